@@ -1,6 +1,10 @@
 package pool
 
-import "expvar"
+import (
+	"expvar"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
 
 const (
 	// ExpvarKeyGets is the key name for the expvar that captures pool
@@ -26,6 +30,11 @@ func (i instrument) Get() (string, error) {
 	return i.next.Get()
 }
 
+func (i instrument) GetEndpoints() (string, map[string]resolve.Endpoint, error) {
+	gets.Add(1)
+	return GetEndpoints(i.next)
+}
+
 func (i instrument) Close() {
 	i.next.Close()
 }
@@ -7,11 +7,12 @@ import (
 	"testing"
 
 	"github.com/peterbourgon/srvproxy/pool"
+	"github.com/peterbourgon/srvproxy/resolve"
 )
 
 func TestGets(t *testing.T) {
 	var p pool.Pool
-	p = pool.RoundRobin([]string{"≠"})
+	p = pool.RoundRobin(resolve.ParseEndpoints([]string{"≠"}))
 	p = pool.Instrument(p)
 	p = pool.Report(ioutil.Discard, p)
 
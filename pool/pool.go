@@ -1,6 +1,10 @@
 package pool
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
 
 var (
 	// ErrNoHosts indicates a pool is empty.
@@ -14,5 +18,40 @@ type Pool interface {
 	Close()
 }
 
-// Factory converts a slice of hosts to a Pool.
-type Factory func([]string) Pool
+// EndpointPool is a Pool that knows the endpoints behind the hosts it
+// yields. The Pool returned by Stream is one, and so are Report and
+// Instrument, if the Pool they wrap is.
+type EndpointPool interface {
+	Pool
+
+	// GetEndpoints is like Get, but also returns the endpoints the host was
+	// picked from, keyed by host, so that the endpoint behind the host, and
+	// its peers, can be found. The map must not be modified.
+	GetEndpoints() (host string, endpoints map[string]resolve.Endpoint, err error)
+}
+
+// GetEndpoints gets a host from p, along with the endpoints it was picked
+// from, if p is an EndpointPool. Otherwise, the endpoints are nil.
+func GetEndpoints(p Pool) (string, map[string]resolve.Endpoint, error) {
+	if ep, ok := p.(EndpointPool); ok {
+		return ep.GetEndpoints()
+	}
+	host, err := p.Get()
+	return host, nil, err
+}
+
+// Factory converts a slice of endpoints to a Pool.
+type Factory func([]resolve.Endpoint) Pool
+
+// HostFactory converts a slice of hosts to a Pool. It's the string-based form
+// of Factory; wrap it with FromHosts to use it as one.
+type HostFactory func([]string) Pool
+
+// FromHosts converts a HostFactory to a Factory. Each endpoint is passed to
+// the HostFactory in its host:port form, and all other information about it
+// is discarded.
+func FromHosts(f HostFactory) Factory {
+	return func(endpoints []resolve.Endpoint) Pool {
+		return f(resolve.Hosts(endpoints))
+	}
+}
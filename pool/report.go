@@ -3,6 +3,8 @@ package pool
 import (
 	"encoding/json"
 	"io"
+
+	"github.com/peterbourgon/srvproxy/resolve"
 )
 
 // Report logs JSON-encoded pool operations for the wrapped pool to the passed
@@ -29,6 +31,12 @@ func (r *report) Get() (string, error) {
 	return host, err
 }
 
+func (r *report) GetEndpoints() (string, map[string]resolve.Endpoint, error) {
+	host, endpoints, err := GetEndpoints(r.next)
+	r.enc.Encode(poolGet{host, err})
+	return host, endpoints, err
+}
+
 func (r *report) Close() {
 	r.next.Close()
 }
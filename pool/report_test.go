@@ -6,12 +6,13 @@ import (
 	"time"
 
 	"github.com/peterbourgon/srvproxy/pool"
+	"github.com/peterbourgon/srvproxy/resolve"
 )
 
 func TestReport(t *testing.T) {
 	buf := &bytes.Buffer{}
-	resolver := &fixedResolver{[]string{"foo"}, time.Millisecond}
-	pool := pool.Report(buf, pool.Stream(resolver, "irrelevant", pool.RoundRobin))
+	resolver := &fixedResolver{hosts: []string{"foo"}, ttl: time.Millisecond}
+	pool := pool.Report(buf, pool.Stream(resolve.FromHosts(resolver), "irrelevant", pool.RoundRobin))
 	if _, err := pool.Get(); err != nil {
 		t.Fatal(err)
 	}
@@ -1,11 +1,16 @@
 package pool
 
-import "sync"
+import (
+	"sync"
 
-// RoundRobin returns a plain round-robining Pool. Close is a no-op.
-func RoundRobin(hosts []string) Pool {
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+// RoundRobin returns a plain round-robining Pool. Priority and weight are
+// ignored. Close is a no-op.
+func RoundRobin(endpoints []resolve.Endpoint) Pool {
 	return &roundRobin{
-		hosts: hosts,
+		hosts: resolve.Hosts(endpoints),
 	}
 }
 
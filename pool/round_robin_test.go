@@ -5,12 +5,13 @@ import (
 	"testing"
 
 	"github.com/peterbourgon/srvproxy/pool"
+	"github.com/peterbourgon/srvproxy/resolve"
 )
 
 func TestRoundRobin(t *testing.T) {
 	var (
 		hosts = []string{"a", "b", "c"}
-		p     = pool.RoundRobin(hosts)
+		p     = pool.RoundRobin(resolve.ParseEndpoints(hosts))
 		want  = []string{"a", "b", "c", "a", "b", "c", "a"}
 		have  []string
 	)
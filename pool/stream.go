@@ -2,91 +2,232 @@ package pool
 
 import (
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/peterbourgon/srvproxy/resolve"
 )
 
 // Stream returns a Pool, created via the Factory, that's continuously updated
-// with hosts resolved from the name.
-func Stream(r resolve.Resolver, name string, f Factory) Pool {
+// with endpoints resolved from the name. If the Resolver is also a
+// resolve.Watcher, updates are taken from its Watch method as they happen.
+// Otherwise, the Resolver is polled each time its TTL expires, and each
+// lookup is bounded by the lookup timeout.
+//
+// Stream returns immediately, and resolution happens in the background. Until
+// the first resolution completes, Get waits for it, but no longer than the
+// lookup timeout; after that, Get is served from the endpoints at hand, which
+// may be none. If resolution fails, the Pool keeps its current endpoints; if
+// it has none, Get returns the resolution error, e.g. a *resolve.BogusError,
+// rather than ErrNoHosts.
+//
+// Resolution never blocks Get. Each update is applied by replacing the
+// current Pool, which Get loads atomically, and then closing the old one, so
+// Pools created by the Factory must be safe for concurrent use, and must
+// tolerate Get after Close.
+//
+// The returned Pool is an EndpointPool: each Pool is published together with
+// the endpoints it was created from, so a host is never matched against the
+// endpoints of another update.
+func Stream(r resolve.Resolver, name string, f Factory, options ...StreamOption) Pool {
 	s := &stream{
-		getc:   make(chan getRequest),
-		closec: make(chan chan struct{}),
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+		timeout: defaultLookupTimeout,
 	}
+	s.setOptions(options...)
 
-	hosts, ttl := mustResolve(r, name, []string{})
-	go s.loop(r, name, hosts, time.After(ttl), f)
+	if s.metrics != nil {
+		r = resolve.Instrument(r, s.metrics)
+	}
+	w, ok := r.(resolve.Watcher)
+	if !ok {
+		w = resolve.Poll(resolve.Timeout(r, s.timeout))
+	}
+
+	go s.loop(w.Watch(name, s.done), name, f)
 
 	return s
 }
 
+const defaultLookupTimeout = 5 * time.Second
+
+// StreamOption sets a specific option for Stream. This is the functional
+// options idiom.
+type StreamOption func(*stream)
+
+// LookupTimeout sets how long each lookup may take before it's abandoned,
+// and how long Get waits for the first one. Watchers manage their own
+// requests, so for them, only the latter applies. A non-positive value
+// disables the timeout. If LookupTimeout isn't provided, a default value of 5
+// seconds is used.
+func LookupTimeout(d time.Duration) StreamOption {
+	return func(s *stream) { s.timeout = d }
+}
+
+// Metrics records each lookup of the name with m, or each update if the
+// Resolver is a Watcher, and each change to its endpoints, as the number of
+// hosts added and removed. If Metrics isn't provided, nothing is recorded.
+func Metrics(m resolve.Metrics) StreamOption {
+	return func(s *stream) { s.metrics = m }
+}
+
 type stream struct {
-	getc   chan getRequest
-	closec chan chan struct{}
+	state   atomic.Pointer[streamState] // nil until ready is closed
+	first   *streamState                // serves the Gets held back by ready
+	ready   chan struct{}
+	done    chan struct{} // closed by Close, to stop the watch and the loop
+	exited  chan struct{} // closed when the loop returns
+	once    sync.Once
+	timeout time.Duration
+	metrics resolve.Metrics
+}
+
+// streamState is what Get is served from: the current Pool, the endpoints it
+// was created from, and the error of the last update, if it failed. It's
+// replaced as a whole, never modified.
+type streamState struct {
+	pool      Pool
+	endpoints map[string]resolve.Endpoint // by host
+	lastErr   error
+}
+
+func (s *stream) setOptions(options ...StreamOption) {
+	for _, f := range options {
+		f(s)
+	}
 }
 
 func (s *stream) Get() (string, error) {
-	req := getRequest{make(chan string), make(chan error)}
-	s.getc <- req
-
-	select {
-	case host := <-req.hostc:
-		return host, nil
-	case err := <-req.errc:
-		return "", err
+	host, _, err := s.GetEndpoints()
+	return host, err
+}
+
+func (s *stream) GetEndpoints() (string, map[string]resolve.Endpoint, error) {
+	st := s.state.Load()
+	if st == nil {
+		<-s.ready
+		st = s.first
 	}
+
+	// If the pool is empty, and resolution has failed, the resolution error
+	// is more useful than ErrNoHosts.
+	host, err := st.pool.Get()
+	if err == ErrNoHosts && st.lastErr != nil {
+		err = st.lastErr
+	}
+	return host, st.endpoints, err
 }
 
 func (s *stream) Close() {
-	q := make(chan struct{})
-	s.closec <- q
-	<-q
+	s.once.Do(func() { close(s.done) })
+	<-s.exited
 }
 
-func (s *stream) loop(r resolve.Resolver, name string, hosts []string, refreshc <-chan time.Time, f Factory) {
-	pool := f(hosts)
+// loop applies updates, and publishes the result for Get. It's the only
+// writer of the state.
+func (s *stream) loop(updates <-chan resolve.Update, name string, f Factory) {
+	defer close(s.exited)
+	var (
+		endpoints = []resolve.Endpoint{}
+		lastErr   error                       // of the last update, if it failed
+		pool      Pool                        // created once we stop waiting for the first update
+		byHost    map[string]resolve.Endpoint // what pool was created from
+		waiting   = true
+		initial   <-chan time.Time
+	)
+	if s.timeout > 0 {
+		t := time.NewTimer(s.timeout)
+		defer t.Stop()
+		initial = t.C
+	}
+
+	// publish creates the Pool if need be, makes it visible to Get, and
+	// releases the Gets held back until now.
+	publish := func() {
+		if pool == nil {
+			pool, byHost = f(endpoints), indexHosts(endpoints)
+		}
+		st := &streamState{pool: pool, endpoints: byHost, lastErr: lastErr}
+		s.state.Store(st)
+		if waiting {
+			s.first = st
+			close(s.ready)
+			waiting, initial = false, nil
+		}
+	}
+
 	for {
 		select {
-		case <-refreshc:
-			newHosts, ttl := mustResolve(r, name, hosts)
-			refreshc = time.After(ttl)
-
-			// Only re-build the Pool if the hosts have changed.
-			if reflect.DeepEqual(newHosts, hosts) {
-				continue
+		case u, ok := <-updates:
+			var old Pool
+			switch {
+			case !ok:
+				updates = nil // the watch ended; keep what we have
+
+			// Keep the current endpoints if resolution failed, and only
+			// re-build the Pool if the endpoints have changed.
+			case u.Err != nil:
+				lastErr = u.Err
+
+			case reflect.DeepEqual(u.Endpoints, endpoints):
+				lastErr = nil
+
+			default:
+				if s.metrics != nil {
+					added, removed := diff(endpoints, u.Endpoints)
+					s.metrics.Change(name, added, removed, len(u.Endpoints))
+				}
+				endpoints, lastErr = u.Endpoints, nil
+				if pool != nil {
+					old = pool
+					pool, byHost = f(endpoints), indexHosts(endpoints)
+				}
 			}
-
-			pool.Close() // close the old
-			hosts = newHosts
-			pool = f(hosts) // create the new
-
-		case req := <-s.getc:
-			host, err := pool.Get()
-			if err != nil {
-				req.errc <- err
-				continue
+			publish()
+			if old != nil {
+				old.Close() // Gets that loaded it before publish may still use it
 			}
 
-			req.hostc <- host
+		case <-initial:
+			publish() // resolution is slow; don't hold requests up any longer
 
-		case q := <-s.closec:
-			close(q)
+		case <-s.done:
+			publish()
+			pool.Close()
 			return
 		}
 	}
 }
 
-func mustResolve(r resolve.Resolver, name string, currentHosts []string) ([]string, time.Duration) {
-	hosts, ttl, err := r.Resolve(name)
-	if err != nil {
-		hosts = currentHosts
-		ttl = time.Second
+// indexHosts returns the endpoints, keyed by host.
+func indexHosts(endpoints []resolve.Endpoint) map[string]resolve.Endpoint {
+	m := make(map[string]resolve.Endpoint, len(endpoints))
+	for _, endpoint := range endpoints {
+		m[endpoint.String()] = endpoint
 	}
-	return hosts, ttl
+	return m
 }
 
-type getRequest struct {
-	hostc chan string
-	errc  chan error
+// diff returns the number of hosts in next but not prev, and vice versa.
+// Endpoints whose other fields changed, e.g. their weights, don't count.
+func diff(prev, next []resolve.Endpoint) (added, removed int) {
+	hosts := map[string]int{}
+	for _, host := range resolve.Hosts(prev) {
+		hosts[host]--
+	}
+	for _, host := range resolve.Hosts(next) {
+		hosts[host]++
+	}
+	for _, n := range hosts {
+		switch {
+		case n > 0:
+			added += n
+		case n < 0:
+			removed -= n
+		}
+	}
+	return added, removed
 }
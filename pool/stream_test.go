@@ -1,19 +1,24 @@
 package pool_test
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/peterbourgon/srvproxy/pool"
+	"github.com/peterbourgon/srvproxy/resolve"
 )
 
 func TestStream(t *testing.T) {
 	a := "≠≠≠≠≠"
 	b := "•••••"
-	d := time.Millisecond
-	r := &fixedResolver{[]string{a}, d}
-	p := pool.Stream(r, "irrelevant", pool.RoundRobin)
+	d := time.Second
+	r := &fixedResolver{hosts: []string{a}, ttl: d}
+	p := pool.Stream(resolve.FromHosts(r), "irrelevant", pool.RoundRobin)
 
 	if err := waitGet(p, time.Millisecond); err != nil {
 		t.Fatal(err)
@@ -28,7 +33,7 @@ func TestStream(t *testing.T) {
 		t.Errorf("want %q, have %q", want, have)
 	}
 
-	r.hosts = []string{b}
+	r.setHosts([]string{b})
 	time.Sleep(3 * (d / 2))
 
 	have, err = p.Get()
@@ -41,15 +46,263 @@ func TestStream(t *testing.T) {
 	}
 }
 
+func TestStreamEndpoints(t *testing.T) {
+	want := []resolve.Endpoint{
+		{Address: "a", Port: 80, Priority: 1, Weight: 10, Labels: map[string]string{"zone": "a"}},
+		{Address: "b", Port: 80, Priority: 2, Weight: 0},
+	}
+	r := resolve.ResolverFunc(func(string) ([]resolve.Endpoint, time.Duration, error) {
+		return want, time.Minute, nil
+	})
+
+	havec := make(chan []resolve.Endpoint, 1)
+	f := func(endpoints []resolve.Endpoint) pool.Pool {
+		havec <- endpoints
+		return pool.RoundRobin(endpoints)
+	}
+	p := pool.Stream(r, "irrelevant", f)
+	defer p.Close()
+
+	if have := <-havec; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+}
+
+func TestStreamGetEndpoints(t *testing.T) {
+	// Every update changes the endpoints, but each host must be found among
+	// the endpoints returned with it, through Report and Instrument too.
+	var (
+		mtx sync.Mutex
+		n   int
+	)
+	r := resolve.ResolverFunc(func(string) ([]resolve.Endpoint, time.Duration, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		n++
+		return resolve.ParseEndpoints([]string{fmt.Sprintf("10.0.0.%d:80", n%250+1)}), 0, nil
+	})
+	p := pool.Instrument(pool.Report(nil, pool.Stream(r, "irrelevant", pool.RoundRobin)))
+	defer p.Close()
+
+	for i := 0; i < 1000; i++ {
+		host, endpoints, err := pool.GetEndpoints(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := endpoints[host]; !ok {
+			t.Fatalf("%s: not in %v", host, endpoints)
+		}
+	}
+}
+
+func TestStreamWatcher(t *testing.T) {
+	w := &fakeWatcher{updates: make(chan resolve.Update)}
+	go func() { w.updates <- resolve.Update{Endpoints: resolve.ParseEndpoints([]string{"a"})} }()
+	p := pool.Stream(w, "irrelevant", pool.RoundRobin)
+
+	if have, err := p.Get(); err != nil || have != "a" {
+		t.Fatalf("want %q, have %q (%v)", "a", have, err)
+	}
+
+	// Errors shouldn't disturb the current endpoints.
+	w.updates <- resolve.Update{Err: errors.New("transient")}
+	if have, err := p.Get(); err != nil || have != "a" {
+		t.Fatalf("want %q, have %q (%v)", "a", have, err)
+	}
+
+	// Updates should be applied as soon as they're pushed, regardless of TTL.
+	w.updates <- resolve.Update{Endpoints: resolve.ParseEndpoints([]string{"b"})}
+	if have, err := p.Get(); err != nil || have != "b" {
+		t.Fatalf("want %q, have %q (%v)", "b", have, err)
+	}
+
+	// Closing the pool should end the watch.
+	p.Close()
+	select {
+	case <-w.done:
+	case <-time.After(time.Second):
+		t.Error("watch wasn't stopped")
+	}
+	if w.resolves != 0 {
+		t.Errorf("want no calls to Resolve, have %d", w.resolves)
+	}
+}
+
+func TestStreamSlowResolver(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	r := resolve.ResolverFunc(func(string) ([]resolve.Endpoint, time.Duration, error) {
+		<-release
+		return resolve.ParseEndpoints([]string{"a"}), time.Hour, nil
+	})
+
+	begin := time.Now()
+	p := pool.Stream(r, "irrelevant", pool.RoundRobin, pool.LookupTimeout(10*time.Millisecond))
+	defer p.Close()
+
+	if _, err := p.Get(); err != pool.ErrNoHosts {
+		t.Errorf("want %v, have %v", pool.ErrNoHosts, err)
+	}
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("Get took %s, want it bounded by the lookup timeout", took)
+	}
+}
+
+func TestStreamLookupError(t *testing.T) {
+	lookupErr := &resolve.BogusError{Name: "irrelevant", Type: "SRV", Reason: "bad signature"}
+	r := resolve.ResolverFunc(func(string) ([]resolve.Endpoint, time.Duration, error) {
+		return nil, time.Hour, lookupErr
+	})
+
+	p := pool.Stream(r, "irrelevant", pool.RoundRobin)
+	defer p.Close()
+
+	// With no endpoints to fall back on, the lookup error is the news.
+	if _, err := p.Get(); err != lookupErr {
+		t.Errorf("want %v, have %v", lookupErr, err)
+	}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	w := &fakeWatcher{updates: make(chan resolve.Update)}
+	m := &fakeMetrics{}
+	go func() { w.updates <- resolve.Update{Endpoints: resolve.ParseEndpoints([]string{"a", "b"})} }()
+	p := pool.Stream(w, "users", pool.RoundRobin, pool.Metrics(m))
+	defer p.Close()
+
+	if _, err := p.Get(); err != nil {
+		t.Fatal(err)
+	}
+	w.updates <- resolve.Update{Err: errors.New("transient")}
+	w.updates <- resolve.Update{Endpoints: resolve.ParseEndpoints([]string{"b", "c"})}
+
+	// Updates pass through the instrumented watcher on their way to the
+	// pool, so there's nothing to synchronize with but the metrics.
+	deadline := time.Now().Add(time.Second)
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for len(m.changes) < 2 && time.Now().Before(deadline) {
+		m.mtx.Unlock()
+		time.Sleep(time.Millisecond)
+		m.mtx.Lock()
+	}
+	if want, have := []string{"users 2 <nil>", "users 0 transient", "users 2 <nil>"}, m.updates; !reflect.DeepEqual(want, have) {
+		t.Errorf("want updates %q, have %q", want, have)
+	}
+	if len(m.lookups) > 0 {
+		t.Errorf("want no lookups, have %q", m.lookups)
+	}
+	if want, have := []string{"users +2 -0 =2", "users +1 -1 =2"}, m.changes; !reflect.DeepEqual(want, have) {
+		t.Errorf("want changes %q, have %q", want, have)
+	}
+}
+
+func BenchmarkStreamGet(b *testing.B) {
+	r := resolve.ResolverFunc(func(string) ([]resolve.Endpoint, time.Duration, error) {
+		return resolve.ParseEndpoints([]string{"a", "b", "c", "d"}), time.Hour, nil
+	})
+
+	for _, f := range []struct {
+		name    string
+		factory pool.Factory
+	}{
+		{"RoundRobin", pool.RoundRobin},
+		{"Weighted", pool.Weighted},
+	} {
+		p := pool.Stream(r, "irrelevant", f.factory)
+		if err := waitGet(p, time.Second); err != nil {
+			b.Fatal(err)
+		}
+
+		for _, procs := range []int{1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("%s/procs=%d", f.name, procs), func(b *testing.B) {
+				defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if _, err := p.Get(); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+		p.Close()
+	}
+}
+
+func TestFromHosts(t *testing.T) {
+	var have []string
+	f := pool.FromHosts(func(hosts []string) pool.Pool {
+		have = hosts
+		return pool.RoundRobin(resolve.ParseEndpoints(hosts))
+	})
+	f([]resolve.Endpoint{{Address: "a", Port: 80}, {Address: "fd00::1", Port: 80}})
+
+	if want := []string{"a:80", "[fd00::1]:80"}; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
 type fixedResolver struct {
+	mtx   sync.Mutex
 	hosts []string
 	ttl   time.Duration
 }
 
 func (r *fixedResolver) Resolve(_ string) ([]string, time.Duration, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
 	return r.hosts, r.ttl, nil
 }
 
+func (r *fixedResolver) setHosts(hosts []string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.hosts = hosts
+}
+
+type fakeWatcher struct {
+	updates  chan resolve.Update
+	done     <-chan struct{}
+	resolves int
+}
+
+func (w *fakeWatcher) Resolve(string) ([]resolve.Endpoint, time.Duration, error) {
+	w.resolves++
+	return nil, time.Hour, errors.New("not implemented")
+}
+
+func (w *fakeWatcher) Watch(_ string, done <-chan struct{}) <-chan resolve.Update {
+	w.done = done
+	return w.updates
+}
+
+type fakeMetrics struct {
+	mtx     sync.Mutex
+	lookups []string
+	updates []string
+	changes []string
+}
+
+func (m *fakeMetrics) Lookup(name string, _ time.Duration, endpoints []resolve.Endpoint, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.lookups = append(m.lookups, fmt.Sprintf("%s %d %v", name, len(endpoints), err))
+}
+
+func (m *fakeMetrics) Update(name string, endpoints []resolve.Endpoint, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.updates = append(m.updates, fmt.Sprintf("%s %d %v", name, len(endpoints), err))
+}
+
+func (m *fakeMetrics) Change(name string, added, removed, total int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.changes = append(m.changes, fmt.Sprintf("%s +%d -%d =%d", name, added, removed, total))
+}
+
 func waitGet(p pool.Pool, max time.Duration) error {
 	deadline := time.Now().Add(max)
 	for {
@@ -0,0 +1,69 @@
+package pool
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+// Weighted returns a Pool that selects endpoints the way RFC 2782 describes
+// for SRV records. Only endpoints in the lowest priority group are used.
+// Within that group, endpoints are picked at random in proportion to their
+// weight, and endpoints with zero weight are only picked when every endpoint
+// in the group has zero weight, in which case they're picked uniformly. Close
+// is a no-op.
+func Weighted(endpoints []resolve.Endpoint) Pool {
+	w := &weighted{}
+	if len(endpoints) <= 0 {
+		return w
+	}
+
+	priority := endpoints[0].Priority
+	for _, e := range endpoints[1:] {
+		if e.Priority < priority {
+			priority = e.Priority
+		}
+	}
+
+	var standby []string
+	for _, e := range endpoints {
+		switch {
+		case e.Priority != priority:
+			continue
+		case e.Weight == 0:
+			standby = append(standby, e.String())
+		default:
+			w.total += int(e.Weight)
+			w.hosts = append(w.hosts, e.String())
+			w.sums = append(w.sums, w.total)
+		}
+	}
+
+	if w.total <= 0 {
+		// Only zero-weight endpoints are left: treat them as equals.
+		for i, host := range standby {
+			w.hosts = append(w.hosts, host)
+			w.sums = append(w.sums, i+1)
+		}
+		w.total = len(standby)
+	}
+	return w
+}
+
+type weighted struct {
+	hosts []string
+	sums  []int // running sum of weights, parallel to hosts
+	total int
+}
+
+func (w *weighted) Get() (string, error) {
+	if w.total <= 0 {
+		return "", ErrNoHosts
+	}
+	n := rand.Intn(w.total)
+	i := sort.Search(len(w.sums), func(i int) bool { return w.sums[i] > n })
+	return w.hosts[i], nil
+}
+
+func (w *weighted) Close() {}
@@ -0,0 +1,64 @@
+package pool_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/peterbourgon/srvproxy/pool"
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestWeighted(t *testing.T) {
+	p := pool.Weighted([]resolve.Endpoint{
+		{Address: "a", Port: 80, Priority: 1, Weight: 75},
+		{Address: "b", Port: 80, Priority: 1, Weight: 25},
+		{Address: "c", Port: 80, Priority: 1, Weight: 0},
+		{Address: "standby", Port: 80, Priority: 10, Weight: 100},
+	})
+
+	n := 10000
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		host, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[host]++
+	}
+
+	for host, want := range map[string]float64{"a:80": 0.75, "b:80": 0.25, "c:80": 0, "standby:80": 0} {
+		if have := float64(counts[host]) / float64(n); math.Abs(want-have) > 0.05 {
+			t.Errorf("%s: want share %.2f, have %.2f", host, want, have)
+		}
+	}
+}
+
+func TestWeightedZeroWeights(t *testing.T) {
+	p := pool.Weighted([]resolve.Endpoint{
+		{Address: "a", Port: 80, Priority: 10, Weight: 0},
+		{Address: "b", Port: 80, Priority: 10, Weight: 0},
+		{Address: "standby", Port: 80, Priority: 20, Weight: 100},
+	})
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		host, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[host]++
+	}
+
+	if counts["a:80"] == 0 || counts["b:80"] == 0 {
+		t.Errorf("want both zero-weight endpoints picked, have %v", counts)
+	}
+	if counts["standby:80"] != 0 {
+		t.Errorf("want lower priority group unused, have %v", counts)
+	}
+}
+
+func TestWeightedEmpty(t *testing.T) {
+	if _, err := pool.Weighted(nil).Get(); err != pool.ErrNoHosts {
+		t.Errorf("want %v, have %v", pool.ErrNoHosts, err)
+	}
+}
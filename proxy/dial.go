@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// defaultAttemptDelay is the Connection Attempt Delay recommended by RFC 8305
+// section 5.
+const defaultAttemptDelay = 250 * time.Millisecond
+
+// alternatesKey is the context key under which RoundTrip passes the addresses
+// of the other endpoints of the same target to the dialer.
+type alternatesKey struct{}
+
+// withAlternates returns a context carrying the alternate addresses for
+// address. The address itself comes first.
+func withAlternates(ctx context.Context, address string, alternates []string) context.Context {
+	return context.WithValue(ctx, alternatesKey{}, append([]string{address}, alternates...))
+}
+
+// targetKey is the context key under which RoundTrip passes the
+// resolve.TargetLabel of the endpoint a request is sent to, if any, to the
+// dialer.
+type targetKey struct{}
+
+// target is the SRV target behind an address.
+type target struct {
+	address string
+	name    string
+}
+
+// withTarget returns a context carrying the SRV target behind address.
+func withTarget(ctx context.Context, address, name string) context.Context {
+	return context.WithValue(ctx, targetKey{}, target{address, name})
+}
+
+// DialTLS returns a dial function for http.Transport.DialTLSContext that
+// connects via dial, and then performs a TLS handshake with config. If dial
+// is nil, the zero net.Dialer is used; if config is nil, the zero tls.Config
+// is used, which verifies the server against the system roots.
+//
+// Requests sent by the Proxy to endpoints with a resolve.TargetLabel, as
+// expanded by resolve.ExpandTargets, are addressed to an IP address, but the
+// server's certificate is for the target. So for them, the target is the
+// server name that's sent and verified. Otherwise, it's config.ServerName,
+// or else the host that's dialed.
+//
+// Use it in the transport passed to Next, with HappyEyeballs if need be, e.g.
+//
+//	proxy.Next(&http.Transport{DialTLSContext: proxy.DialTLS(proxy.HappyEyeballs(nil), nil)})
+func DialTLS(dial func(ctx context.Context, network, address string) (net.Conn, error), config *tls.Config) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		c := config.Clone()
+		if t, ok := ctx.Value(targetKey{}).(target); ok && t.address == address {
+			c.ServerName = t.name
+		} else if c.ServerName == "" {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			c.ServerName = host
+		}
+
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, c)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// HappyEyeballs returns a dial function for http.Transport.DialContext that
+// connects to dual-stack hosts as specified by RFC 8305. Connection attempts
+// to the addresses of a host are started one after the other, alternating
+// between IPv6 and IPv4, each one as soon as the previous one fails or
+// after a delay. The first connection to be established is used, and the
+// others are closed, so that an unreachable address family costs no more
+// than the delay.
+//
+// The addresses are those of the endpoints that share the resolve.TargetLabel
+// of the endpoint a request was sent to by the Proxy, which is the case for
+// endpoints expanded by resolve.ExpandTargets. Hostnames are looked up with
+// the Dialer's Resolver. The delay is the Dialer's FallbackDelay, or 250ms if
+// it's zero. If d is nil, the zero Dialer is used.
+//
+// Use it in the transport passed to Next, e.g.
+//
+//	proxy.Next(&http.Transport{DialContext: proxy.HappyEyeballs(nil)})
+func HappyEyeballs(d *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	delay := d.FallbackDelay
+	if delay <= 0 {
+		delay = defaultAttemptDelay
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		addrs, err := dialAddrs(ctx, d, address)
+		if err != nil {
+			return nil, err
+		}
+		return race(ctx, d, network, interleave(addrs), delay)
+	}
+}
+
+// dialAddrs returns the addresses to try for address: the alternates passed
+// by RoundTrip, if any, or else the addresses of its host, or else address
+// itself if its host is an IP address.
+func dialAddrs(ctx context.Context, d *net.Dialer, address string) ([]string, error) {
+	if alternates, ok := ctx.Value(alternatesKey{}).([]string); ok && len(alternates) > 0 && alternates[0] == address {
+		return alternates, nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{address}, nil
+	}
+
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ipaddrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ipaddrs))
+	for _, ipaddr := range ipaddrs {
+		addrs = append(addrs, net.JoinHostPort(ipaddr.String(), port))
+	}
+	return addrs, nil
+}
+
+// interleave reorders addrs so that they alternate between address families,
+// starting with the family of the first one, and otherwise keeping their
+// order; see RFC 8305 section 4.
+func interleave(addrs []string) []string {
+	var first, second []string
+	for _, addr := range addrs {
+		if len(first) <= 0 || isIPv6(addr) == isIPv6(first[0]) {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	ordered := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+func isIPv6(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// race dials addrs in order, starting each attempt when the previous one
+// fails, or after delay, and returns the first connection established. If
+// every attempt fails, it returns the first error.
+func race(ctx context.Context, d *net.Dialer, network string, addrs []string, delay time.Duration) (net.Conn, error) {
+	if len(addrs) <= 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("no addresses to dial")}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	var (
+		results  = make(chan result, len(addrs))
+		next     = 0
+		pending  = 0
+		firstErr error
+	)
+	start := func() {
+		go func(addr string) {
+			conn, err := d.DialContext(ctx, network, addr)
+			results <- result{conn, err}
+		}(addrs[next])
+		next++
+		pending++
+	}
+
+	start()
+	for pending > 0 {
+		var timer <-chan time.Time
+		if next < len(addrs) {
+			timer = time.After(delay)
+		}
+		select {
+		case <-timer:
+			start()
+
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// The losers are cancelled, but may connect anyway.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		}
+	}
+	return nil, firstErr
+}
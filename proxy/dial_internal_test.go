@@ -0,0 +1,14 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRaceNoAddrs(t *testing.T) {
+	if _, err := race(context.Background(), &net.Dialer{}, "tcp", nil, time.Millisecond); err == nil {
+		t.Error("want error, have none")
+	}
+}
@@ -0,0 +1,164 @@
+package proxy_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/proxy"
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestHappyEyeballs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.ParseUint(port, 10, 16)
+
+	// The IPv6 path is a black hole: connection attempts never complete.
+	blackhole := net.JoinHostPort("::1", port)
+	dialer := &net.Dialer{
+		FallbackDelay: 50 * time.Millisecond,
+		ControlContext: func(ctx context.Context, _, address string, _ syscall.RawConn) error {
+			if address == blackhole {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		},
+	}
+
+	target := map[string]string{resolve.TargetLabel: "a.internal"}
+	endpoints := []resolve.Endpoint{
+		{Address: "::1", Port: uint16(p), Labels: target},
+		{Address: "127.0.0.1", Port: uint16(p), Labels: target},
+	}
+	resolver := resolve.ResolverFunc(func(string) ([]resolve.Endpoint, time.Duration, error) {
+		return endpoints, time.Minute, nil
+	})
+	rt := proxy.Proxy(
+		proxy.Resolver(resolver),
+		proxy.Next(&http.Transport{DialContext: proxy.HappyEyeballs(dialer), DisableKeepAlives: true}),
+	)
+
+	for i := 0; i < 2*len(endpoints); i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		req, _ := http.NewRequestWithContext(ctx, "GET", "dummy://foo.bar.net/", nil)
+		begin := time.Now()
+		resp, err := rt.RoundTrip(req)
+		cancel()
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		resp.Body.Close()
+		if took := time.Since(begin); took > time.Second {
+			t.Errorf("request %d: took %s", i, took)
+		}
+	}
+}
+
+func TestHappyEyeballsRefused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	// Nothing listens on [::1] at the server's port, or IPv6 is unavailable;
+	// either way, the attempt fails and IPv4 is tried immediately.
+	dial := proxy.HappyEyeballs(&net.Dialer{FallbackDelay: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dial(ctx, "tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestDialTLS(t *testing.T) {
+	// The certificate is for the SRV target, not for the address that's
+	// dialed, as is usual for endpoints expanded by resolve.ExpandTargets.
+	cert, roots := newCertificate(t, "a.internal")
+	var hosts []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.ParseUint(port, 10, 16)
+
+	endpoints := []resolve.Endpoint{{Address: "127.0.0.1", Port: uint16(p), Labels: map[string]string{resolve.TargetLabel: "a.internal"}}}
+	resolver := resolve.ResolverFunc(func(string) ([]resolve.Endpoint, time.Duration, error) {
+		return endpoints, time.Minute, nil
+	})
+	rt := proxy.Proxy(
+		proxy.Resolver(resolver),
+		proxy.Scheme("https"),
+		proxy.Next(&http.Transport{DialTLSContext: proxy.DialTLS(nil, &tls.Config{RootCAs: roots}), DisableKeepAlives: true}),
+	)
+
+	req, _ := http.NewRequest("GET", "dummy://foo.bar.net/", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Without a Host of its own, the request is for the target.
+	req.Host = ""
+	resp, err = rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if want := []string{"foo.bar.net", "a.internal:" + port}; !reflect.DeepEqual(want, hosts) {
+		t.Errorf("want Hosts %v, have %v", want, hosts)
+	}
+}
+
+// newCertificate returns a self-signed certificate for name, and a pool of
+// roots that trusts it.
+func newCertificate(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
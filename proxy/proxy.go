@@ -3,7 +3,11 @@ package proxy
 import (
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/peterbourgon/srvproxy/pool"
 	"github.com/peterbourgon/srvproxy/resolve"
@@ -14,42 +18,85 @@ import (
 func Proxy(options ...Option) http.RoundTripper {
 	p := &proxy{
 		next:         http.DefaultTransport,
+		nextH2:       nil,
 		scheme:       "http",
-		resolver:     resolve.ResolverFunc(resolve.DNSSRV),
+		schemeFunc:   ALPNScheme,
+		resolver:     resolve.ContextResolverFunc(resolve.DNSSRVContext),
 		poolReporter: nil,
 		factory:      pool.RoundRobin,
+		streamOpts:   nil,
+		rules:        nil,
 		registry:     nil,
 	}
 	p.setOptions(options...)
-	p.registry = newRegistry(p.resolver, p.poolReporter, p.factory)
+	if len(p.rules) > 0 {
+		p.resolver = resolve.Rewrite(p.resolver, p.rules...)
+	}
+	p.registry = newRegistry(p.resolver, p.poolReporter, p.factory, p.streamOpts...)
 	return p
 }
 
 type proxy struct {
 	next         http.RoundTripper
+	nextH2       http.RoundTripper
 	scheme       string
+	schemeFunc   func(resolve.Endpoint) string
 	resolver     resolve.Resolver
 	poolReporter io.Writer
 	factory      pool.Factory
+	streamOpts   []pool.StreamOption
+	rules        []resolve.Rule
 	registry     *registry
 }
 
 func (p *proxy) RoundTrip(req *http.Request) (*http.Response, error) {
-	host, err := p.registry.get(req.URL.Host).Get()
+	host, endpoints, err := pool.GetEndpoints(p.registry.get(req.URL.Host))
 	if err != nil {
 		return nil, fmt.Errorf("couldn't send request: %v", err)
 	}
 
+	var (
+		scheme, next = p.scheme, p.next
+		ctx          = req.Context()
+		hostHeader   = req.Host
+	)
+	if endpoint, ok := endpoints[host]; ok {
+		if s := p.schemeFunc(endpoint); s != "" {
+			scheme = s
+		}
+		if others := alternates(endpoint, endpoints); len(others) > 0 {
+			ctx = withAlternates(ctx, host, others)
+		}
+		// The endpoint may be an address expanded from an SRV target, which
+		// is what TLS should verify, and what the Host header should name.
+		if name := endpoint.Labels[resolve.TargetLabel]; name != "" {
+			ctx = withTarget(ctx, host, name)
+			switch {
+			case hostHeader != "":
+			case endpoint.Port != 0:
+				hostHeader = net.JoinHostPort(name, strconv.Itoa(int(endpoint.Port)))
+			default:
+				hostHeader = name
+			}
+		}
+	}
+	if scheme == "h2" {
+		scheme = "https"
+		if p.nextH2 != nil {
+			next = p.nextH2
+		}
+	}
+
 	// "RoundTrip should not modify the request, except for
 	// consuming and closing the Body, including on errors."
 	// -- http://golang.org/pkg/net/http/#RoundTripper
 	newurl := (*req.URL)
-	newurl.Scheme = p.scheme
+	newurl.Scheme = scheme
 	newurl.Host = host
 	newreq := (*req)
 	newreq.URL = &newurl
-
-	return p.next.RoundTrip(&newreq)
+	newreq.Host = hostHeader
+	return next.RoundTrip(newreq.WithContext(ctx))
 }
 
 func (p *proxy) setOptions(options ...Option) {
@@ -64,23 +111,73 @@ func (p *proxy) setOptions(options ...Option) {
 type Option func(*proxy)
 
 // Scheme sets the protocol scheme, probably "http" or "https". If no scheme
-// is provided, "http" is used.
+// is provided, "http" is used. SchemeFunc may override it per endpoint.
 func Scheme(scheme string) Option {
 	return func(p *proxy) { p.scheme = scheme }
 }
 
+// SchemeFunc sets the function that picks the protocol scheme for each
+// endpoint a request is sent to. It may return "h2" for endpoints that only
+// speak HTTP/2, which are sent "https" requests via NextH2. If it returns
+// the empty string, Scheme is used. If SchemeFunc isn't provided, ALPNScheme
+// is used.
+func SchemeFunc(f func(resolve.Endpoint) string) Option {
+	return func(p *proxy) { p.schemeFunc = f }
+}
+
+// ALPNScheme picks the scheme for endpoints that advertise ALPN protocols,
+// as resolved by resolve.SVCB: "h2" if HTTP/2 is the only HTTP protocol
+// they speak, "https" if they speak HTTP/1.1, and the empty string otherwise.
+func ALPNScheme(endpoint resolve.Endpoint) string {
+	var h1, h2 bool
+	for _, id := range strings.Split(endpoint.Labels[resolve.ALPNLabel], ",") {
+		switch id {
+		case "http/1.1":
+			h1 = true
+		case "h2":
+			h2 = true
+		}
+	}
+	switch {
+	case h1:
+		return "https"
+	case h2:
+		return "h2"
+	default:
+		return ""
+	}
+}
+
 // Next sets the http.RoundTripper that's used to transport reconstructed HTTP
 // requests. If Next isn't provided, http.DefaultTransport is used.
 func Next(rt http.RoundTripper) Option {
 	return func(p *proxy) { p.next = rt }
 }
 
+// NextH2 sets the http.RoundTripper that's used to transport requests to
+// endpoints for which the "h2" scheme was picked; see SchemeFunc. If NextH2
+// isn't provided, Next is used, which negotiates HTTP/2 via ALPN if it's
+// like http.DefaultTransport.
+func NextH2(rt http.RoundTripper) Option {
+	return func(p *proxy) { p.nextH2 = rt }
+}
+
 // Resolver sets which name resolver will be used. If Resolver isn't provided,
 // a DNS SRV resolver is used.
 func Resolver(r resolve.Resolver) Option {
 	return func(p *proxy) { p.resolver = r }
 }
 
+// Names sets the rules that map the hosts of request URLs to the names that
+// are resolved, so that URLs can use short hosts like "dnssrv://users/",
+// and the naming scheme of the cluster is configured in one place. The first
+// rule that applies to a host is used; hosts that no rule applies to are
+// resolved as-is. See resolve.Template and resolve.Regexp. If Names isn't
+// provided, hosts are resolved as-is.
+func Names(rules ...resolve.Rule) Option {
+	return func(p *proxy) { p.rules = append(p.rules, rules...) }
+}
+
 // PoolReporter sets the destination where the pool will report each
 // invocation as JSON-encoded events. If PoolReporter isn't provided, the pool
 // won't report any information.
@@ -93,3 +190,18 @@ func PoolReporter(w io.Writer) Option {
 func Factory(f pool.Factory) Option {
 	return func(p *proxy) { p.factory = f }
 }
+
+// LookupTimeout sets how long each name resolution may take before it's
+// abandoned, and how long a request for a new name waits for the first one.
+// Requests are never held up by resolution for longer than that. If
+// LookupTimeout isn't provided, the pool.Stream default is used.
+func LookupTimeout(d time.Duration) Option {
+	return func(p *proxy) { p.streamOpts = append(p.streamOpts, pool.LookupTimeout(d)) }
+}
+
+// Metrics records the resolution of each name, and changes to its hosts,
+// with m, e.g. resolve.Expvar. If Metrics isn't provided, nothing is
+// recorded.
+func Metrics(m resolve.Metrics) Option {
+	return func(p *proxy) { p.streamOpts = append(p.streamOpts, pool.Metrics(m)) }
+}
@@ -1,13 +1,17 @@
 package proxy_test
 
 import (
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/peterbourgon/srvproxy/proxy"
+	"github.com/peterbourgon/srvproxy/resolve"
+	"github.com/peterbourgon/srvproxy/resolve/dnstest"
 )
 
 func TestProxy(t *testing.T) {
@@ -23,7 +27,7 @@ func TestProxy(t *testing.T) {
 	}
 
 	resolver := fixedResolver{[]string{u.Host}, time.Minute}
-	proxy := proxy.Proxy(proxy.Resolver(resolver))
+	proxy := proxy.Proxy(proxy.Resolver(resolve.FromHosts(resolver)))
 	transport := &http.Transport{}
 	transport.RegisterProtocol("dummy", proxy)
 	client := &http.Client{}
@@ -43,6 +47,95 @@ func TestProxy(t *testing.T) {
 	}
 }
 
+func TestProxyDNS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusTeapot) }))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.ParseUint(port, 10, 16)
+
+	dns := dnstest.NewServer()
+	defer dns.Close()
+	dns.SetSRV("_http._tcp.users.internal", dnstest.SRV{Port: uint16(p), Target: "127.0.0.1", TTL: time.Minute})
+
+	rt := proxy.Proxy(proxy.Resolver(dns.Resolver()))
+	req, _ := http.NewRequest("GET", "dnssrv://_http._tcp.users.internal/", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want, have := http.StatusTeapot, resp.StatusCode; want != have {
+		t.Errorf("want HTTP %d, have %d", want, have)
+	}
+}
+
+func TestProxyScheme(t *testing.T) {
+	endpoints := []resolve.Endpoint{{Address: "a", Port: 443, Labels: map[string]string{resolve.ALPNLabel: "h2"}}}
+	resolver := resolve.ResolverFunc(func(string) ([]resolve.Endpoint, time.Duration, error) {
+		return endpoints, time.Minute, nil
+	})
+
+	var next, nextH2 recordingTransport
+	p := proxy.Proxy(proxy.Resolver(resolver), proxy.Next(&next), proxy.NextH2(&nextH2))
+	req, _ := http.NewRequest("GET", "dummy://foo.bar.net/path", nil)
+	if _, err := p.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "https://a:443/path", nextH2.url; want != have {
+		t.Errorf("want %q via NextH2, have %q", want, have)
+	}
+	if next.url != "" {
+		t.Errorf("want nothing via Next, have %q", next.url)
+	}
+}
+
+func TestProxyNames(t *testing.T) {
+	var asked string
+	resolver := resolve.ResolverFunc(func(name string) ([]resolve.Endpoint, time.Duration, error) {
+		asked = name
+		return []resolve.Endpoint{{Address: "a", Port: 80}}, time.Minute, nil
+	})
+	template, err := resolve.Template("_{service}._tcp.{name}.{env}.internal", map[string]string{"service": "http", "env": "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var next recordingTransport
+	p := proxy.Proxy(proxy.Resolver(resolver), proxy.Names(template), proxy.Next(&next))
+	req, _ := http.NewRequest("GET", "dnssrv://users/path", nil)
+	if _, err := p.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "_http._tcp.users.prod.internal", asked; want != have {
+		t.Errorf("want %q resolved, have %q", want, have)
+	}
+	if want, have := "http://a:80/path", next.url; want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func TestALPNScheme(t *testing.T) {
+	for alpn, want := range map[string]string{
+		"":            "",
+		"h2":          "h2",
+		"h2,http/1.1": "https",
+		"http/1.1":    "https",
+		"h3":          "",
+	} {
+		endpoint := resolve.Endpoint{Address: "a", Labels: map[string]string{resolve.ALPNLabel: alpn}}
+		if have := proxy.ALPNScheme(endpoint); want != have {
+			t.Errorf("%q: want %q, have %q", alpn, want, have)
+		}
+	}
+}
+
+type recordingTransport struct{ url string }
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.url = req.URL.String()
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
 type fixedResolver struct {
 	hosts []string
 	ttl   time.Duration
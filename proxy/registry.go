@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"io"
+	"sort"
 	"sync"
 
 	"github.com/peterbourgon/srvproxy/pool"
@@ -19,14 +20,16 @@ type registry struct {
 	resolver     resolve.Resolver
 	reportWriter io.Writer
 	factory      pool.Factory
+	options      []pool.StreamOption
 	m            map[string]pool.Pool
 }
 
-func newRegistry(r resolve.Resolver, reportWriter io.Writer, f pool.Factory) *registry {
+func newRegistry(r resolve.Resolver, reportWriter io.Writer, f pool.Factory, options ...pool.StreamOption) *registry {
 	return &registry{
 		resolver:     r,
 		reportWriter: reportWriter,
 		factory:      f,
+		options:      options,
 		m:            map[string]pool.Pool{},
 	}
 }
@@ -36,10 +39,29 @@ func (r *registry) get(host string) pool.Pool {
 	defer r.Unlock()
 	p, ok := r.m[host]
 	if !ok {
-		p = pool.Stream(r.resolver, host, r.factory)
+		p = pool.Stream(r.resolver, host, r.factory, r.options...)
 		p = pool.Report(r.reportWriter, p)
 		p = pool.Instrument(p)
 		r.m[host] = p
 	}
 	return p
 }
+
+// alternates returns the other hosts with the same resolve.TargetLabel as
+// endpoint, among the endpoints it was picked from, i.e. the other addresses
+// of the same SRV target. Hosts without a port are left out, as they aren't
+// what's dialed.
+func alternates(endpoint resolve.Endpoint, endpoints map[string]resolve.Endpoint) []string {
+	target, ok := endpoint.Labels[resolve.TargetLabel]
+	if !ok || endpoint.Port == 0 {
+		return nil
+	}
+	var hosts []string
+	for host, other := range endpoints {
+		if other.Labels[resolve.TargetLabel] == target && other.Port != 0 && host != endpoint.String() {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
@@ -1,14 +1,17 @@
 package proxy
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/peterbourgon/srvproxy/pool"
+	"github.com/peterbourgon/srvproxy/resolve"
 )
 
 func TestRegistry(t *testing.T) {
-	registry := newRegistry(&doublingResolver{time.Millisecond}, nil, pool.RoundRobin)
+	registry := newRegistry(resolve.FromHosts(&doublingResolver{time.Millisecond}), nil, pool.RoundRobin)
 
 	// A new registry should have no pools.
 	if want, have := 0, len(registry.m); want != have {
@@ -44,6 +47,46 @@ func TestRegistry(t *testing.T) {
 	}
 }
 
+func TestRegistryEndpoints(t *testing.T) {
+	// The endpoints change with every lookup, but each host must still be
+	// found among the endpoints of the pool that yielded it.
+	registry := newRegistry(resolve.FromHosts(&countingResolver{}), nil, pool.RoundRobin, pool.LookupTimeout(time.Second))
+	p := registry.get("foo")
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				host, endpoints, err := pool.GetEndpoints(p)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, ok := endpoints[host]; !ok {
+					t.Errorf("%s: no endpoint", host)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type countingResolver struct {
+	mtx sync.Mutex
+	n   int
+}
+
+func (r *countingResolver) Resolve(string) ([]string, time.Duration, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.n++
+	return []string{fmt.Sprintf("10.0.0.%d:80", r.n%250+1)}, 0, nil
+}
+
 type doublingResolver struct {
 	ttl time.Duration
 }
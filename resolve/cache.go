@@ -0,0 +1,202 @@
+package resolve
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// staleTTL is the TTL given to stale answers, per RFC 8767 section 4.
+const staleTTL = 30 * time.Second
+
+// Cache returns a resolver that caches the answers of r. Concurrent lookups
+// for the same name are collapsed into a single lookup via r. Answers are
+// cached for their TTL, and failures for the negative TTL.
+//
+// If a name can't be resolved once its answer has expired, the last good
+// answer is served in its place, with a TTL of 30 seconds, until it's been
+// expired for longer than the max stale period. This is "serve-stale" from
+// RFC 8767. The same happens when the context of a lookup is done before r
+// answers; the lookup via r carries on for any other callers.
+//
+// A single Cache may be shared by many proxies, so that each name is
+// resolved once, no matter how many pools stream it.
+func Cache(r Resolver, options ...CacheOption) *CacheResolver {
+	c := &CacheResolver{
+		next:        WithContext(r),
+		negativeTTL: time.Second,
+		maxStale:    time.Hour,
+		onStale:     func(string, error) {},
+		entries:     map[string]*cacheEntry{},
+		calls:       map[string]*cacheCall{},
+	}
+	c.setOptions(options...)
+	return c
+}
+
+// CacheOption sets a specific option for the Cache. This is the functional
+// options idiom.
+type CacheOption func(*CacheResolver)
+
+// CacheNegativeTTL sets how long a failed lookup is cached. If
+// CacheNegativeTTL isn't provided, a default value of 1 second is used.
+func CacheNegativeTTL(d time.Duration) CacheOption {
+	return func(c *CacheResolver) { c.negativeTTL = d }
+}
+
+// CacheMaxStale sets how long after it expires an answer may still be served
+// in place of a failure. Zero disables serve-stale. If CacheMaxStale isn't
+// provided, a default value of 1 hour is used.
+func CacheMaxStale(d time.Duration) CacheOption {
+	return func(c *CacheResolver) { c.maxStale = d }
+}
+
+// CacheOnStale sets a function that's called with the name and the error
+// each time a stale answer is served in place of that error. If CacheOnStale
+// isn't provided, stale answers are served silently.
+func CacheOnStale(f func(name string, err error)) CacheOption {
+	return func(c *CacheResolver) { c.onStale = f }
+}
+
+// CacheResolver is a caching Resolver. See Cache.
+type CacheResolver struct {
+	next        ContextResolver
+	negativeTTL time.Duration
+	maxStale    time.Duration
+	onStale     func(string, error)
+
+	mtx     sync.Mutex
+	entries map[string]*cacheEntry
+	calls   map[string]*cacheCall
+}
+
+type cacheEntry struct {
+	endpoints  []Endpoint // last good answer, if any
+	expires    time.Time  // of endpoints
+	err        error      // last failure, if more recent than endpoints
+	errExpires time.Time
+}
+
+// stale returns whether the last good answer may be served at t.
+func (e *cacheEntry) stale(t time.Time, maxStale time.Duration) bool {
+	return e.endpoints != nil && t.Before(e.expires.Add(maxStale))
+}
+
+// cacheCall is an in-flight lookup, shared by every caller that wants it.
+type cacheCall struct {
+	done      chan struct{}
+	cancel    context.CancelFunc
+	waiters   int
+	endpoints []Endpoint
+	ttl       time.Duration
+	err       error
+}
+
+func (c *CacheResolver) setOptions(options ...CacheOption) {
+	for _, f := range options {
+		f(c)
+	}
+}
+
+// Resolve implements Resolver.
+func (c *CacheResolver) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return c.ResolveContext(context.Background(), name)
+}
+
+// ResolveContext implements ContextResolver. If ctx is done before an answer
+// arrives, a stale answer is returned if there is one, and otherwise the
+// context's error.
+func (c *CacheResolver) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	c.mtx.Lock()
+	now := time.Now()
+	e, ok := c.entries[name]
+	switch {
+	case ok && e.err == nil && now.Before(e.expires):
+		defer c.mtx.Unlock()
+		return copyEndpoints(e.endpoints), e.expires.Sub(now), nil
+
+	case ok && e.err != nil && now.Before(e.errExpires):
+		err := e.err
+		c.mtx.Unlock()
+		return c.staleOr(name, err)
+	}
+
+	call, ok := c.calls[name]
+	if !ok {
+		var callCtx context.Context
+		call = &cacheCall{done: make(chan struct{})}
+		callCtx, call.cancel = context.WithCancel(context.Background())
+		c.calls[name] = call
+		go c.do(callCtx, call, name)
+	}
+	call.waiters++
+	c.mtx.Unlock()
+
+	select {
+	case <-call.done:
+		if call.err == nil {
+			return copyEndpoints(call.endpoints), call.ttl, nil
+		}
+		return c.staleOr(name, call.err)
+
+	case <-ctx.Done():
+		c.mtx.Lock()
+		if call.waiters--; call.waiters <= 0 && c.calls[name] == call {
+			delete(c.calls, name) // nobody is waiting for it any more
+			call.cancel()
+		}
+		c.mtx.Unlock()
+		return c.staleOr(name, ctx.Err())
+	}
+}
+
+// do performs the lookup for call, and records its result.
+func (c *CacheResolver) do(ctx context.Context, call *cacheCall, name string) {
+	defer close(call.done)
+	defer call.cancel()
+	endpoints, ttl, err := c.next.ResolveContext(ctx, name)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.calls[name] == call {
+		delete(c.calls, name)
+	}
+	call.endpoints, call.ttl, call.err = endpoints, ttl, err
+
+	if ctx.Err() != nil {
+		return // abandoned by every caller, so it says nothing about the name
+	}
+	e, ok := c.entries[name]
+	if !ok {
+		e = &cacheEntry{}
+		c.entries[name] = e
+	}
+	now := time.Now()
+	if err != nil {
+		e.err, e.errExpires = err, now.Add(c.negativeTTL)
+		return
+	}
+	e.endpoints, e.expires, e.err = copyEndpoints(endpoints), now.Add(ttl), nil
+}
+
+// staleOr returns the stale answer for name if there is one, or else err.
+func (c *CacheResolver) staleOr(name string, err error) ([]Endpoint, time.Duration, error) {
+	c.mtx.Lock()
+	e, ok := c.entries[name]
+	ok = ok && e.stale(time.Now(), c.maxStale)
+	var endpoints []Endpoint
+	if ok {
+		endpoints = copyEndpoints(e.endpoints)
+	}
+	c.mtx.Unlock()
+
+	if !ok {
+		return []Endpoint{}, 0, err
+	}
+	c.onStale(name, err)
+	return endpoints, staleTTL, nil
+}
+
+func copyEndpoints(endpoints []Endpoint) []Endpoint {
+	return append(make([]Endpoint, 0, len(endpoints)), endpoints...)
+}
@@ -0,0 +1,139 @@
+package resolve_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestCacheSingleflight(t *testing.T) {
+	var (
+		calls   int32
+		release = make(chan struct{})
+	)
+	r := resolve.HostsFunc(func(string) ([]string, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []string{"a:80"}, time.Minute, nil
+	})
+	c := resolve.Cache(r)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			endpoints, _, err := c.Resolve("irrelevant")
+			if err != nil || !reflect.DeepEqual([]string{"a:80"}, resolve.Hosts(endpoints)) {
+				t.Errorf("have %v (%v)", endpoints, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond) // let them pile up
+	close(release)
+	wg.Wait()
+
+	// Cached, so no further lookups.
+	if _, ttl, err := c.Resolve("irrelevant"); err != nil || ttl > time.Minute {
+		t.Errorf("have TTL %s (%v)", ttl, err)
+	}
+	if want, have := int32(1), atomic.LoadInt32(&calls); want != have {
+		t.Errorf("want %d upstream lookup(s), have %d", want, have)
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	calls := 0
+	r := resolve.HostsFunc(func(string) ([]string, time.Duration, error) {
+		calls++
+		return nil, 0, errors.New("unreachable")
+	})
+	c := resolve.Cache(r, resolve.CacheNegativeTTL(10*time.Millisecond))
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.Resolve("irrelevant"); err == nil {
+			t.Errorf("%d: want error, have none", i)
+		}
+	}
+	if want, have := 1, calls; want != have {
+		t.Errorf("want %d upstream lookup(s), have %d", want, have)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	c.Resolve("irrelevant")
+	if want, have := 2, calls; want != have {
+		t.Errorf("want %d upstream lookup(s), have %d", want, have)
+	}
+}
+
+func TestCacheServeStale(t *testing.T) {
+	var fail int32
+	r := resolve.HostsFunc(func(string) ([]string, time.Duration, error) {
+		if atomic.LoadInt32(&fail) == 1 {
+			return nil, 0, errors.New("unreachable")
+		}
+		return []string{"a:80"}, time.Millisecond, nil
+	})
+	var stale int32
+	c := resolve.Cache(r,
+		resolve.CacheNegativeTTL(time.Millisecond),
+		resolve.CacheMaxStale(50*time.Millisecond),
+		resolve.CacheOnStale(func(string, error) { atomic.AddInt32(&stale, 1) }),
+	)
+
+	if _, _, err := c.Resolve("irrelevant"); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&fail, 1)
+	time.Sleep(5 * time.Millisecond)
+
+	endpoints, ttl, err := c.Resolve("irrelevant")
+	if err != nil || !reflect.DeepEqual([]string{"a:80"}, resolve.Hosts(endpoints)) {
+		t.Fatalf("want stale answer, have %v (%v)", endpoints, err)
+	}
+	if want, have := 30*time.Second, ttl; want != have {
+		t.Errorf("want stale TTL %s, have %s", want, have)
+	}
+	if want, have := int32(1), atomic.LoadInt32(&stale); want != have {
+		t.Errorf("want %d stale answer(s) reported, have %d", want, have)
+	}
+
+	// Once the max stale period has passed, the error comes through.
+	time.Sleep(60 * time.Millisecond)
+	if _, _, err := c.Resolve("irrelevant"); err == nil {
+		t.Error("want error, have none")
+	}
+}
+
+func TestCacheStaleOnTimeout(t *testing.T) {
+	var (
+		calls   int32
+		release = make(chan struct{})
+	)
+	defer close(release)
+	r := resolve.HostsFunc(func(string) ([]string, time.Duration, error) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			<-release
+		}
+		return []string{"a:80"}, time.Millisecond, nil
+	})
+	c := resolve.Cache(r)
+
+	if _, _, err := c.Resolve("irrelevant"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	endpoints, _, err := c.ResolveContext(ctx, "irrelevant")
+	if err != nil || !reflect.DeepEqual([]string{"a:80"}, resolve.Hosts(endpoints)) {
+		t.Errorf("want stale answer, have %v (%v)", endpoints, err)
+	}
+}
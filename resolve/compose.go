@@ -0,0 +1,183 @@
+package resolve
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SourceLabel is the label that Fallback and Union set on each endpoint they
+// return, to report which source served it. Sources are named via Source;
+// unnamed sources are reported by their position, starting at "0".
+const SourceLabel = "source"
+
+// Source names a Resolver, so that Fallback and Union can report it.
+func Source(name string, r Resolver) Resolver {
+	return source{name, WithContext(r)}
+}
+
+type source struct {
+	name string
+	ContextResolver
+}
+
+// Fallback returns a Resolver that tries each of the resolvers in order, and
+// returns the answer of the first one that resolves the name to at least one
+// endpoint. If none do, the returned error is a *FallbackError. Sources that
+// fail are reported to the SourceMetrics of an enclosing Instrument, if any.
+func Fallback(rs ...Resolver) ContextResolver {
+	return fallback(sources(rs))
+}
+
+type fallback []source
+
+func (f fallback) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return f.ResolveContext(context.Background(), name)
+}
+
+func (f fallback) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	e := &FallbackError{Name: name}
+	for _, s := range f {
+		endpoints, ttl, err := s.ResolveContext(ctx, name)
+		if err == nil && len(endpoints) > 0 {
+			return withSource(endpoints, s.name), ttl, nil
+		}
+		if err == nil {
+			err = &net.DNSError{Err: "no endpoints", Name: name, IsNotFound: true}
+		}
+		reportSourceError(ctx, name, s.name, err)
+		e.Sources, e.Errs = append(e.Sources, s.name), append(e.Errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return []Endpoint{}, 0, e
+}
+
+// FallbackError is returned by Fallback and Union when none of their sources
+// could resolve a name.
+type FallbackError struct {
+	Name    string   // the name passed to Resolve
+	Sources []string // the sources tried
+	Errs    []error  // the error for each source
+}
+
+func (e *FallbackError) Error() string {
+	errs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		errs[i] = e.Sources[i] + ": " + err.Error()
+	}
+	return fmt.Sprintf("lookup %s failed, %d source(s) tried (%s)", e.Name, len(e.Sources), strings.Join(errs, "; "))
+}
+
+// Unwrap returns the errors of each source, for errors.Is and errors.As.
+func (e *FallbackError) Unwrap() []error {
+	return e.Errs
+}
+
+// Union returns a Resolver that resolves the name via all of the resolvers
+// concurrently, and merges their answers. Endpoints with the same address and
+// port are only returned once, from the first source that has them. The TTL
+// is the minimum TTL of the sources that answered. Sources that fail are left
+// out; only if every source fails is an error, a *FallbackError, returned. So
+// that a source that's always down doesn't go unnoticed, the failures are
+// reported to the SourceMetrics of an enclosing Instrument, if any.
+func Union(rs ...Resolver) ContextResolver {
+	return union(sources(rs))
+}
+
+type union []source
+
+func (u union) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return u.ResolveContext(context.Background(), name)
+}
+
+func (u union) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	type result struct {
+		endpoints []Endpoint
+		ttl       time.Duration
+		err       error
+	}
+	results := make([]chan result, len(u))
+	for i, s := range u {
+		results[i] = make(chan result, 1)
+		go func(s source, c chan<- result) {
+			endpoints, ttl, err := s.ResolveContext(ctx, name)
+			c <- result{endpoints, ttl, err}
+		}(s, results[i])
+	}
+
+	var (
+		endpoints = []Endpoint{}
+		ttl       time.Duration
+		answered  = false
+		seen      = map[string]bool{}
+		e         = &FallbackError{Name: name}
+	)
+	for i, c := range results {
+		res := <-c
+		if res.err != nil {
+			reportSourceError(ctx, name, u[i].name, res.err)
+			e.Sources, e.Errs = append(e.Sources, u[i].name), append(e.Errs, res.err)
+			continue
+		}
+		if !answered || res.ttl < ttl {
+			ttl = res.ttl
+		}
+		answered = true
+		for _, endpoint := range withSource(res.endpoints, u[i].name) {
+			if key := endpoint.String(); !seen[key] {
+				seen[key] = true
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+	}
+	if !answered {
+		return []Endpoint{}, 0, e
+	}
+	sortEndpoints(endpoints)
+	return endpoints, ttl, nil
+}
+
+// sourceMetricsKey is the context key under which Instrument passes its
+// SourceMetrics to the Fallbacks and Unions it wraps.
+type sourceMetricsKey struct{}
+
+// reportSourceError reports the failure of a source to the SourceMetrics in
+// ctx, if any.
+func reportSourceError(ctx context.Context, name, source string, err error) {
+	if m, ok := ctx.Value(sourceMetricsKey{}).(SourceMetrics); ok {
+		m.SourceError(name, source, err)
+	}
+}
+
+// sources names each resolver that isn't already named by its position.
+func sources(rs []Resolver) []source {
+	ss := make([]source, len(rs))
+	for i, r := range rs {
+		s, ok := r.(source)
+		if !ok {
+			s = source{strconv.Itoa(i), WithContext(r)}
+		}
+		ss[i] = s
+	}
+	return ss
+}
+
+// withSource returns a copy of endpoints, labeled with the source.
+func withSource(endpoints []Endpoint, source string) []Endpoint {
+	labeled := make([]Endpoint, len(endpoints))
+	for i, endpoint := range endpoints {
+		labels := make(map[string]string, len(endpoint.Labels)+1)
+		for k, v := range endpoint.Labels {
+			labels[k] = v
+		}
+		labels[SourceLabel] = source
+		endpoint.Labels = labels
+		labeled[i] = endpoint
+	}
+	return labeled
+}
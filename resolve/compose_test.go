@@ -0,0 +1,97 @@
+package resolve_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestFallback(t *testing.T) {
+	var (
+		down   = fixed(nil, 0, errors.New("unreachable"))
+		empty  = fixed([]string{}, time.Minute, nil)
+		static = fixed([]string{"a:80"}, time.Minute, nil)
+		dns    = fixed([]string{"b:80"}, time.Second, nil)
+	)
+
+	r := resolve.Fallback(resolve.Source("consul", down), empty, resolve.Source("static", static), dns)
+	endpoints, ttl, err := r.Resolve("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"a:80"}, resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want, have := "static", endpoints[0].Labels[resolve.SourceLabel]; want != have {
+		t.Errorf("want source %q, have %q", want, have)
+	}
+	if want, have := time.Minute, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+
+	_, _, err = resolve.Fallback(resolve.Source("consul", down), empty).Resolve("users")
+	e, ok := err.(*resolve.FallbackError)
+	if !ok {
+		t.Fatalf("want *FallbackError, have %#v", err)
+	}
+	if want, have := []string{"consul", "1"}, e.Sources; !reflect.DeepEqual(want, have) {
+		t.Errorf("want sources %v, have %v", want, have)
+	}
+}
+
+func TestUnion(t *testing.T) {
+	var (
+		down   = fixed(nil, 0, errors.New("unreachable"))
+		static = fixed([]string{"a:80", "b:80"}, time.Minute, nil)
+		dns    = fixed([]string{"b:80", "c:80"}, time.Second, nil)
+	)
+
+	r := resolve.Union(resolve.Source("static", static), resolve.Source("consul", down), resolve.Source("dns", dns))
+	endpoints, ttl, err := r.Resolve("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"a:80", "b:80", "c:80"}, resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	sources := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		sources[i] = endpoint.Labels[resolve.SourceLabel]
+	}
+	if want, have := []string{"static", "static", "dns"}, sources; !reflect.DeepEqual(want, have) {
+		t.Errorf("want sources %v, have %v", want, have)
+	}
+	if want, have := time.Second, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+
+	if _, _, err := resolve.Union(down, down).Resolve("users"); err == nil {
+		t.Error("want error, have none")
+	}
+}
+
+func TestUnionSourceErrors(t *testing.T) {
+	var (
+		down   = fixed(nil, 0, errors.New("unreachable"))
+		static = fixed([]string{"a:80"}, time.Minute, nil)
+		m      = &recordingMetrics{}
+	)
+
+	// The source is down, but the lookup succeeds, so only the metrics know.
+	r := resolve.Instrument(resolve.Timeout(resolve.Union(resolve.Source("static", static), resolve.Source("consul", down)), time.Second), m)
+	if _, _, err := r.Resolve("users"); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"users consul: unreachable"}, m.sourceErrors; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func fixed(hosts []string, ttl time.Duration, err error) resolve.Resolver {
+	return resolve.HostsFunc(func(string) ([]string, time.Duration, error) {
+		return hosts, ttl, err
+	})
+}
@@ -0,0 +1,283 @@
+package resolve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Consul returns a resolver that reads the passing instances of a service
+// from the Consul health API at addr, e.g. "http://127.0.0.1:8500". Names are
+// Consul service names. Each instance becomes an Endpoint with the service
+// address (or the node address, if the service has none), the service port,
+// the passing weight as Weight, and the service metadata as Labels.
+func Consul(addr string, options ...ConsulOption) *ConsulResolver {
+	r := &ConsulResolver{
+		addr:   strings.TrimRight(addr, "/"),
+		client: http.DefaultClient,
+		ttl:    5 * time.Second,
+		wait:   5 * time.Minute,
+	}
+	r.setOptions(options...)
+	return r
+}
+
+// ConsulOption sets a specific option for the Consul resolver. This is the
+// functional options idiom.
+type ConsulOption func(*ConsulResolver)
+
+// ConsulDatacenter sets the datacenter to query. If ConsulDatacenter isn't
+// provided, the datacenter of the agent is used.
+func ConsulDatacenter(dc string) ConsulOption {
+	return func(r *ConsulResolver) { r.dc = dc }
+}
+
+// ConsulTags restricts results to instances that have all of the tags. If
+// ConsulTags isn't provided, instances aren't filtered by tag.
+func ConsulTags(tags ...string) ConsulOption {
+	return func(r *ConsulResolver) { r.tags = append([]string{}, tags...) }
+}
+
+// ConsulToken sets the ACL token sent with each request. If ConsulToken isn't
+// provided, the agent's default token is used.
+func ConsulToken(token string) ConsulOption {
+	return func(r *ConsulResolver) { r.token = token }
+}
+
+// ConsulTTL sets the TTL returned by Resolve. Consul has no notion of TTLs,
+// so this only controls how often pollers come back. If ConsulTTL isn't
+// provided, a default value of 5 seconds is used.
+func ConsulTTL(d time.Duration) ConsulOption {
+	return func(r *ConsulResolver) { r.ttl = d }
+}
+
+// ConsulWait sets the maximum duration of each blocking query made by Watch.
+// If ConsulWait isn't provided, a default value of 5 minutes is used.
+func ConsulWait(d time.Duration) ConsulOption {
+	return func(r *ConsulResolver) { r.wait = d }
+}
+
+// ConsulClient sets the HTTP client used to talk to Consul. If ConsulClient
+// isn't provided, http.DefaultClient is used.
+func ConsulClient(c *http.Client) ConsulOption {
+	return func(r *ConsulResolver) { r.client = c }
+}
+
+// ConsulResolver resolves names via the Consul health API. It's both a
+// Resolver and a Watcher, so pool.Stream picks up changes immediately.
+type ConsulResolver struct {
+	addr   string
+	client *http.Client
+	dc     string
+	tags   []string
+	token  string
+	ttl    time.Duration
+	wait   time.Duration
+}
+
+func (r *ConsulResolver) setOptions(options ...ConsulOption) {
+	for _, f := range options {
+		f(r)
+	}
+}
+
+// Resolve implements Resolver with a single, non-blocking query.
+func (r *ConsulResolver) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return r.ResolveContext(context.Background(), name)
+}
+
+// ResolveContext is Resolve, with the query bound to ctx.
+func (r *ConsulResolver) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	endpoints, _, err := r.fetch(ctx, name, 0)
+	if err != nil {
+		return []Endpoint{}, 0, err
+	}
+	return endpoints, r.ttl, nil
+}
+
+// Watch returns a channel of updates for the named service, driven by
+// Consul blocking queries, so changes are delivered as soon as Consul sees
+// them. The first update is sent as soon as the initial query completes.
+// Subsequent updates are only sent when the set of endpoints changes, or
+// when a query fails, in which case Watch backs off and tries again, and
+// sends the next result even if it's unchanged. If a query returns without
+// the Consul index advancing, e.g. because a proxy strips the X-Consul-Index
+// header, the next one is delayed by at least a second, so Watch never polls
+// Consul in a tight loop. Close done to stop watching; the channel is closed
+// after that.
+func (r *ConsulResolver) Watch(name string, done <-chan struct{}) <-chan Update {
+	var (
+		c           = make(chan Update)
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+	go func() {
+		<-done
+		cancel()
+	}()
+	go func() {
+		defer close(c)
+		var (
+			index   uint64
+			changes changeFilter
+			backoff time.Duration
+		)
+		for {
+			begin := time.Now()
+			endpoints, newIndex, err := r.fetch(ctx, name, index)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err != nil {
+				backoff = nextBackoff(backoff)
+				changes.fail()
+				select {
+				case c <- Update{Err: err}:
+				case <-done:
+					return
+				}
+				select {
+				case <-time.After(backoff):
+				case <-done:
+					return
+				}
+				continue
+			}
+
+			// Per the Consul docs, a query that doesn't advance the index
+			// must be rate limited, as the next one won't block. fetch has
+			// already reset the index to 0 if it went backwards.
+			var delay time.Duration
+			if newIndex <= index {
+				delay = consulMinInterval - time.Since(begin)
+			}
+			backoff, index = 0, newIndex
+
+			if changes.changed(endpoints) {
+				select {
+				case c <- Update{Endpoints: endpoints}:
+				case <-done:
+					return
+				}
+			}
+
+			if delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return c
+}
+
+// fetch queries the health endpoint for name. If index is non-zero, it's a
+// blocking query that returns when the result changes or the wait elapses.
+// It returns the endpoints and the new Consul index.
+func (r *ConsulResolver) fetch(ctx context.Context, name string, index uint64) ([]Endpoint, uint64, error) {
+	q := url.Values{}
+	q.Set("passing", "")
+	if r.dc != "" {
+		q.Set("dc", r.dc)
+	}
+	for _, tag := range r.tags {
+		q.Add("tag", tag)
+	}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", strconv.FormatInt(int64(r.wait/time.Millisecond), 10)+"ms")
+	}
+
+	u := r.addr + "/v1/health/service/" + url.PathEscape(name) + "?" + q.Encode()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	if r.token != "" {
+		req.Header.Set("X-Consul-Token", r.token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul: %s: HTTP %d %s", name, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("consul: %s: %v", name, err)
+	}
+
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if newIndex < index {
+		newIndex = 0
+	}
+
+	endpoints := make([]Endpoint, 0, len(entries))
+	for _, e := range entries {
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+		weight := e.Service.Weights.Passing
+		switch {
+		case weight <= 0:
+			weight = 1 // Consul's default, for agents that don't report weights
+		case weight > 0xFFFF:
+			weight = 0xFFFF
+		}
+		var labels map[string]string
+		if len(e.Service.Meta) > 0 {
+			labels = e.Service.Meta
+		}
+		endpoints = append(endpoints, Endpoint{
+			Address: addr,
+			Port:    e.Service.Port,
+			Weight:  uint16(weight),
+			Labels:  labels,
+		})
+	}
+	sortEndpoints(endpoints)
+	return endpoints, newIndex, nil
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    uint16
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+// consulMinInterval is the minimum time between the start of queries made by
+// Watch that don't advance the Consul index.
+const consulMinInterval = time.Second
+
+// nextBackoff doubles d, starting at 100ms and capping at 30s.
+func nextBackoff(d time.Duration) time.Duration {
+	switch {
+	case d <= 0:
+		return 100 * time.Millisecond
+	case d >= 15*time.Second:
+		return 30 * time.Second
+	default:
+		return 2 * d
+	}
+}
@@ -0,0 +1,256 @@
+package resolve_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestConsulResolve(t *testing.T) {
+	c := newFakeConsul()
+	c.set(consulInstance{Node: "10.0.0.1", Port: 8080, Weight: 3, Meta: map[string]string{"version": "2"}})
+	s := httptest.NewServer(c)
+	defer s.Close()
+
+	r := resolve.Consul(s.URL,
+		resolve.ConsulDatacenter("dc2"),
+		resolve.ConsulTags("primary", "v2"),
+		resolve.ConsulToken("secret"),
+		resolve.ConsulTTL(time.Minute),
+	)
+	endpoints, ttl, err := r.Resolve("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []resolve.Endpoint{{Address: "10.0.0.1", Port: 8080, Weight: 3, Labels: map[string]string{"version": "2"}}}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+	if want, have := time.Minute, ttl; want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+
+	req := c.lastRequest()
+	if want, have := "/v1/health/service/users", req.URL.Path; want != have {
+		t.Errorf("want path %q, have %q", want, have)
+	}
+	q := req.URL.Query()
+	if _, ok := q["passing"]; !ok {
+		t.Errorf("want passing filter, have %q", req.URL.RawQuery)
+	}
+	if want, have := "dc2", q.Get("dc"); want != have {
+		t.Errorf("want dc %q, have %q", want, have)
+	}
+	if want, have := []string{"primary", "v2"}, q["tag"]; !reflect.DeepEqual(want, have) {
+		t.Errorf("want tags %v, have %v", want, have)
+	}
+	if want, have := "secret", req.Header.Get("X-Consul-Token"); want != have {
+		t.Errorf("want token %q, have %q", want, have)
+	}
+}
+
+func TestConsulResolveError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+	}))
+	defer s.Close()
+
+	if _, _, err := resolve.Consul(s.URL).Resolve("users"); err == nil {
+		t.Error("want error, have none")
+	}
+}
+
+func TestConsulWatch(t *testing.T) {
+	c := newFakeConsul()
+	c.set(consulInstance{Address: "10.0.0.1", Port: 80})
+	s := httptest.NewServer(c)
+	defer s.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	updates := resolve.Consul(s.URL).Watch("users", done)
+
+	u := recvUpdate(t, updates)
+	if want, have := []string{"10.0.0.1:80"}, resolve.Hosts(u.Endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	// The watcher is now parked in a blocking query, which should return as
+	// soon as the service changes.
+	c.set(consulInstance{Address: "10.0.0.1", Port: 80}, consulInstance{Address: "10.0.0.2", Port: 80})
+	u = recvUpdate(t, updates)
+	if want, have := []string{"10.0.0.1:80", "10.0.0.2:80"}, resolve.Hosts(u.Endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if req := c.lastRequest(); req.URL.Query().Get("index") == "" {
+		t.Errorf("want blocking query, have %q", req.URL.RawQuery)
+	}
+}
+
+func TestConsulWatchRecovery(t *testing.T) {
+	// The second query fails, and the third returns what the first did,
+	// which must be sent anyway, so the error is known to be over.
+	var (
+		mtx      sync.Mutex
+		requests int
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mtx.Lock()
+		requests++
+		n := requests
+		mtx.Unlock()
+		if n == 2 {
+			http.Error(w, "no cluster leader", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Consul-Index", strconv.Itoa(n))
+		w.Write([]byte(`[{"Service": {"Address": "10.0.0.1", "Port": 80}}]`))
+	}))
+	defer s.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	updates := resolve.Consul(s.URL).Watch("users", done)
+
+	recvUpdate(t, updates)
+	select {
+	case u := <-updates:
+		if u.Err == nil {
+			t.Errorf("want error, have %+v", u)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for update")
+	}
+	if u := recvUpdate(t, updates); !reflect.DeepEqual([]string{"10.0.0.1:80"}, resolve.Hosts(u.Endpoints)) {
+		t.Errorf("have %+v", u)
+	}
+}
+
+func TestConsulWatchNoIndex(t *testing.T) {
+	// Without X-Consul-Index, there's nothing to block on, so each query
+	// returns at once, and Watch must rate limit them itself.
+	var (
+		mtx      sync.Mutex
+		requests int
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mtx.Lock()
+		requests++
+		mtx.Unlock()
+		w.Write([]byte(`[{"Service": {"Address": "10.0.0.1", "Port": 80}}]`))
+	}))
+	defer s.Close()
+
+	done := make(chan struct{})
+	updates := resolve.Consul(s.URL).Watch("users", done)
+	recvUpdate(t, updates)
+	time.Sleep(500 * time.Millisecond)
+	close(done)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if requests > 2 {
+		t.Errorf("want at most 2 requests, have %d", requests)
+	}
+}
+
+func recvUpdate(t *testing.T, updates <-chan resolve.Update) resolve.Update {
+	t.Helper()
+	select {
+	case u := <-updates:
+		if u.Err != nil {
+			t.Fatal(u.Err)
+		}
+		return u
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for update")
+		return resolve.Update{}
+	}
+}
+
+type consulInstance struct {
+	Node    string
+	Address string
+	Port    uint16
+	Weight  int
+	Meta    map[string]string
+}
+
+// fakeConsul is a stand-in for the Consul health API, which supports
+// blocking queries on a single, mutable service.
+type fakeConsul struct {
+	mtx       sync.Mutex
+	index     uint64
+	instances []consulInstance
+	changed   chan struct{}
+	last      *http.Request
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{index: 1, changed: make(chan struct{})}
+}
+
+func (c *fakeConsul) set(instances ...consulInstance) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.instances = instances
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) lastRequest() *http.Request {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.last
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mtx.Lock()
+	c.last = r
+	index, changed := c.index, c.changed
+	c.mtx.Unlock()
+
+	if want, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); want >= index {
+		wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+		if err != nil {
+			wait = time.Minute
+		}
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	type entry struct {
+		Node    struct{ Address string }
+		Service struct {
+			Address string
+			Port    uint16
+			Meta    map[string]string
+			Weights struct{ Passing, Warning int }
+		}
+	}
+	entries := make([]entry, len(c.instances))
+	for i, inst := range c.instances {
+		entries[i].Node.Address = inst.Node
+		entries[i].Service.Address = inst.Address
+		entries[i].Service.Port = inst.Port
+		entries[i].Service.Meta = inst.Meta
+		entries[i].Service.Weights.Passing = inst.Weight
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	json.NewEncoder(w).Encode(entries)
+}
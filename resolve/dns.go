@@ -0,0 +1,573 @@
+package resolve
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve/internal/dnswire"
+)
+
+const (
+	// ednsSize is the UDP payload size advertised via EDNS(0). It's the
+	// value recommended by DNS Flag Day 2020 to avoid IP fragmentation.
+	ednsSize = 1232
+
+	// minTTL is the smallest TTL DNS returns, so that records with a TTL of
+	// zero don't make callers spin.
+	minTTL = time.Second
+
+	// maxCNAMEs bounds how many CNAMEs are followed in an answer section.
+	maxCNAMEs = 8
+)
+
+// DNS returns a Resolver that performs SRV lookups by speaking the DNS wire
+// protocol directly to the configured nameservers. Queries are sent over UDP,
+// and retried over TCP when the response is truncated. Unlike DNSSRV, the
+// returned TTL is the minimum TTL of the answer set.
+//
+// Names are expanded through the search list the same way as the system
+// resolver: names with at least ndots dots are tried as given first, other
+// names are tried with each search domain appended first, and names with a
+// trailing dot are never expanded. If no candidate resolves, the returned
+// error is a *SearchError listing each of them.
+//
+// Which records are looked up is independent of how they're fetched: SRV
+// records by default, SVCB and HTTPS records with SVCBRecords, or DNS-SD
+// browsing with DNSSD, each over DNS, DoH, DoT or from a ZoneFile. The
+// exceptions are that SVCBRecords can't be combined with DNSSD or
+// ExpandTargets, and that zone files can't hold SVCB records. A resolver
+// given options that can't be combined fails every lookup, saying why.
+func DNS(options ...DNSOption) Resolver {
+	r := &dnsResolver{
+		nameservers: []string{"127.0.0.1:53"},
+		timeout:     2 * time.Second,
+		ndots:       1,
+		attempts:    1,
+	}
+	r.setOptions(options...)
+	r.complete()
+	return r
+}
+
+// DNSOption sets a specific option for the DNS resolver. This is the
+// functional options idiom.
+type DNSOption func(*dnsResolver)
+
+// Nameservers sets the nameservers that will be queried, in order. Addresses
+// without a port use port 53, or 853 for DoT. For DoH, nameservers are URLs.
+// If Nameservers isn't provided, 127.0.0.1:53 is used.
+func Nameservers(addrs ...string) DNSOption {
+	return func(r *dnsResolver) { r.nameservers = append([]string{}, addrs...) }
+}
+
+// DNSTimeout sets how long to wait for each nameserver to answer. If
+// DNSTimeout isn't provided, a default value of 2 seconds is used.
+func DNSTimeout(d time.Duration) DNSOption {
+	return func(r *dnsResolver) { r.timeout = d }
+}
+
+// FromResolvConf configures nameservers, search list, ndots, timeout,
+// attempts and rotation from the parsed resolv.conf(5) data. Options given
+// after FromResolvConf override the corresponding settings.
+func FromResolvConf(c *ResolvConf) DNSOption {
+	return func(r *dnsResolver) {
+		Nameservers(c.Nameservers...)(r)
+		r.search = append([]string{}, c.Search...)
+		r.ndots = c.Ndots
+		r.timeout = c.Timeout
+		r.attempts = c.Attempts
+		r.rotate = c.Rotate
+	}
+}
+
+// Search sets the search list used to expand short names. If Search isn't
+// provided, names are only tried as given.
+func Search(domains ...string) DNSOption {
+	return func(r *dnsResolver) { r.search = append([]string{}, domains...) }
+}
+
+// Ndots sets how many dots a name must contain to be tried as given before
+// the search list is applied. If Ndots isn't provided, a default value of 1
+// is used.
+func Ndots(n int) DNSOption {
+	return func(r *dnsResolver) { r.ndots = n }
+}
+
+// Attempts sets how many times the full list of nameservers is tried before
+// giving up on a name. If Attempts isn't provided, each nameserver is tried
+// once.
+func Attempts(n int) DNSOption {
+	return func(r *dnsResolver) { r.attempts = n }
+}
+
+// Rotate spreads queries across nameservers, rather than always asking the
+// first one first. If Rotate isn't provided, nameservers are tried in order.
+func Rotate(rotate bool) DNSOption {
+	return func(r *dnsResolver) { r.rotate = rotate }
+}
+
+// Transports for DNS messages.
+const (
+	protoUDP   = iota // UDP, retried over TCP when truncated
+	protoHTTPS        // DoH, RFC 8484
+	protoTLS          // DoT, RFC 7858
+	protoZone         // answered from a zone file
+)
+
+type dnsResolver struct {
+	proto       int
+	nameservers []string
+	timeout     time.Duration
+	search      []string
+	ndots       int
+	attempts    int
+	rotate      bool
+	svcb        bool   // SVCB and HTTPS rather than SRV records
+	dnssd       bool   // PTR, SRV and TXT records, per RFC 6763
+	expand      bool   // SRV targets to their addresses
+	next        uint32 // rotation offset, accessed atomically
+
+	dohClient *http.Client // DoH
+	dohMethod string
+	tlsConfig *tls.Config // DoT
+	mtx       sync.Mutex
+	idle      map[string][]net.Conn  // DoT connections for reuse, by server
+	zone      zone                   // ZoneFile
+	anchors   []TrustAnchor          // DNSSEC, if any
+	keys      map[string]trustedKeys // validated DNSKEYs, by zone
+	err       error                  // options that can't be combined
+}
+
+func (r *dnsResolver) setOptions(options ...DNSOption) {
+	for _, f := range options {
+		f(r)
+	}
+}
+
+// complete gives nameservers the default port of the transport, now that the
+// options can't change it, and checks that the options can be combined. The
+// error is also returned by each lookup.
+func (r *dnsResolver) complete() error {
+	for i, addr := range r.nameservers {
+		switch r.proto {
+		case protoUDP:
+			r.nameservers[i] = withPort(addr, "53")
+		case protoTLS:
+			r.nameservers[i] = withPort(addr, "853")
+		}
+	}
+	switch {
+	case r.svcb && r.dnssd:
+		r.err = errors.New("SVCBRecords and DNSSD can't be combined")
+	case r.svcb && r.expand:
+		r.err = errors.New("SVCBRecords and ExpandTargets can't be combined")
+	case r.svcb && r.proto == protoZone:
+		r.err = errors.New("zone files can't hold SVCB records")
+	}
+	return r.err
+}
+
+func (r *dnsResolver) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return r.ResolveContext(context.Background(), name)
+}
+
+// ResolveContext bounds the whole lookup, including every candidate and
+// nameserver tried, by ctx. The per-nameserver timeout still applies within
+// it.
+func (r *dnsResolver) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	if r.err != nil {
+		return []Endpoint{}, 0, r.err
+	}
+	candidates := r.candidates(name)
+	errs := make([]error, 0, len(candidates))
+	for _, candidate := range candidates {
+		lookup := r.resolveSRV
+		switch {
+		case r.svcb:
+			lookup = r.resolveSVCB
+		case r.dnssd:
+			lookup = r.resolveDNSSD
+		}
+		endpoints, ttl, err := lookup(ctx, candidate)
+		if err == nil {
+			return endpoints, ttl, nil
+		}
+		if ctx.Err() != nil {
+			return []Endpoint{}, 0, err // don't report candidates never tried
+		}
+		errs = append(errs, err)
+	}
+	if len(candidates) == 1 {
+		return []Endpoint{}, 0, errs[0]
+	}
+	return []Endpoint{}, 0, &SearchError{Name: name, Tried: candidates, Errs: errs}
+}
+
+// candidates returns the fully-qualified names to try for name, in order.
+func (r *dnsResolver) candidates(name string) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+
+	searched := make([]string, 0, len(r.search))
+	for _, domain := range r.search {
+		searched = append(searched, dnswire.Fqdn(name+"."+strings.Trim(domain, ".")))
+	}
+
+	if strings.Count(name, ".") >= r.ndots {
+		return append([]string{dnswire.Fqdn(name)}, searched...)
+	}
+	return append(searched, dnswire.Fqdn(name))
+}
+
+func (r *dnsResolver) resolveSRV(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	resp, server, err := r.query(ctx, name, dnswire.TypeSRV)
+	if err != nil {
+		return []Endpoint{}, 0, err
+	}
+
+	rrs, ttl := answers(resp, name, dnswire.TypeSRV)
+	endpoints := make([]Endpoint, 0, len(rrs))
+	for _, rr := range rrs {
+		srv := rr.Data.(*dnswire.SRV)
+		if srv.Target == "." {
+			continue // "service decidedly not available" -- RFC 2782
+		}
+		endpoints = append(endpoints, Endpoint{
+			Address:  strings.TrimRight(srv.Target, "."),
+			Port:     srv.Port,
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+		})
+	}
+	if len(endpoints) <= 0 {
+		return []Endpoint{}, 0, &net.DNSError{Err: "no SRV records", Name: name, Server: server, IsNotFound: true}
+	}
+
+	if r.expand {
+		if endpoints, ttl, err = r.expandTargets(ctx, resp, endpoints, ttl); err != nil {
+			return []Endpoint{}, 0, err
+		}
+	}
+	sortEndpoints(endpoints)
+	return endpoints, ttl, nil
+}
+
+// query asks each nameserver in turn until one of them gives a definitive
+// answer, and returns it along with the server that answered.
+func (r *dnsResolver) query(ctx context.Context, name string, qtype uint16) (*dnswire.Message, string, error) {
+	id := newID()
+	if r.proto == protoHTTPS {
+		id = 0 // for HTTP caches; see RFC 8484 section 4.1
+	}
+	req := &dnswire.Message{
+		Header:    dnswire.Header{ID: id, RecursionDesired: true},
+		Questions: []dnswire.Question{{Name: name, Type: qtype, Class: dnswire.ClassINET}},
+		Additionals: []dnswire.RR{
+			{Name: ".", Type: dnswire.TypeOPT, Class: ednsSize, Data: &dnswire.Raw{}},
+		},
+	}
+	validate := len(r.anchors) > 0
+	if validate {
+		req.CheckingDisabled = true
+		req.Additionals[0].TTL = dnswire.EDNS0FlagDO
+	}
+
+	var (
+		lastErr  error = &net.DNSError{Err: "no nameservers", Name: name}
+		n              = len(r.nameservers)
+		offset         = 0
+		attempts       = r.attempts
+	)
+	if r.rotate && n > 0 {
+		offset = int(atomic.AddUint32(&r.next, 1) % uint32(n))
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+	for attempt := 0; attempt < attempts; attempt++ {
+		for i := 0; i < n; i++ {
+			if ctx.Err() != nil {
+				return nil, "", dnsNetError(req, "", ctx.Err())
+			}
+			server := r.nameservers[(offset+i)%n]
+			resp, err := r.exchange(ctx, server, req)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			switch resp.Rcode {
+			case dnswire.RcodeSuccess:
+				// The keys and DS records of the chain of trust are
+				// validated as the chain is walked.
+				if validate && qtype != dnswire.TypeDNSKEY && qtype != dnswire.TypeDS {
+					if err := r.validate(ctx, resp); err != nil {
+						lastErr = err
+						continue // another server may not be spoofed
+					}
+				}
+				return resp, server, nil
+			case dnswire.RcodeNameError:
+				return nil, server, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+			default:
+				lastErr = &net.DNSError{Err: rcodeText(resp.Rcode), Name: name, Server: server, IsTemporary: true}
+			}
+		}
+	}
+	return nil, "", lastErr
+}
+
+// SearchError is returned by the DNS resolver when none of the candidate
+// names derived from a name via the search list could be resolved.
+type SearchError struct {
+	Name  string   // the name passed to Resolve
+	Tried []string // fully-qualified candidates, in the order they were tried
+	Errs  []error  // the error for each candidate
+}
+
+func (e *SearchError) Error() string {
+	errs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		errs[i] = err.Error()
+	}
+	return fmt.Sprintf("lookup %s failed, %d candidate(s) tried (%s)", e.Name, len(e.Tried), strings.Join(errs, "; "))
+}
+
+// Unwrap returns the errors of each candidate, for errors.Is and errors.As.
+func (e *SearchError) Unwrap() []error {
+	return e.Errs
+}
+
+// exchange sends req to server over the resolver's transport. Over UDP, it's
+// repeated over TCP if the response was truncated.
+func (r *dnsResolver) exchange(ctx context.Context, server string, req *dnswire.Message) (*dnswire.Message, error) {
+	b, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	switch r.proto {
+	case protoZone:
+		return r.zone.answer(req), nil
+	case protoHTTPS:
+		resp, err := r.exchangeHTTPS(ctx, server, req, b)
+		if err != nil {
+			return nil, dnsNetError(req, server, err)
+		}
+		return resp, nil
+	case protoTLS:
+		resp, err := r.exchangeTLS(ctx, server, req, b)
+		if err != nil {
+			return nil, dnsNetError(req, server, err)
+		}
+		return resp, nil
+	}
+
+	resp, err := r.exchangeUDP(ctx, server, req, b)
+	if err != nil {
+		return nil, dnsNetError(req, server, err)
+	}
+	if resp.Truncated {
+		if resp, err = r.exchangeTCP(ctx, server, req, b); err != nil {
+			return nil, dnsNetError(req, server, err)
+		}
+	}
+	return resp, nil
+}
+
+func (r *dnsResolver) exchangeUDP(ctx context.Context, server string, req *dnswire.Message, b []byte) (*dnswire.Message, error) {
+	conn, stop, err := r.dial(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		var resp dnswire.Message
+		if err := resp.Unpack(buf[:n]); err != nil || !isResponseTo(&resp, req) {
+			continue // ignore garbage and stray answers, and wait for ours
+		}
+		return &resp, nil
+	}
+}
+
+func (r *dnsResolver) exchangeTCP(ctx context.Context, server string, req *dnswire.Message, b []byte) (*dnswire.Message, error) {
+	conn, stop, err := r.dial(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	return exchangeStream(conn, req, b)
+}
+
+// dial connects to server with a deadline of the nameserver timeout or the
+// deadline of ctx, whichever comes first. If ctx is cancelled while the
+// connection is in use, pending I/O fails immediately. The returned function
+// closes the connection and must be called when it's no longer needed.
+func (r *dnsResolver) dial(ctx context.Context, network, server string) (net.Conn, func(), error) {
+	deadline := time.Now().Add(r.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, server)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	conn.SetDeadline(deadline)
+	stopAfter := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	return conn, func() {
+		stopAfter()
+		cancel()
+		conn.Close()
+	}, nil
+}
+
+// exchangeStream sends a request over a stream connection, using the two
+// byte length prefix framing of RFC 1035 section 4.2.2.
+func exchangeStream(rw io.ReadWriter, req *dnswire.Message, b []byte) (*dnswire.Message, error) {
+	framed := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(framed, uint16(len(b)))
+	if _, err := rw.Write(append(framed, b...)); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(rw, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return nil, err
+	}
+
+	var resp dnswire.Message
+	if err := resp.Unpack(buf); err != nil {
+		return nil, err
+	}
+	if !isResponseTo(&resp, req) {
+		return nil, errors.New("response doesn't match query")
+	}
+	return &resp, nil
+}
+
+// answers returns the records of the given type for name in the answer
+// section, following CNAMEs, and the minimum TTL of every record involved.
+func answers(m *dnswire.Message, name string, qtype uint16) ([]dnswire.RR, time.Duration) {
+	var (
+		rrs    []dnswire.RR
+		ttl    = ^uint32(0)
+		target = name
+	)
+	for i := 0; i <= maxCNAMEs; i++ {
+		var cname *dnswire.RR
+		for j, rr := range m.Answers {
+			if !dnswire.EqualNames(rr.Name, target) {
+				continue
+			}
+			switch {
+			case rr.Type == qtype:
+				rrs = append(rrs, rr)
+			case rr.Type == dnswire.TypeCNAME && cname == nil:
+				cname = &m.Answers[j]
+			}
+		}
+		if len(rrs) > 0 || cname == nil {
+			break
+		}
+		ttl = minUint32(ttl, cname.TTL)
+		target = cname.Data.(*dnswire.CNAME).Target
+	}
+	for _, rr := range rrs {
+		ttl = minUint32(ttl, rr.TTL)
+	}
+
+	d := time.Duration(ttl) * time.Second
+	if d < minTTL {
+		d = minTTL
+	}
+	return rrs, d
+}
+
+func isResponseTo(resp, req *dnswire.Message) bool {
+	if !resp.Response || resp.ID != req.ID || len(resp.Questions) != len(req.Questions) {
+		return false
+	}
+	for i, q := range req.Questions {
+		p := resp.Questions[i]
+		if p.Type != q.Type || p.Class != q.Class || !dnswire.EqualNames(p.Name, q.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+func dnsNetError(req *dnswire.Message, server string, err error) error {
+	e := &net.DNSError{Err: err.Error(), Server: server}
+	if len(req.Questions) > 0 {
+		e.Name = req.Questions[0].Name
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		e.IsTimeout = true
+	}
+	return e
+}
+
+func rcodeText(rcode int) string {
+	switch rcode {
+	case dnswire.RcodeFormatError:
+		return "format error"
+	case dnswire.RcodeServerFailure:
+		return "server failure"
+	case dnswire.RcodeNameError:
+		return "no such host"
+	case dnswire.RcodeNotImplemented:
+		return "not implemented"
+	case dnswire.RcodeRefused:
+		return "query refused"
+	default:
+		return fmt.Sprintf("rcode %d", rcode)
+	}
+}
+
+func newID() uint16 {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint16(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
+
+func withPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
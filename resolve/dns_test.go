@@ -0,0 +1,255 @@
+package resolve_test
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+	"github.com/peterbourgon/srvproxy/resolve/dnstest"
+)
+
+func TestDNS(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetSRV("_http._tcp.foo.internal",
+		dnstest.SRV{Port: 8080, Target: "b.internal", TTL: 300 * time.Second},
+		dnstest.SRV{Port: 8081, Target: "a.internal", TTL: 60 * time.Second},
+	)
+
+	r := resolve.DNS(resolve.Nameservers(s.Addr()))
+	endpoints, ttl, err := r.Resolve("_http._tcp.foo.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"a.internal:8081", "b.internal:8080"}, resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want, have := 60*time.Second, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+}
+
+func TestDNSPriorityWeight(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetSRV("foo.internal",
+		dnstest.SRV{Priority: 10, Weight: 0, Port: 80, Target: "standby.internal", TTL: 30 * time.Second},
+		dnstest.SRV{Priority: 1, Weight: 10, Port: 80, Target: "b.internal", TTL: 30 * time.Second},
+		dnstest.SRV{Priority: 1, Weight: 90, Port: 80, Target: "a.internal", TTL: 30 * time.Second},
+	)
+
+	have, _, err := resolve.DNS(resolve.Nameservers(s.Addr())).Resolve("foo.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resolve.Endpoint{
+		{Address: "a.internal", Port: 80, Priority: 1, Weight: 90},
+		{Address: "b.internal", Port: 80, Priority: 1, Weight: 10},
+		{Address: "standby.internal", Port: 80, Priority: 10, Weight: 0},
+	}
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+}
+
+func TestDNSCNAME(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetCNAME("foo.internal", "bar.internal", 10*time.Second)
+	s.SetSRV("bar.internal", dnstest.SRV{Port: 80, Target: "a.internal", TTL: 30 * time.Second})
+
+	endpoints, ttl, err := resolve.DNS(resolve.Nameservers(s.Addr())).Resolve("foo.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"a.internal:80"}, resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want, have := 10*time.Second, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+}
+
+func TestDNSTruncated(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetSRV("foo.internal", dnstest.SRV{Port: 80, Target: "a.internal", TTL: 30 * time.Second})
+	s.SetFault("foo.internal", dnstest.Truncate)
+
+	endpoints, _, err := resolve.DNS(resolve.Nameservers(s.Addr())).Resolve("foo.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"a.internal:80"}, resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	var tcp []bool
+	for _, q := range s.Received() {
+		tcp = append(tcp, q.TCP)
+	}
+	if want := []bool{false, true}; !reflect.DeepEqual(want, tcp) {
+		t.Errorf("want queries over TCP %v, have %v", want, tcp)
+	}
+}
+
+func TestDNSFailover(t *testing.T) {
+	bad := dnstest.NewServer()
+	defer bad.Close()
+	bad.SetFault("*", dnstest.ServFail)
+
+	good := dnstest.NewServer()
+	defer good.Close()
+	good.SetSRV("foo.internal", dnstest.SRV{Port: 80, Target: "a.internal", TTL: 30 * time.Second})
+
+	r := resolve.DNS(resolve.Nameservers(bad.Addr(), good.Addr()))
+	if _, _, err := r.Resolve("foo.internal"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDNSContext(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetFault("*", dnstest.Timeout)
+
+	r := resolve.DNS(resolve.Nameservers(s.Addr()), resolve.DNSTimeout(time.Minute), resolve.Attempts(5))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	begin := time.Now()
+	_, _, err := r.(resolve.ContextResolver).ResolveContext(ctx, "foo.internal")
+	if e, ok := err.(*net.DNSError); !ok || !e.IsTimeout {
+		t.Errorf("want timeout *net.DNSError, have %#v", err)
+	}
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("lookup took %s, want it bounded by the context", took)
+	}
+}
+
+func TestDNSNameError(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+
+	_, _, err := resolve.DNS(resolve.Nameservers(s.Addr())).Resolve("foo.internal")
+	if e, ok := err.(*net.DNSError); !ok || !e.IsNotFound {
+		t.Errorf("want not-found *net.DNSError, have %#v", err)
+	}
+}
+
+func TestDNSSearch(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetSRV("users.svc.internal", dnstest.SRV{Port: 80, Target: "a.internal", TTL: 30 * time.Second})
+
+	r := resolve.DNS(
+		resolve.Nameservers(s.Addr()),
+		resolve.Search("default.internal", "svc.internal"),
+	)
+	endpoints, _, err := r.Resolve("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"a.internal:80"}, resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	var asked []string
+	for _, q := range s.Received() {
+		asked = append(asked, q.Name)
+	}
+	if want := []string{"users.default.internal.", "users.svc.internal."}; !reflect.DeepEqual(want, asked) {
+		t.Errorf("want %v, have %v", want, asked)
+	}
+}
+
+func TestDNSSearchCopy(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetSRV("users.svc.internal", dnstest.SRV{Port: 80, Target: "a.internal", TTL: 30 * time.Second})
+
+	domains := []string{"svc.internal"}
+	r := resolve.DNS(resolve.Nameservers(s.Addr()), resolve.Search(domains...))
+	domains[0] = "default.internal"
+
+	if _, _, err := r.Resolve("users"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDNSSearchError(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+
+	r := resolve.DNS(
+		resolve.Nameservers(s.Addr()),
+		resolve.Search("default.internal", "svc.internal"),
+		resolve.Ndots(2),
+	)
+	_, _, err := r.Resolve("users.prod")
+	e, ok := err.(*resolve.SearchError)
+	if !ok {
+		t.Fatalf("want *resolve.SearchError, have %#v", err)
+	}
+
+	want := []string{"users.prod.default.internal.", "users.prod.svc.internal.", "users.prod."}
+	if have := e.Tried; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	for _, name := range want {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q doesn't mention %q", err, name)
+		}
+	}
+}
+
+func TestDNSRotate(t *testing.T) {
+	servers := make([]*dnstest.Server, 2)
+	addrs := make([]string, len(servers))
+	for i := range servers {
+		servers[i] = dnstest.NewServer()
+		defer servers[i].Close()
+		servers[i].SetSRV("foo.internal", dnstest.SRV{Port: 80, Target: "a.internal", TTL: 30 * time.Second})
+		addrs[i] = servers[i].Addr()
+	}
+
+	r := resolve.DNS(resolve.Nameservers(addrs...), resolve.Rotate(true))
+	for i := 0; i < 4; i++ {
+		if _, _, err := r.Resolve("foo.internal"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, s := range servers {
+		if want, have := 2, s.Queries("foo.internal"); want != have {
+			t.Errorf("nameserver %d: want %d queries, have %d", i, want, have)
+		}
+	}
+}
+
+func TestDNSAttempts(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetFault("*", dnstest.ServFail)
+
+	r := resolve.DNS(resolve.Nameservers(s.Addr()), resolve.Attempts(3))
+	if _, _, err := r.Resolve("foo.internal"); err == nil {
+		t.Fatal("want error, have none")
+	}
+	if want, have := 3, s.Queries("foo.internal"); want != have {
+		t.Errorf("want %d queries, have %d", want, have)
+	}
+}
+
+func TestDNSConflictingOptions(t *testing.T) {
+	for _, r := range []resolve.Resolver{
+		resolve.DNS(resolve.SVCBRecords(true), resolve.DNSSD(true)),
+		resolve.SVCB(resolve.DNSSD(true)),
+		resolve.DoT("127.0.0.1", resolve.ExpandTargets(true), resolve.SVCBRecords(true)),
+	} {
+		if _, _, err := r.Resolve("foo.internal"); err == nil || !strings.Contains(err.Error(), "can't be combined") {
+			t.Errorf("want error about combining options, have %v", err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package resolve
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve/internal/dnswire"
+)
+
+// InstanceLabel is the label that DNS-SD resolution sets on each endpoint to
+// the name of the service instance it belongs to.
+const InstanceLabel = "instance"
+
+// DNSSD enables DNS-Based Service Discovery, as specified by RFC 6763. Names
+// are taken to be service types, e.g. "_http._tcp.example.com", whose PTR
+// records list service instances. The SRV and TXT records of each instance
+// are looked up, and the key=value attributes in the TXT record are attached
+// to the instance's endpoints as labels, with lowercased keys, alongside
+// any labels set by ExpandTargets. Attributes without a value get an empty
+// one. If a name has no PTR records, it's taken to be an instance itself. It
+// can't be combined with SVCBRecords. If DNSSD isn't provided, only SRV
+// records are looked up.
+func DNSSD(enabled bool) DNSOption {
+	return func(r *dnsResolver) { r.dnssd = enabled }
+}
+
+func (r *dnsResolver) resolveDNSSD(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	var (
+		instances []string
+		ttl       time.Duration
+		browsed   bool
+	)
+	resp, _, err := r.query(ctx, name, dnswire.TypePTR)
+	if e, ok := err.(*net.DNSError); err != nil && (!ok || !e.IsNotFound) {
+		return []Endpoint{}, 0, err
+	}
+	if err == nil {
+		var rrs []dnswire.RR
+		rrs, ttl = answers(resp, name, dnswire.TypePTR)
+		for _, rr := range rrs {
+			instances = append(instances, rr.Data.(*dnswire.PTR).Target)
+		}
+		browsed = len(instances) > 0
+	}
+	if !browsed {
+		instances = []string{name}
+	}
+
+	type result struct {
+		endpoints []Endpoint
+		ttl       time.Duration
+		err       error
+	}
+	results := make([]chan result, len(instances))
+	for i, instance := range instances {
+		results[i] = make(chan result, 1)
+		go func(instance string, c chan<- result) {
+			endpoints, ttl, err := r.resolveInstance(ctx, instance, browsed)
+			c <- result{endpoints, ttl, err}
+		}(instance, results[i])
+	}
+
+	var (
+		endpoints = []Endpoint{}
+		haveTTL   = browsed // the TTL of the PTR records
+		firstErr  error
+	)
+	for _, c := range results {
+		res := <-c
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue // other instances may still be fine
+		}
+		if !haveTTL || res.ttl < ttl {
+			ttl, haveTTL = res.ttl, true
+		}
+		endpoints = append(endpoints, res.endpoints...)
+	}
+	if len(endpoints) <= 0 {
+		return []Endpoint{}, 0, firstErr
+	}
+	sortEndpoints(endpoints)
+	return endpoints, ttl, nil
+}
+
+// resolveInstance looks up the SRV and TXT records of a service instance.
+// If label is set, the endpoints are labeled with the instance name.
+func (r *dnsResolver) resolveInstance(ctx context.Context, instance string, label bool) ([]Endpoint, time.Duration, error) {
+	endpoints, ttl, err := r.resolveSRV(ctx, instance)
+	if err != nil {
+		return []Endpoint{}, 0, err
+	}
+
+	// Every instance should have a TXT record, but a missing one is no
+	// reason to discard the instance.
+	var attrs map[string]string
+	if resp, _, err := r.query(ctx, instance, dnswire.TypeTXT); err == nil {
+		rrs, txtTTL := answers(resp, instance, dnswire.TypeTXT)
+		if len(rrs) > 0 {
+			attrs = parseTXT(rrs[0].Data.(*dnswire.TXT).Strings)
+			if txtTTL < ttl {
+				ttl = txtTTL
+			}
+		}
+	}
+	if label {
+		if attrs == nil {
+			attrs = map[string]string{}
+		}
+		attrs[InstanceLabel] = strings.TrimRight(instance, ".")
+	}
+
+	// Labels set by the SRV lookup, like TargetLabel, take precedence.
+	for i, endpoint := range endpoints {
+		if len(attrs) <= 0 {
+			break
+		}
+		labels := make(map[string]string, len(attrs)+len(endpoint.Labels))
+		for k, v := range attrs {
+			labels[k] = v
+		}
+		for k, v := range endpoint.Labels {
+			labels[k] = v
+		}
+		endpoints[i].Labels = labels
+	}
+	return endpoints, ttl, nil
+}
+
+// parseTXT parses the strings of a DNS-SD TXT record into attributes, per
+// RFC 6763 section 6. Keys are case-insensitive, so they're lowercased, and
+// only the first occurrence of a key counts. Strings without a key are
+// ignored.
+func parseTXT(strs []string) map[string]string {
+	attrs := map[string]string{}
+	for _, s := range strs {
+		key, value := s, ""
+		if i := strings.Index(s, "="); i >= 0 {
+			key, value = s[:i], s[i+1:]
+		}
+		if key = strings.ToLower(key); key == "" {
+			continue
+		}
+		if _, ok := attrs[key]; !ok {
+			attrs[key] = value
+		}
+	}
+	if len(attrs) <= 0 {
+		return nil
+	}
+	return attrs
+}
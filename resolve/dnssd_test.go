@@ -0,0 +1,84 @@
+package resolve_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+	"github.com/peterbourgon/srvproxy/resolve/dnstest"
+)
+
+func TestDNSSD(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetPTR("_http._tcp.foo.internal",
+		dnstest.PTR{Target: "a._http._tcp.foo.internal", TTL: 120 * time.Second},
+		dnstest.PTR{Target: "b._http._tcp.foo.internal", TTL: 120 * time.Second},
+	)
+	s.SetSRV("a._http._tcp.foo.internal", dnstest.SRV{Port: 8080, Target: "a.internal", TTL: time.Minute})
+	s.SetSRV("b._http._tcp.foo.internal", dnstest.SRV{Port: 8080, Target: "b.internal", TTL: time.Minute})
+	s.SetTXT("a._http._tcp.foo.internal", dnstest.TXT{Strings: []string{"Version=2", "zone=us-east-1a", "canary", "version=3", "=junk"}, TTL: 30 * time.Second})
+
+	r := resolve.DNS(resolve.Nameservers(s.Addr()), resolve.DNSSD(true))
+	endpoints, ttl, err := r.Resolve("_http._tcp.foo.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resolve.Endpoint{
+		{Address: "a.internal", Port: 8080, Labels: map[string]string{
+			"version":             "2",
+			"zone":                "us-east-1a",
+			"canary":              "",
+			resolve.InstanceLabel: "a._http._tcp.foo.internal",
+		}},
+		{Address: "b.internal", Port: 8080, Labels: map[string]string{
+			resolve.InstanceLabel: "b._http._tcp.foo.internal",
+		}},
+	}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+	if want, have := 30*time.Second, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+
+	// Without PTR records, the name is taken to be an instance.
+	endpoints, _, err = r.Resolve("b._http._tcp.foo.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"b.internal:8080"}, resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestDNSSDExpandTargets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prod.zone")
+	writeFile(t, path, `
+$ORIGIN prod.internal.
+$TTL 60
+_http._tcp         PTR  a._http._tcp
+a._http._tcp       SRV  0 0 8080 users-1
+a._http._tcp       TXT  "version=2" "target=ignored"
+users-1            A    10.0.0.1
+`)
+
+	r, err := resolve.ZoneFile(path, resolve.DNSSD(true), resolve.ExpandTargets(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints, _, err := r.Resolve("_http._tcp.prod.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resolve.Endpoint{{Address: "10.0.0.1", Port: 8080, Labels: map[string]string{
+		"version":             "2",
+		resolve.TargetLabel:   "users-1.prod.internal",
+		resolve.InstanceLabel: "a._http._tcp.prod.internal",
+	}}}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+}
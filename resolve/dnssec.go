@@ -0,0 +1,623 @@
+package resolve
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve/internal/dnswire"
+)
+
+// DNSSEC signing algorithms understood by the validator (RFC 8624).
+const (
+	algRSASHA256       = 8
+	algRSASHA512       = 10
+	algECDSAP256SHA256 = 13
+	algECDSAP384SHA384 = 14
+	algED25519         = 15
+)
+
+// maxChain bounds how many zones are walked from an answer to a trust anchor.
+const maxChain = 16
+
+// maxNSEC3Iterations bounds the hash iterations of the NSEC3 records that are
+// accepted as proof, as RFC 9276 recommends; records with more are ignored.
+const maxNSEC3Iterations = 150
+
+// TrustAnchor is the DS record of a zone whose keys are trusted without
+// further proof, where chains of trust end. For the public DNS, it's the
+// root's, as published by IANA; for private zones, it may be any zone's.
+type TrustAnchor struct {
+	Zone       string
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+// ParseTrustAnchor parses a trust anchor from a DS record in the master file
+// format, with or without its TTL and class, e.g.
+//
+//	internal. IN DS 12345 13 2 5F3A...
+func ParseTrustAnchor(s string) (TrustAnchor, error) {
+	fields := strings.Fields(s)
+	for len(fields) > 1 && !strings.EqualFold(fields[1], "DS") {
+		fields = append(fields[:1], fields[2:]...) // skip the TTL and class
+	}
+	if len(fields) < 6 {
+		return TrustAnchor{}, fmt.Errorf("bad trust anchor %q: want zone, DS, key tag, algorithm, digest type and digest", s)
+	}
+	var nums [3]uint64
+	for i, size := range []int{16, 8, 8} {
+		n, err := strconv.ParseUint(fields[2+i], 10, size)
+		if err != nil {
+			return TrustAnchor{}, fmt.Errorf("bad trust anchor %q: %v", s, err)
+		}
+		nums[i] = n
+	}
+	digest, err := hex.DecodeString(strings.Join(fields[5:], ""))
+	if err != nil {
+		return TrustAnchor{}, fmt.Errorf("bad trust anchor %q: %v", s, err)
+	}
+	return TrustAnchor{
+		Zone:       dnswire.Fqdn(fields[0]),
+		KeyTag:     uint16(nums[0]),
+		Algorithm:  uint8(nums[1]),
+		DigestType: uint8(nums[2]),
+		Digest:     digest,
+	}, nil
+}
+
+// DNSSEC enables DNSSEC validation, as specified by RFC 4033 to 4035. DNSSEC
+// records are asked for, and every record set in an answer must be signed by
+// a key that's trusted via a chain of DS and DNSKEY records from one of the
+// anchors. So must the addresses of SRV targets, for ExpandTargets. Answers
+// that don't validate are rejected with a *BogusError. So are answers
+// synthesized from a wildcard, unless they come with a signed NSEC or NSEC3
+// record that proves that the name asked for doesn't exist. Answers that a
+// name doesn't exist aren't validated, so an attacker may still make a
+// lookup fail, but can't redirect it. Nameservers are asked not to validate
+// themselves, so that bogus answers are reported as such. If DNSSEC isn't
+// provided, answers are taken on trust.
+func DNSSEC(anchors ...TrustAnchor) DNSOption {
+	return func(r *dnsResolver) { r.anchors = append([]TrustAnchor{}, anchors...) }
+}
+
+// BogusError is returned by resolvers with DNSSEC validation when an answer
+// doesn't validate. That's a sign of a broken zone, or of an attack.
+type BogusError struct {
+	Name   string // the owner of the records that didn't validate
+	Type   string // their type, e.g. "SRV"
+	Reason string
+}
+
+func (e *BogusError) Error() string {
+	return fmt.Sprintf("bogus DNSSEC data for %s %s: %s", e.Name, e.Type, e.Reason)
+}
+
+// trustedKeys are the validated zone keys of a zone.
+type trustedKeys struct {
+	keys    []*dnswire.DNSKEY
+	expires time.Time
+}
+
+// rrset is a set of records with the same owner and type, and the
+// signatures that cover them.
+type rrset struct {
+	name string
+	typ  uint16
+	rrs  []*dnswire.RR
+	sigs []*dnswire.RRSIG
+}
+
+// rrsets groups the records of a message section into sets.
+func rrsets(section []dnswire.RR) []*rrset {
+	var (
+		sets  []*rrset
+		index = map[string]*rrset{}
+		key   = func(name string, typ uint16) string {
+			return strings.ToLower(dnswire.Fqdn(name)) + "/" + strconv.Itoa(int(typ))
+		}
+	)
+	for i := range section {
+		if rr := &section[i]; rr.Type != dnswire.TypeRRSIG {
+			k := key(rr.Name, rr.Type)
+			if set, ok := index[k]; ok {
+				set.rrs = append(set.rrs, rr)
+				continue
+			}
+			set := &rrset{name: rr.Name, typ: rr.Type, rrs: []*dnswire.RR{rr}}
+			index[k] = set
+			sets = append(sets, set)
+		}
+	}
+	for _, rr := range section {
+		if sig, ok := rr.Data.(*dnswire.RRSIG); ok {
+			if set, ok := index[key(rr.Name, sig.TypeCovered)]; ok {
+				set.sigs = append(set.sigs, sig)
+			}
+		}
+	}
+	return sets
+}
+
+// validate checks the answers of resp, which must all be signed. Addresses
+// in the additional section that don't validate are dropped. TTLs are capped
+// by the signatures. Wildcard expansions are proven by the authority section.
+func (r *dnsResolver) validate(ctx context.Context, resp *dnswire.Message) error {
+	for _, set := range rrsets(resp.Answers) {
+		if err := r.verify(ctx, set, resp.Authorities, 0); err != nil {
+			return err
+		}
+	}
+
+	var additionals []dnswire.RR
+	for _, set := range rrsets(resp.Additionals) {
+		if set.typ == dnswire.TypeA || set.typ == dnswire.TypeAAAA {
+			if err := r.verify(ctx, set, resp.Authorities, 0); err != nil {
+				continue // they'll be asked for, and validated, if needed
+			}
+		}
+		for _, rr := range set.rrs {
+			additionals = append(additionals, *rr)
+		}
+	}
+	resp.Additionals = additionals
+	return nil
+}
+
+// verify checks that set is signed by a trusted key of the signer zone, and
+// caps the TTLs of its records by the signature. If the signature shows that
+// set was expanded from a wildcard, authority must prove that its name
+// doesn't exist, as RFC 4035 section 5.3.4 requires; otherwise, the answer
+// could be replayed for any name covered by the wildcard.
+func (r *dnsResolver) verify(ctx context.Context, set *rrset, authority []dnswire.RR, depth int) error {
+	bogus := func(reason string) error {
+		return &BogusError{Name: strings.TrimSuffix(set.name, "."), Type: typeName(set.typ), Reason: reason}
+	}
+	if len(set.sigs) <= 0 {
+		return bogus("no signatures")
+	}
+
+	var (
+		now    = uint32(time.Now().Unix())
+		reason string
+	)
+	for _, sig := range set.sigs {
+		switch {
+		case !isSubdomain(set.name, sig.SignerName):
+			reason = fmt.Sprintf("signer %s isn't a parent", sig.SignerName)
+			continue
+		case !current(sig, now):
+			reason = "signature expired, or not yet valid"
+			continue
+		}
+		keys, err := r.zoneKeys(ctx, sig.SignerName, depth+1)
+		if err != nil {
+			return err
+		}
+		if err := verifySig(sig, keys, set.rrs); err != nil {
+			reason = err.Error()
+			continue
+		}
+		if int(sig.Labels) < dnswire.SignatureLabels(set.name) && !r.provesWildcard(ctx, set.name, sig, authority, depth) {
+			reason = "wildcard expansion without proof that the name doesn't exist"
+			continue
+		}
+		for _, rr := range set.rrs {
+			rr.TTL = minUint32(rr.TTL, minUint32(sig.OriginalTTL, sig.Expiration-now))
+		}
+		return nil
+	}
+	return bogus(reason)
+}
+
+// zoneKeys returns the zone keys of zone, once they're validated against the
+// zone's DS records, which are validated in turn, up to a trust anchor.
+func (r *dnsResolver) zoneKeys(ctx context.Context, zone string, depth int) ([]*dnswire.DNSKEY, error) {
+	zone = strings.ToLower(dnswire.Fqdn(zone))
+	bogus := func(reason string) error {
+		return &BogusError{Name: strings.TrimSuffix(zone, "."), Type: "DNSKEY", Reason: reason}
+	}
+	if depth > maxChain {
+		return nil, bogus("chain of trust too long")
+	}
+
+	r.mtx.Lock()
+	trusted, ok := r.keys[zone]
+	r.mtx.Unlock()
+	if ok && time.Now().Before(trusted.expires) {
+		return trusted.keys, nil
+	}
+
+	resp, _, err := r.query(ctx, zone, dnswire.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	set := findRRset(resp.Answers, zone, dnswire.TypeDNSKEY)
+	if set == nil {
+		return nil, bogus("no DNSKEY records")
+	}
+	dss, err := r.delegation(ctx, zone, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	// The keys that the DS records vouch for must sign the whole set.
+	var vouched []*dnswire.DNSKEY
+	for _, rr := range set.rrs {
+		key := rr.Data.(*dnswire.DNSKEY)
+		for _, ds := range dss {
+			if key.Algorithm == ds.Algorithm && key.KeyTag() == ds.KeyTag && matchDS(zone, key, ds) {
+				vouched = append(vouched, key)
+				break
+			}
+		}
+	}
+	if len(vouched) <= 0 {
+		return nil, bogus("no DNSKEY matches the DS records")
+	}
+	var (
+		now    = uint32(time.Now().Unix())
+		signed *dnswire.RRSIG
+	)
+	for _, sig := range set.sigs {
+		if dnswire.EqualNames(sig.SignerName, zone) && int(sig.Labels) == dnswire.SignatureLabels(zone) && current(sig, now) && verifySig(sig, vouched, set.rrs) == nil {
+			signed = sig
+			break
+		}
+	}
+	if signed == nil {
+		return nil, bogus("not signed by a key the DS records vouch for")
+	}
+
+	var keys []*dnswire.DNSKEY
+	ttl := minUint32(signed.OriginalTTL, signed.Expiration-now)
+	for _, rr := range set.rrs {
+		key := rr.Data.(*dnswire.DNSKEY)
+		if key.Flags&dnswire.DNSKEYFlagZone != 0 && key.Protocol == 3 {
+			keys = append(keys, key)
+		}
+		ttl = minUint32(ttl, rr.TTL)
+	}
+
+	r.mtx.Lock()
+	if r.keys == nil {
+		r.keys = map[string]trustedKeys{}
+	}
+	r.keys[zone] = trustedKeys{keys, time.Now().Add(time.Duration(ttl) * time.Second)}
+	r.mtx.Unlock()
+	return keys, nil
+}
+
+// delegation returns the trusted DS records of zone: those of its trust
+// anchors, or else those signed by its parent.
+func (r *dnsResolver) delegation(ctx context.Context, zone string, depth int) ([]*dnswire.DS, error) {
+	var dss []*dnswire.DS
+	for _, anchor := range r.anchors {
+		if dnswire.EqualNames(anchor.Zone, zone) {
+			dss = append(dss, &dnswire.DS{
+				KeyTag:     anchor.KeyTag,
+				Algorithm:  anchor.Algorithm,
+				DigestType: anchor.DigestType,
+				Digest:     anchor.Digest,
+			})
+		}
+	}
+	if len(dss) > 0 {
+		return dss, nil
+	}
+
+	bogus := func(reason string) error {
+		return &BogusError{Name: strings.TrimSuffix(zone, "."), Type: "DS", Reason: reason}
+	}
+	if zone == "." {
+		return nil, bogus("no trust anchor")
+	}
+	resp, _, err := r.query(ctx, zone, dnswire.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	set := findRRset(resp.Answers, zone, dnswire.TypeDS)
+	if set == nil {
+		return nil, bogus("no DS records, so no chain of trust from an anchor")
+	}
+
+	// DS records belong to the parent, and must be signed by it, or else
+	// the chain would never end.
+	sigs := set.sigs[:0]
+	for _, sig := range set.sigs {
+		if !dnswire.EqualNames(sig.SignerName, zone) {
+			sigs = append(sigs, sig)
+		}
+	}
+	set.sigs = sigs
+	if err := r.verify(ctx, set, nil, depth); err != nil {
+		return nil, err
+	}
+	for _, rr := range set.rrs {
+		dss = append(dss, rr.Data.(*dnswire.DS))
+	}
+	return dss, nil
+}
+
+// provesWildcard returns true if authority holds a signed NSEC or NSEC3 record of
+// the zone of sig, which proves that name, expanded from a wildcard as sig
+// shows, doesn't exist, and neither does anything between it and the closest
+// encloser, the parent of the wildcard.
+func (r *dnsResolver) provesWildcard(ctx context.Context, name string, sig *dnswire.RRSIG, authority []dnswire.RR, depth int) bool {
+	var (
+		labels     = dnswire.Labels(name)
+		nextCloser = strings.Join(labels[len(labels)-int(sig.Labels)-1:], ".") + "."
+		zone       = sig.SignerName
+	)
+	for _, set := range rrsets(authority) {
+		if !isSubdomain(set.name, zone) || len(set.rrs) != 1 {
+			continue
+		}
+		var proves bool
+		switch d := set.rrs[0].Data.(type) {
+		case *dnswire.NSEC:
+			// The NSEC covers name, and neither of its ends is at or below
+			// the next closer name, so nothing is.
+			proves = covers(set.name, d.NextName, name) &&
+				!isSubdomain(set.name, nextCloser) && !isSubdomain(d.NextName, nextCloser)
+		case *dnswire.NSEC3:
+			// The NSEC3 covers the hash of the next closer name.
+			proves = dnswire.EqualNames(parent(set.name), zone) && coversHash(set.name, d, nextCloser)
+		}
+		if proves && r.verify(ctx, set, nil, depth) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// covers returns true if name is strictly between owner and next, in
+// canonical order. If next isn't after owner, owner is the last name of the
+// zone, and next its apex, so that every name after owner is covered.
+func covers(owner, next, name string) bool {
+	if dnswire.CompareNames(owner, next) < 0 {
+		return dnswire.CompareNames(owner, name) < 0 && dnswire.CompareNames(name, next) < 0
+	}
+	return dnswire.CompareNames(owner, name) < 0 && isSubdomain(name, next)
+}
+
+// coversHash returns true if the hash of name lies strictly between the hash
+// in owner, the name of an NSEC3 record, and the next hash of the record.
+func coversHash(owner string, d *dnswire.NSEC3, name string) bool {
+	if d.HashAlgorithm != dnswire.NSEC3HashSHA1 || d.Iterations > maxNSEC3Iterations {
+		return false
+	}
+	hash, err := nsec3Hash(name, d.Salt, d.Iterations)
+	if err != nil {
+		return false
+	}
+	var (
+		from = strings.ToUpper(dnswire.Labels(owner)[0])
+		to   = nsec3Encoding.EncodeToString(d.NextHashed)
+		h    = nsec3Encoding.EncodeToString(hash)
+	)
+	if from < to {
+		return from < h && h < to
+	}
+	return from < h || h < to // the last hash of the zone wraps around
+}
+
+// nsec3Encoding is the encoding of hashes in the names of NSEC3 records.
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// nsec3Hash returns the NSEC3 hash of name (RFC 5155 section 5).
+func nsec3Hash(name string, salt []byte, iterations uint16) ([]byte, error) {
+	b, err := dnswire.CanonicalName(name)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i <= int(iterations); i++ {
+		h := sha1.New()
+		h.Write(b)
+		h.Write(salt)
+		b = h.Sum(nil)
+	}
+	return b, nil
+}
+
+// parent returns the parent of name, fully qualified.
+func parent(name string) string {
+	labels := dnswire.Labels(name)
+	if len(labels) <= 1 {
+		return "."
+	}
+	return strings.Join(labels[1:], ".") + "."
+}
+
+func findRRset(section []dnswire.RR, name string, typ uint16) *rrset {
+	for _, set := range rrsets(section) {
+		if set.typ == typ && dnswire.EqualNames(set.name, name) {
+			return set
+		}
+	}
+	return nil
+}
+
+// verifySig checks sig over rrs with each of the keys it may have been made
+// with.
+func verifySig(sig *dnswire.RRSIG, keys []*dnswire.DNSKEY, rrs []*dnswire.RR) error {
+	set := make([]dnswire.RR, len(rrs))
+	for i, rr := range rrs {
+		set[i] = *rr
+	}
+	data, err := dnswire.SignedData(sig, set)
+	if err != nil {
+		return err
+	}
+	err = errors.New("no key matches the signature")
+	for _, key := range keys {
+		if key.Algorithm != sig.Algorithm || key.KeyTag() != sig.KeyTag {
+			continue
+		}
+		if err = verifyKey(key, data, sig.Signature); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifyKey checks a signature over data made with key.
+func verifyKey(key *dnswire.DNSKEY, data, sig []byte) error {
+	switch key.Algorithm {
+	case algRSASHA256, algRSASHA512:
+		pub, err := rsaKey(key.PublicKey)
+		if err != nil {
+			return err
+		}
+		h := crypto.SHA256
+		if key.Algorithm == algRSASHA512 {
+			h = crypto.SHA512
+		}
+		digest := h.New()
+		digest.Write(data)
+		if err := rsa.VerifyPKCS1v15(pub, h, digest.Sum(nil), sig); err != nil {
+			return errors.New("bad signature")
+		}
+		return nil
+
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		curve, h := elliptic.P256(), sha256.New()
+		if key.Algorithm == algECDSAP384SHA384 {
+			curve, h = elliptic.P384(), sha512.New384()
+		}
+		size := curve.Params().BitSize / 8
+		if len(key.PublicKey) != 2*size || len(sig) != 2*size {
+			return errors.New("bad ECDSA key or signature size")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.PublicKey[:size]),
+			Y:     new(big.Int).SetBytes(key.PublicKey[size:]),
+		}
+		h.Write(data)
+		if !ecdsa.Verify(pub, h.Sum(nil), new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])) {
+			return errors.New("bad signature")
+		}
+		return nil
+
+	case algED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return errors.New("bad Ed25519 key size")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key.PublicKey), data, sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported algorithm %d", key.Algorithm)
+	}
+}
+
+// rsaKey decodes an RSA public key in the format of RFC 3110 section 2.
+func rsaKey(b []byte) (*rsa.PublicKey, error) {
+	if len(b) < 1 {
+		return nil, errors.New("bad RSA key")
+	}
+	n, b := int(b[0]), b[1:]
+	if n == 0 {
+		if len(b) < 2 {
+			return nil, errors.New("bad RSA key")
+		}
+		n, b = int(b[0])<<8|int(b[1]), b[2:]
+	}
+	if n == 0 || n > 8 || len(b) <= n {
+		return nil, errors.New("bad RSA key")
+	}
+	e := new(big.Int).SetBytes(b[:n])
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("bad RSA exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(b[n:]), E: int(e.Int64())}, nil
+}
+
+// matchDS reports whether ds is the digest of key, owned by zone.
+func matchDS(zone string, key *dnswire.DNSKEY, ds *dnswire.DS) bool {
+	var h hash.Hash
+	switch ds.DigestType {
+	case 1:
+		h = sha1.New()
+	case 2:
+		h = sha256.New()
+	case 4:
+		h = sha512.New384()
+	default:
+		return false
+	}
+	owner, err := dnswire.CanonicalName(zone)
+	if err != nil {
+		return false
+	}
+	rdata, err := dnswire.CanonicalRData(key)
+	if err != nil {
+		return false
+	}
+	h.Write(owner)
+	h.Write(rdata)
+	return string(h.Sum(nil)) == string(ds.Digest)
+}
+
+// current reports whether now is within the validity period of sig, in the
+// serial number arithmetic of RFC 1982.
+func current(sig *dnswire.RRSIG, now uint32) bool {
+	return int32(now-sig.Inception) >= 0 && int32(sig.Expiration-now) >= 0
+}
+
+// isSubdomain reports whether name is at or below zone.
+func isSubdomain(name, zone string) bool {
+	name, zone = strings.ToLower(dnswire.Fqdn(name)), strings.ToLower(dnswire.Fqdn(zone))
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+func typeName(typ uint16) string {
+	switch typ {
+	case dnswire.TypeA:
+		return "A"
+	case dnswire.TypeAAAA:
+		return "AAAA"
+	case dnswire.TypeCNAME:
+		return "CNAME"
+	case dnswire.TypePTR:
+		return "PTR"
+	case dnswire.TypeTXT:
+		return "TXT"
+	case dnswire.TypeSRV:
+		return "SRV"
+	case dnswire.TypeSVCB:
+		return "SVCB"
+	case dnswire.TypeHTTPS:
+		return "HTTPS"
+	case dnswire.TypeDS:
+		return "DS"
+	case dnswire.TypeDNSKEY:
+		return "DNSKEY"
+	case dnswire.TypeNSEC:
+		return "NSEC"
+	case dnswire.TypeNSEC3:
+		return "NSEC3"
+	default:
+		return "TYPE" + strconv.Itoa(int(typ))
+	}
+}
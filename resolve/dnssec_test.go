@@ -0,0 +1,292 @@
+package resolve_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+	"github.com/peterbourgon/srvproxy/resolve/dnstest"
+	"github.com/peterbourgon/srvproxy/resolve/internal/dnswire"
+)
+
+func TestDNSSEC(t *testing.T) {
+	z := newSignedZones(t)
+	s := z.serve(t)
+	defer s.Close()
+
+	r := resolve.DNS(resolve.Nameservers(s.Addr()), resolve.DNSSEC(z.anchor), resolve.ExpandTargets(true))
+	endpoints, ttl, err := r.Resolve("_http._tcp.users.prod.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "10.0.0.1:8080", fmt.Sprint(endpoints[0]); len(endpoints) != 1 || want != have {
+		t.Errorf("want %s, have %v", want, endpoints)
+	}
+	if want, have := 30*time.Second, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+	for _, q := range s.Received() {
+		if !q.DO || !q.CD {
+			t.Errorf("%s: want DO and CD bits set, have %v and %v", q.Name, q.DO, q.CD)
+		}
+	}
+}
+
+func TestDNSSECBogus(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		tamper func(*signedZones)
+	}{
+		{"spoofed", func(z *signedZones) {
+			z.rrs["_http._tcp.users.prod.internal./33"][0].Data.(*dnswire.SRV).Port = 6666
+		}},
+		{"unsigned", func(z *signedZones) {
+			delete(z.sigs, "_http._tcp.users.prod.internal./33")
+		}},
+		{"expired", func(z *signedZones) {
+			z.sigs["_http._tcp.users.prod.internal./33"] = z.prod.sign(t, z.rrs["_http._tcp.users.prod.internal./33"], -2*time.Hour, -time.Hour)
+		}},
+		{"broken delegation", func(z *signedZones) {
+			z.rrs["prod.internal./43"][0].Data.(*dnswire.DS).Digest[0] ^= 0xFF
+			z.sigs["prod.internal./43"] = z.root.sign(t, z.rrs["prod.internal./43"], -time.Hour, time.Hour)
+		}},
+		{"wrong anchor", func(z *signedZones) {
+			z.anchor.Digest = append([]byte{}, z.anchor.Digest...)
+			z.anchor.Digest[0] ^= 0xFF
+		}},
+	} {
+		z := newSignedZones(t)
+		tc.tamper(z)
+		s := z.serve(t)
+
+		r := resolve.DNS(resolve.Nameservers(s.Addr()), resolve.DNSSEC(z.anchor))
+		_, _, err := r.Resolve("_http._tcp.users.prod.internal")
+		var bogus *resolve.BogusError
+		if !errors.As(err, &bogus) {
+			t.Errorf("%s: want *resolve.BogusError, have %v", tc.name, err)
+		}
+		s.Close()
+	}
+}
+
+func TestDNSSECWildcard(t *testing.T) {
+	// _http._tcp.orders.prod.internal. doesn't exist, so it's answered from
+	// *.prod.internal., which is only to be trusted with proof that it
+	// doesn't exist, and neither does orders.prod.internal.
+	const name = "_http._tcp.orders.prod.internal"
+	nsec := func(owner, next string) func(*testing.T, *signedZones) {
+		return func(t *testing.T, z *signedZones) {
+			z.add(t, z.prod, dnswire.RR{Name: owner, Type: dnswire.TypeNSEC, TTL: 60, Data: &dnswire.NSEC{NextName: next}})
+		}
+	}
+	nsec3 := func(t *testing.T, z *signedZones) {
+		h := sha1.Sum([]byte("\x06orders\x04prod\x08internal\x00"))
+		from, to := h, h
+		from[len(from)-1]--
+		to[len(to)-1]++
+		owner := base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(from[:]) + ".prod.internal."
+		z.add(t, z.prod, dnswire.RR{Name: owner, Type: dnswire.TypeNSEC3, TTL: 60, Data: &dnswire.NSEC3{HashAlgorithm: 1, NextHashed: to[:]}})
+	}
+	for _, tc := range []struct {
+		name  string
+		proof func(*testing.T, *signedZones)
+		valid bool
+	}{
+		{"NSEC", nsec("a.prod.internal.", "_http._tcp.users.prod.internal."), true},
+		{"NSEC of the last name", nsec("_http._tcp.users.prod.internal.", "prod.internal."), false},
+		{"NSEC3", nsec3, true},
+		{"no proof", func(*testing.T, *signedZones) {}, false},
+		{"NSEC not covering", nsec("*.prod.internal.", "a.prod.internal."), false},
+		{"NSEC below the next closer name", nsec("_a.orders.prod.internal.", "_http._tcp.users.prod.internal."), false},
+	} {
+		z := newSignedZones(t)
+		z.add(t, z.prod, dnswire.RR{Name: "*.prod.internal.", Type: dnswire.TypeSRV, TTL: 60, Data: &dnswire.SRV{Port: 9090, Target: "a.prod.internal."}})
+		tc.proof(t, z)
+		s := z.serve(t)
+
+		r := resolve.DNS(resolve.Nameservers(s.Addr()), resolve.DNSSEC(z.anchor))
+		endpoints, _, err := r.Resolve(name)
+		var bogus *resolve.BogusError
+		switch {
+		case tc.valid && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case tc.valid && fmt.Sprint(endpoints) != "[a.prod.internal:9090]":
+			t.Errorf("%s: want a.prod.internal:9090, have %v", tc.name, endpoints)
+		case !tc.valid && !errors.As(err, &bogus):
+			t.Errorf("%s: want *resolve.BogusError, have %v", tc.name, err)
+		}
+		s.Close()
+	}
+}
+
+func TestDNSSECLabels(t *testing.T) {
+	// An RRSIG can't claim more labels than its owner has.
+	z := newSignedZones(t)
+	k := "_http._tcp.users.prod.internal./33"
+	z.sigs[k] = z.prod.signLabels(t, z.rrs[k], 6, -time.Hour, time.Hour)
+	s := z.serve(t)
+	defer s.Close()
+
+	r := resolve.DNS(resolve.Nameservers(s.Addr()), resolve.DNSSEC(z.anchor))
+	_, _, err := r.Resolve("_http._tcp.users.prod.internal")
+	var bogus *resolve.BogusError
+	if !errors.As(err, &bogus) {
+		t.Errorf("want *resolve.BogusError, have %v", err)
+	}
+}
+
+func TestParseTrustAnchor(t *testing.T) {
+	anchor, err := resolve.ParseTrustAnchor("internal. 3600 IN DS 12345 13 2 0A0B 0C0D")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := resolve.TrustAnchor{Zone: "internal.", KeyTag: 12345, Algorithm: 13, DigestType: 2, Digest: []byte{10, 11, 12, 13}}
+	if fmt.Sprint(want) != fmt.Sprint(anchor) {
+		t.Errorf("want %+v, have %+v", want, anchor)
+	}
+	if _, err := resolve.ParseTrustAnchor("internal. DS 12345 13"); err == nil {
+		t.Errorf("want error for short anchor, have none")
+	}
+}
+
+// signedZones serves internal., which is signed with ECDSA and the trust
+// anchor, and prod.internal., which is signed with Ed25519 and delegated
+// from it.
+type signedZones struct {
+	root, prod *zoneSigner
+	anchor     resolve.TrustAnchor
+	rrs        map[string][]dnswire.RR // by name/type
+	sigs       map[string][]dnswire.RR
+}
+
+func newSignedZones(t *testing.T) *signedZones {
+	z := &signedZones{
+		root: newZoneSigner(t, "internal.", 13),
+		prod: newZoneSigner(t, "prod.internal.", 15),
+		rrs:  map[string][]dnswire.RR{},
+		sigs: map[string][]dnswire.RR{},
+	}
+	anchor := ds("internal.", z.root.key)
+	z.anchor = resolve.TrustAnchor{Zone: "internal.", KeyTag: anchor.KeyTag, Algorithm: anchor.Algorithm, DigestType: anchor.DigestType, Digest: anchor.Digest}
+
+	z.add(t, z.root, dnswire.RR{Name: "internal.", Type: dnswire.TypeDNSKEY, TTL: 3600, Data: z.root.key})
+	z.add(t, z.root, dnswire.RR{Name: "prod.internal.", Type: dnswire.TypeDS, TTL: 3600, Data: ds("prod.internal.", z.prod.key)})
+	z.add(t, z.prod, dnswire.RR{Name: "prod.internal.", Type: dnswire.TypeDNSKEY, TTL: 3600, Data: z.prod.key})
+	z.add(t, z.prod, dnswire.RR{Name: "_http._tcp.users.prod.internal.", Type: dnswire.TypeSRV, TTL: 60, Data: &dnswire.SRV{Port: 8080, Target: "a.prod.internal."}})
+	z.add(t, z.prod, dnswire.RR{Name: "a.prod.internal.", Type: dnswire.TypeA, TTL: 30, Data: &dnswire.A{IP: []byte{10, 0, 0, 1}}})
+	return z
+}
+
+func (z *signedZones) add(t *testing.T, s *zoneSigner, rr dnswire.RR) {
+	rr.Class = dnswire.ClassINET
+	k := fmt.Sprintf("%s/%d", rr.Name, rr.Type)
+	z.rrs[k] = append(z.rrs[k], rr)
+	z.sigs[k] = s.sign(t, z.rrs[k], -time.Hour, time.Hour)
+}
+
+// serve starts a server for the zones, as they are now.
+func (z *signedZones) serve(t *testing.T) *dnstest.Server {
+	s := dnstest.NewServer()
+	for k, rrs := range z.rrs {
+		var records []dnstest.Raw
+		for _, rr := range append(append([]dnswire.RR{}, rrs...), z.sigs[k]...) {
+			data, err := dnswire.CanonicalRData(rr.Data)
+			if err != nil {
+				s.Close()
+				t.Fatal(err)
+			}
+			records = append(records, dnstest.Raw{Type: rr.Type, Data: data, TTL: time.Duration(rr.TTL) * time.Second})
+		}
+		s.SetRaw(rrs[0].Name, records...)
+	}
+	return s
+}
+
+// zoneSigner signs the records of a zone with a single key.
+type zoneSigner struct {
+	zone string
+	key  *dnswire.DNSKEY
+	sig  func([]byte) []byte
+}
+
+func newZoneSigner(t *testing.T, zone string, algorithm uint8) *zoneSigner {
+	s := &zoneSigner{zone: zone, key: &dnswire.DNSKEY{
+		Flags:     dnswire.DNSKEYFlagZone | dnswire.DNSKEYFlagSEP,
+		Protocol:  3,
+		Algorithm: algorithm,
+	}}
+	switch algorithm {
+	case 13:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.key.PublicKey = append(priv.PublicKey.X.FillBytes(make([]byte, 32)), priv.PublicKey.Y.FillBytes(make([]byte, 32))...)
+		s.sig = func(data []byte) []byte {
+			h := sha256.Sum256(data)
+			r, ss, err := ecdsa.Sign(rand.Reader, priv, h[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+		}
+	case 15:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.key.PublicKey = pub
+		s.sig = func(data []byte) []byte { return ed25519.Sign(priv, data) }
+	default:
+		t.Fatalf("unsupported algorithm %d", algorithm)
+	}
+	return s
+}
+
+// sign returns the RRSIG of rrs, valid from now+from to now+to.
+func (s *zoneSigner) sign(t *testing.T, rrs []dnswire.RR, from, to time.Duration) []dnswire.RR {
+	return s.signLabels(t, rrs, dnswire.SignatureLabels(rrs[0].Name), from, to)
+}
+
+// signLabels is like sign, but the RRSIG claims the given number of labels.
+func (s *zoneSigner) signLabels(t *testing.T, rrs []dnswire.RR, labels int, from, to time.Duration) []dnswire.RR {
+	now := time.Now()
+	sig := &dnswire.RRSIG{
+		TypeCovered: rrs[0].Type,
+		Algorithm:   s.key.Algorithm,
+		Labels:      uint8(labels),
+		OriginalTTL: rrs[0].TTL,
+		Expiration:  uint32(now.Add(to).Unix()),
+		Inception:   uint32(now.Add(from).Unix()),
+		KeyTag:      s.key.KeyTag(),
+		SignerName:  s.zone,
+	}
+	data, err := dnswire.SignedData(sig, rrs)
+	if err != nil {
+		// Sign what the owner would be signed with, so only Labels is off.
+		c := *sig
+		c.Labels = uint8(dnswire.SignatureLabels(rrs[0].Name))
+		if data, err = dnswire.SignedData(&c, rrs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sig.Signature = s.sig(data)
+	return []dnswire.RR{{Name: rrs[0].Name, Type: dnswire.TypeRRSIG, Class: dnswire.ClassINET, TTL: rrs[0].TTL, Data: sig}}
+}
+
+// ds returns the SHA-256 DS record of key, a key of owner.
+func ds(owner string, key *dnswire.DNSKEY) *dnswire.DS {
+	name, _ := dnswire.CanonicalName(owner)
+	rdata, _ := dnswire.CanonicalRData(key)
+	digest := sha256.Sum256(append(name, rdata...))
+	return &dnswire.DS{KeyTag: key.KeyTag(), Algorithm: key.Algorithm, DigestType: 2, Digest: digest[:]}
+}
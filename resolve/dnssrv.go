@@ -1,28 +1,48 @@
 package resolve
 
 import (
+	"context"
 	"net"
-	"sort"
-	"strconv"
 	"strings"
 	"time"
 )
 
 // DNSSRV resolves the name via a DNS SRV lookup.
-func DNSSRV(name string) ([]string, time.Duration, error) {
-	_, addrs, err := net.LookupSRV("", "", name)
+func DNSSRV(name string) ([]Endpoint, time.Duration, error) {
+	return DNSSRVContext(context.Background(), name)
+}
+
+// DNSSRVContext resolves the name via a DNS SRV lookup, which is abandoned if
+// ctx is done first.
+func DNSSRVContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	return lookupSRV(ctx, net.DefaultResolver, name)
+}
+
+// NetSRV returns a Resolver that does what DNSSRV does, but with r rather
+// than net.DefaultResolver, e.g. one that talks to a dnstest.Server.
+func NetSRV(r *net.Resolver) ContextResolver {
+	return ContextResolverFunc(func(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+		return lookupSRV(ctx, r, name)
+	})
+}
+
+func lookupSRV(ctx context.Context, r *net.Resolver, name string) ([]Endpoint, time.Duration, error) {
+	_, addrs, err := r.LookupSRV(ctx, "", "", name)
 	if err != nil {
-		return []string{}, 0, err
+		return []Endpoint{}, 0, err
 	}
 
-	hosts := make([]string, len(addrs))
+	endpoints := make([]Endpoint, len(addrs))
 	for i := 0; i < len(addrs); i++ {
-		host := strings.TrimRight(addrs[i].Target, ".")
-		port := strconv.FormatUint(uint64(addrs[i].Port), 10)
-		hosts[i] = host + ":" + port
+		endpoints[i] = Endpoint{
+			Address:  strings.TrimRight(addrs[i].Target, "."),
+			Port:     addrs[i].Port,
+			Priority: addrs[i].Priority,
+			Weight:   addrs[i].Weight,
+		}
 	}
 
-	sort.Strings(hosts)
-	ttl := 5 * time.Second // TODO: get DNS TTL, probably via github.com/miekg/dns
-	return hosts, ttl, nil
+	sortEndpoints(endpoints)
+	ttl := 5 * time.Second // net.LookupSRV doesn't expose TTLs; see DNS
+	return endpoints, ttl, nil
 }
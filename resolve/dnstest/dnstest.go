@@ -0,0 +1,665 @@
+// Package dnstest provides an authoritative DNS server for tests, which
+// serves records that can be changed while it runs, and can be told to
+// misbehave.
+package dnstest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+	"github.com/peterbourgon/srvproxy/resolve/internal/dnswire"
+)
+
+// SRV is an SRV record. The target is taken to be fully qualified, whether
+// or not it ends in a dot.
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+	TTL      time.Duration
+}
+
+// A is an address record: an A record for IPv4 addresses, and an AAAA record
+// for IPv6 addresses.
+type A struct {
+	IP  string
+	TTL time.Duration
+}
+
+// TXT is a TXT record, made of one or more strings.
+type TXT struct {
+	Strings []string
+	TTL     time.Duration
+}
+
+// PTR is a PTR record, as used by DNS-SD to list service instances. The
+// target is taken to be fully qualified, whether or not it ends in a dot.
+type PTR struct {
+	Target string
+	TTL    time.Duration
+}
+
+// SVCB is an SVCB or HTTPS record, as specified by RFC 9460. A Priority of 0
+// makes it an AliasMode record. The target is taken to be fully qualified,
+// except for ".", which stands for the owner name. Params with a zero value
+// aren't set; Mandatory lists the keys of the params that must be
+// understood, which needn't be among the others.
+type SVCB struct {
+	Priority      uint16
+	Target        string
+	Mandatory     []uint16
+	ALPN          []string
+	NoDefaultALPN bool
+	Port          uint16
+	IPv4Hint      []string
+	ECH           []byte
+	IPv6Hint      []string
+	TTL           time.Duration
+}
+
+// Raw is a record of any type, with its RDATA in wire form, for records the
+// other types don't cover, like those of DNSSEC. Names in the RDATA mustn't
+// be compressed.
+type Raw struct {
+	Type uint16 // e.g. 46 for RRSIG
+	Data []byte
+	TTL  time.Duration
+}
+
+// Query is a query received by the server.
+type Query struct {
+	Name string // as asked, fully qualified
+	Type uint16 // e.g. 33 for SRV
+	TCP  bool   // received over TCP or DoH, rather than UDP
+	DO   bool   // the DNSSEC OK bit was set
+	CD   bool   // the Checking Disabled bit was set
+}
+
+// Fault is a way for the server to misbehave when asked about a name.
+type Fault int
+
+// Faults that can be injected with SetFault.
+const (
+	NoFault  Fault = iota // answer normally
+	ServFail              // answer with SERVFAIL
+	NXDomain              // answer with NXDOMAIN, whether the name exists or not
+	Timeout               // don't answer at all
+	Truncate              // answer over UDP with the TC bit set and no records
+)
+
+// Server is an authoritative DNS server listening on loopback, over both UDP
+// and TCP, on the same port. Names are case-insensitive, and fully qualified
+// whether or not they end in a dot. The server knows every name it has
+// records for; it answers NXDOMAIN for other names, and an empty answer for
+// types a known name has no records of. CNAMEs are followed to the records
+// of their targets, and RRSIGs are returned along with the records they
+// cover, if the query has the DNSSEC OK bit set.
+//
+// Names under a wildcard, like *.internal, that the server doesn't know are
+// answered with the records of the wildcard, unless a name between them and
+// the wildcard is known. Along with such answers, the server returns every
+// NSEC and NSEC3 record it has, and their RRSIGs, in the authority section,
+// as the proof that the name doesn't exist; it's up to the caller to set the
+// records that make a good, or a bad, one.
+type Server struct {
+	udp  net.PacketConn
+	tcp  net.Listener
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	mtx      sync.Mutex
+	records  map[string][]dnswire.RR // by lowercased, fully qualified name
+	faults   map[string]Fault
+	queries  map[string]int
+	received []Query
+}
+
+// NewServer starts and returns a new Server. The caller should call Close
+// when finished, to shut it down. Like httptest.NewServer, it panics if it
+// can't listen.
+func NewServer() *Server {
+	for i := 0; i < 10; i++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			panic(fmt.Sprintf("dnstest: failed to listen: %v", err))
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close() // the port is taken for TCP; try another
+			continue
+		}
+		s := &Server{
+			udp:     udp,
+			tcp:     tcp,
+			done:    make(chan struct{}),
+			records: map[string][]dnswire.RR{},
+			faults:  map[string]Fault{},
+			queries: map[string]int{},
+		}
+		s.wg.Add(2)
+		go s.serveUDP()
+		go s.serveTCP()
+		return s
+	}
+	panic("dnstest: failed to listen on a shared UDP and TCP port")
+}
+
+// Addr returns the address of the server, as host:port.
+func (s *Server) Addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+// Close shuts down the server, and waits for it to stop.
+func (s *Server) Close() {
+	close(s.done)
+	s.udp.Close()
+	s.tcp.Close()
+	s.wg.Wait()
+}
+
+// Resolver returns a resolve.DNS resolver that asks the server, with the
+// given options, which may override the nameservers.
+func (s *Server) Resolver(options ...resolve.DNSOption) resolve.Resolver {
+	return resolve.DNS(append([]resolve.DNSOption{resolve.Nameservers(s.Addr())}, options...)...)
+}
+
+// NetResolver returns a net.Resolver that asks the server, for use with
+// resolve.NetSRV, or anything else that takes one.
+func (s *Server) NetResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, s.Addr())
+		},
+	}
+}
+
+// SetSRV replaces the SRV records of name. With no records, name has no SRV
+// records.
+func (s *Server) SetSRV(name string, records ...SRV) {
+	rrs := make([]dnswire.RR, len(records))
+	for i, r := range records {
+		rrs[i] = rr(name, dnswire.TypeSRV, r.TTL, &dnswire.SRV{
+			Priority: r.Priority,
+			Weight:   r.Weight,
+			Port:     r.Port,
+			Target:   dnswire.Fqdn(r.Target),
+		})
+	}
+	s.set(name, []uint16{dnswire.TypeSRV}, rrs)
+}
+
+// SetA replaces the A and AAAA records of name. With no records, name has no
+// address records. It panics if an address can't be parsed.
+func (s *Server) SetA(name string, records ...A) {
+	rrs := make([]dnswire.RR, len(records))
+	for i, r := range records {
+		ip := net.ParseIP(r.IP)
+		switch {
+		case ip == nil:
+			panic(fmt.Sprintf("dnstest: bad address %q", r.IP))
+		case ip.To4() != nil:
+			rrs[i] = rr(name, dnswire.TypeA, r.TTL, &dnswire.A{IP: ip.To4()})
+		default:
+			rrs[i] = rr(name, dnswire.TypeAAAA, r.TTL, &dnswire.AAAA{IP: ip})
+		}
+	}
+	s.set(name, []uint16{dnswire.TypeA, dnswire.TypeAAAA}, rrs)
+}
+
+// SetTXT replaces the TXT records of name. With no records, name has no TXT
+// records.
+func (s *Server) SetTXT(name string, records ...TXT) {
+	rrs := make([]dnswire.RR, len(records))
+	for i, r := range records {
+		rrs[i] = rr(name, dnswire.TypeTXT, r.TTL, &dnswire.TXT{Strings: r.Strings})
+	}
+	s.set(name, []uint16{dnswire.TypeTXT}, rrs)
+}
+
+// SetCNAME makes name an alias of target, which is taken to be fully
+// qualified, replacing its CNAME record, if any. It doesn't remove records
+// of other types, which a real zone wouldn't have.
+func (s *Server) SetCNAME(name, target string, ttl time.Duration) {
+	s.set(name, []uint16{dnswire.TypeCNAME}, []dnswire.RR{
+		rr(name, dnswire.TypeCNAME, ttl, &dnswire.CNAME{Target: dnswire.Fqdn(target)}),
+	})
+}
+
+// SetPTR replaces the PTR records of name. With no records, name has no PTR
+// records.
+func (s *Server) SetPTR(name string, records ...PTR) {
+	rrs := make([]dnswire.RR, len(records))
+	for i, r := range records {
+		rrs[i] = rr(name, dnswire.TypePTR, r.TTL, &dnswire.PTR{Target: dnswire.Fqdn(r.Target)})
+	}
+	s.set(name, []uint16{dnswire.TypePTR}, rrs)
+}
+
+// SetSVCB replaces the SVCB records of name. With no records, name has no
+// SVCB records. It panics if an address hint can't be parsed.
+func (s *Server) SetSVCB(name string, records ...SVCB) {
+	s.set(name, []uint16{dnswire.TypeSVCB}, svcbRRs(name, dnswire.TypeSVCB, records))
+}
+
+// SetHTTPS replaces the HTTPS records of name, which are SVCB records for
+// HTTPS. With no records, name has no HTTPS records. It panics if an
+// address hint can't be parsed.
+func (s *Server) SetHTTPS(name string, records ...SVCB) {
+	s.set(name, []uint16{dnswire.TypeHTTPS}, svcbRRs(name, dnswire.TypeHTTPS, records))
+}
+
+// SetRaw replaces the records of name that are of the types of records,
+// along with the RRSIGs covering them, with records. An RRSIG record counts
+// as one of the type it covers, so that it's served along with them.
+func (s *Server) SetRaw(name string, records ...Raw) {
+	var (
+		types []uint16
+		rrs   = make([]dnswire.RR, len(records))
+	)
+	for i, r := range records {
+		rrs[i] = rr(name, r.Type, r.TTL, &dnswire.Raw{Data: r.Data})
+		if t := coveredType(rrs[i]); !hasType(types, t) {
+			types = append(types, t)
+		}
+	}
+	s.set(name, types, rrs)
+}
+
+// Remove removes every record of name, so that the server no longer knows it.
+func (s *Server) Remove(name string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.records, key(name))
+}
+
+// SetFault makes the server misbehave when asked about name, in any way
+// other than NoFault, until it's set back to NoFault. The name "*" stands
+// for every name without a fault of its own.
+func (s *Server) SetFault(name string, f Fault) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if name != "*" {
+		name = key(name)
+	}
+	if f == NoFault {
+		delete(s.faults, name)
+		return
+	}
+	s.faults[name] = f
+}
+
+// Queries returns how many queries the server has received for name, of any
+// type, over either transport.
+func (s *Server) Queries(name string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.queries[key(name)]
+}
+
+// Received returns every query the server has received, in order.
+func (s *Server) Received() []Query {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]Query{}, s.received...)
+}
+
+// ServeHTTP answers DNS-over-HTTPS queries, as specified by RFC 8484, in
+// both GET and POST form, so that the server can be mounted on an
+// httptest.Server to test resolve.DoH. Faults apply as they do over TCP;
+// with Timeout, the request is held until it's cancelled, or the server is
+// closed.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		b   []byte
+		err error
+	)
+	switch r.Method {
+	case "GET":
+		b, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case "POST":
+		b, err = io.ReadAll(r.Body)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := s.handle(b, true)
+	if resp == nil {
+		select {
+		case <-r.Context().Done():
+		case <-s.done:
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(resp)
+}
+
+func (s *Server) set(name string, types []uint16, rrs []dnswire.RR) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	k := key(name)
+	kept := rrs
+	for _, old := range s.records[k] {
+		if !hasType(types, coveredType(old)) {
+			kept = append(kept, old)
+		}
+	}
+	if len(kept) <= 0 {
+		delete(s.records, k)
+		return
+	}
+	s.records[k] = kept
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if b := s.handle(buf[:n], false); b != nil {
+			s.udp.WriteTo(b, addr)
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConn answers queries on conn, framed as they are over TCP, until conn
+// is closed, or the server is, so that the server can be put behind a TLS
+// listener to test resolve.DoT. Faults apply as they do over TCP.
+func (s *Server) ServeConn(conn net.Conn) {
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-s.done:
+		case <-finished:
+		}
+		conn.Close()
+	}()
+
+	// RFC 7766 allows several queries per connection.
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		if b := s.handle(buf, true); b != nil {
+			binary.BigEndian.PutUint16(length[:], uint16(len(b)))
+			if _, err := conn.Write(append(length[:], b...)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle returns the packed response to the packed query b, or nil if
+// there's to be no response.
+func (s *Server) handle(b []byte, overTCP bool) []byte {
+	var req dnswire.Message
+	if err := req.Unpack(b); err != nil || req.Response {
+		return nil
+	}
+	resp := &dnswire.Message{
+		Header: dnswire.Header{
+			ID:               req.ID,
+			Response:         true,
+			Opcode:           req.Opcode,
+			Authoritative:    true,
+			RecursionDesired: req.RecursionDesired,
+		},
+		Questions: req.Questions,
+	}
+	if len(req.Questions) != 1 {
+		resp.Rcode = dnswire.RcodeFormatError
+		return pack(resp)
+	}
+
+	q := req.Questions[0]
+	k := key(q.Name)
+	do := false
+	for _, rr := range req.Additionals {
+		if rr.Type == dnswire.TypeOPT {
+			do = rr.TTL&dnswire.EDNS0FlagDO != 0
+		}
+	}
+	s.mtx.Lock()
+	s.queries[k]++
+	s.received = append(s.received, Query{Name: q.Name, Type: q.Type, TCP: overTCP, DO: do, CD: req.CheckingDisabled})
+	fault, ok := s.faults[k]
+	if !ok {
+		fault = s.faults["*"]
+	}
+	rrs, _ := s.lookup(q.Name)
+	known := rrs != nil
+	for name, i := q.Name, 0; i <= maxCNAMEs; i++ {
+		answers, cname, wildcard := s.answers(name, q.Type, do)
+		resp.Answers = append(resp.Answers, answers...)
+		if wildcard && do {
+			resp.Authorities = s.denials()
+		}
+		if cname == "" {
+			break
+		}
+		name = cname
+	}
+	s.mtx.Unlock()
+
+	switch {
+	case fault == Timeout:
+		return nil
+	case fault == ServFail:
+		resp.Rcode, resp.Answers, resp.Authorities = dnswire.RcodeServerFailure, nil, nil
+	case fault == NXDomain, !known:
+		resp.Rcode, resp.Answers, resp.Authorities = dnswire.RcodeNameError, nil, nil
+	case fault == Truncate && !overTCP:
+		resp.Truncated, resp.Answers, resp.Authorities = true, nil, nil
+	}
+	return pack(resp)
+}
+
+// maxCNAMEs bounds how many CNAMEs are followed, so that loops end.
+const maxCNAMEs = 8
+
+// answers returns the records of name that answer a query for typ, with the
+// RRSIGs covering them if do is set, in the asker's case. If name is an alias
+// instead, the CNAME is returned, along with its target. The records may be
+// those of a wildcard, as reported.
+func (s *Server) answers(name string, typ uint16, do bool) (answers []dnswire.RR, cname string, wildcard bool) {
+	rrs, wildcard := s.lookup(name)
+	for _, want := range []uint16{typ, dnswire.TypeCNAME} {
+		for _, rr := range rrs {
+			if coveredType(rr) != want || (rr.Type == dnswire.TypeRRSIG && !do) {
+				continue
+			}
+			rr.Name = name
+			answers = append(answers, rr)
+			if c, ok := rr.Data.(*dnswire.CNAME); ok && want != typ {
+				cname = c.Target
+			}
+		}
+		if len(answers) > 0 {
+			return answers, cname, wildcard
+		}
+	}
+	return nil, "", false
+}
+
+// lookup returns the records of name, or else those of the wildcard that
+// covers it, if no name between them is known, with wildcard set.
+func (s *Server) lookup(name string) (rrs []dnswire.RR, wildcard bool) {
+	k := key(name)
+	if rrs, ok := s.records[k]; ok {
+		return rrs, false
+	}
+	for i := strings.Index(k, "."); i >= 0 && i < len(k)-1; i = strings.Index(k, ".") {
+		k = k[i+1:]
+		if rrs, ok := s.records["*."+k]; ok {
+			return rrs, true
+		}
+		if _, ok := s.records[k]; ok {
+			break
+		}
+	}
+	return nil, false
+}
+
+// denials returns every NSEC and NSEC3 record, with their RRSIGs.
+func (s *Server) denials() []dnswire.RR {
+	var rrs []dnswire.RR
+	for _, records := range s.records {
+		for _, rr := range records {
+			if t := coveredType(rr); t == dnswire.TypeNSEC || t == dnswire.TypeNSEC3 {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	return rrs
+}
+
+func pack(m *dnswire.Message) []byte {
+	b, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func rr(name string, typ uint16, ttl time.Duration, data dnswire.RData) dnswire.RR {
+	return dnswire.RR{
+		Name:  dnswire.Fqdn(name),
+		Type:  typ,
+		Class: dnswire.ClassINET,
+		TTL:   uint32(ttl / time.Second),
+		Data:  data,
+	}
+}
+
+func key(name string) string {
+	return strings.ToLower(dnswire.Fqdn(name))
+}
+
+// coveredType returns the type of rr, or the type it covers if it's an RRSIG,
+// as RRSIGs belong with the records they cover.
+func coveredType(rr dnswire.RR) uint16 {
+	switch d := rr.Data.(type) {
+	case *dnswire.RRSIG:
+		return d.TypeCovered
+	case *dnswire.Raw:
+		if rr.Type == dnswire.TypeRRSIG && len(d.Data) >= 2 {
+			return uint16(d.Data[0])<<8 | uint16(d.Data[1])
+		}
+	}
+	return rr.Type
+}
+
+func svcbRRs(name string, typ uint16, records []SVCB) []dnswire.RR {
+	rrs := make([]dnswire.RR, len(records))
+	for i, r := range records {
+		target := r.Target
+		if target != "." {
+			target = dnswire.Fqdn(target)
+		}
+		rrs[i] = rr(name, typ, r.TTL, &dnswire.SVCB{Priority: r.Priority, Target: target, Params: r.params()})
+	}
+	return rrs
+}
+
+// params returns the SvcParams of the record, in ascending order of key.
+func (r SVCB) params() []dnswire.SVCParam {
+	var params []dnswire.SVCParam
+	if len(r.Mandatory) > 0 {
+		keys := append([]uint16{}, r.Mandatory...)
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		var v []byte
+		for _, k := range keys {
+			v = binary.BigEndian.AppendUint16(v, k)
+		}
+		params = append(params, dnswire.SVCParam{Key: dnswire.SVCKeyMandatory, Value: v})
+	}
+	if len(r.ALPN) > 0 {
+		var v []byte
+		for _, id := range r.ALPN {
+			v = append(append(v, byte(len(id))), id...)
+		}
+		params = append(params, dnswire.SVCParam{Key: dnswire.SVCKeyALPN, Value: v})
+	}
+	if r.NoDefaultALPN {
+		params = append(params, dnswire.SVCParam{Key: dnswire.SVCKeyNoDefaultALPN})
+	}
+	if r.Port != 0 {
+		params = append(params, dnswire.SVCParam{Key: dnswire.SVCKeyPort, Value: binary.BigEndian.AppendUint16(nil, r.Port)})
+	}
+	if len(r.IPv4Hint) > 0 {
+		params = append(params, dnswire.SVCParam{Key: dnswire.SVCKeyIPv4Hint, Value: hints(r.IPv4Hint, net.IPv4len)})
+	}
+	if len(r.ECH) > 0 {
+		params = append(params, dnswire.SVCParam{Key: dnswire.SVCKeyECH, Value: r.ECH})
+	}
+	if len(r.IPv6Hint) > 0 {
+		params = append(params, dnswire.SVCParam{Key: dnswire.SVCKeyIPv6Hint, Value: hints(r.IPv6Hint, net.IPv6len)})
+	}
+	return params
+}
+
+// hints packs addresses of the given length, in bytes, for an address hint.
+func hints(addrs []string, size int) []byte {
+	var v []byte
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if size == net.IPv4len {
+			ip = ip.To4()
+		}
+		if ip == nil {
+			panic(fmt.Sprintf("dnstest: bad address hint %q", addr))
+		}
+		v = append(v, ip...)
+	}
+	return v
+}
+
+func hasType(types []uint16, typ uint16) bool {
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
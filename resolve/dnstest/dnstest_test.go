@@ -0,0 +1,176 @@
+package dnstest_test
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+	"github.com/peterbourgon/srvproxy/resolve/dnstest"
+)
+
+func TestServer(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+
+	const name = "_http._tcp.users.internal"
+	s.SetSRV(name,
+		dnstest.SRV{Port: 8080, Target: "a.internal", TTL: time.Minute},
+		dnstest.SRV{Port: 8080, Target: "b.internal", TTL: 30 * time.Second},
+	)
+	r := s.Resolver()
+	endpoints, ttl, err := r.Resolve(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resolve.Endpoint{{Address: "a.internal", Port: 8080}, {Address: "b.internal", Port: 8080}}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+	if want, have := 30*time.Second, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+
+	s.SetSRV(name, dnstest.SRV{Port: 9090, Target: "c.internal", TTL: time.Minute})
+	endpoints, _, err = r.Resolve(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []resolve.Endpoint{{Address: "c.internal", Port: 9090}}; !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+	if want, have := 2, s.Queries(name); want != have {
+		t.Errorf("want %d queries, have %d", want, have)
+	}
+
+	s.Remove(name)
+	if _, _, err := r.Resolve(name); !isDNSError(err, func(e *net.DNSError) bool { return e.IsNotFound }) {
+		t.Errorf("want not found, have %v", err)
+	}
+}
+
+func TestServerRecords(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+
+	s.SetSRV("_http._tcp.users.internal", dnstest.SRV{Port: 8080, Target: "a.internal", TTL: time.Minute})
+	s.SetA("a.internal", dnstest.A{IP: "10.0.0.1", TTL: 10 * time.Second}, dnstest.A{IP: "2001:db8::1", TTL: time.Minute})
+	s.SetTXT("a.internal", dnstest.TXT{Strings: []string{"zone=a"}, TTL: time.Minute})
+
+	endpoints, ttl, err := s.Resolver(resolve.ExpandTargets(true)).Resolve("_http._tcp.users.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, endpoint := range endpoints {
+		have = append(have, endpoint.String())
+	}
+	if want := []string{"10.0.0.1:8080", "[2001:db8::1]:8080"}; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want, have := 10*time.Second, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+
+	// Replacing the addresses leaves the TXT record alone.
+	s.SetA("a.internal")
+	txts, err := s.NetResolver().LookupTXT(context.Background(), "a.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"zone=a"}; !reflect.DeepEqual(want, txts) {
+		t.Errorf("want %v, have %v", want, txts)
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+
+	const name = "_http._tcp.users.internal"
+	s.SetSRV(name, dnstest.SRV{Port: 8080, Target: "a.internal", TTL: time.Minute})
+	r := s.Resolver(resolve.DNSTimeout(100 * time.Millisecond))
+
+	for _, tc := range []struct {
+		fault dnstest.Fault
+		check func(*net.DNSError) bool
+	}{
+		{dnstest.ServFail, func(e *net.DNSError) bool { return e.IsTemporary }},
+		{dnstest.NXDomain, func(e *net.DNSError) bool { return e.IsNotFound }},
+		{dnstest.Timeout, func(e *net.DNSError) bool { return e.IsTimeout }},
+	} {
+		s.SetFault(name, tc.fault)
+		if _, _, err := r.Resolve(name); !isDNSError(err, tc.check) {
+			t.Errorf("fault %d: have %v", tc.fault, err)
+		}
+	}
+
+	// Truncated answers are retried over TCP, which isn't truncated.
+	s.SetFault("*", dnstest.Truncate)
+	s.SetFault(name, dnstest.NoFault)
+	if _, _, err := r.Resolve(name); err != nil {
+		t.Errorf("truncate: %v", err)
+	}
+}
+
+func TestServerCNAME(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+
+	s.SetCNAME("users.internal", "_http._tcp.users.internal", time.Minute)
+	s.SetSRV("_http._tcp.users.internal", dnstest.SRV{Port: 8080, Target: "a.internal", TTL: time.Minute})
+	endpoints, _, err := s.Resolver().Resolve("USERS.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []resolve.Endpoint{{Address: "a.internal", Port: 8080}}; !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+
+	// Only the alias was asked about.
+	want := []dnstest.Query{{Name: "USERS.internal.", Type: 33}}
+	if have := s.Received(); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+}
+
+func TestServerRaw(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+
+	// An SRV record in wire form: priority 1, weight 2, port 8080, and the
+	// target a.internal.
+	data := []byte{0, 1, 0, 2, 0x1f, 0x90, 1, 'a', 8, 'i', 'n', 't', 'e', 'r', 'n', 'a', 'l', 0}
+	s.SetRaw("_http._tcp.users.internal", dnstest.Raw{Type: 33, Data: data, TTL: time.Minute})
+	endpoints, _, err := s.Resolver().Resolve("_http._tcp.users.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []resolve.Endpoint{{Address: "a.internal", Port: 8080, Priority: 1, Weight: 2}}; !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+}
+
+func TestNetSRV(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+
+	s.SetSRV("_http._tcp.users.internal",
+		dnstest.SRV{Priority: 10, Weight: 5, Port: 8080, Target: "a.internal", TTL: time.Minute},
+	)
+	endpoints, _, err := resolve.NetSRV(s.NetResolver()).Resolve("_http._tcp.users.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resolve.Endpoint{{Address: "a.internal", Port: 8080, Priority: 10, Weight: 5}}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+}
+
+func isDNSError(err error, check func(*net.DNSError) bool) bool {
+	e, ok := err.(*net.DNSError)
+	return ok && check(e)
+}
@@ -0,0 +1,120 @@
+package resolve
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve/internal/dnswire"
+)
+
+// dohMediaType is the media type of DNS messages in DoH; see RFC 8484.
+const dohMediaType = "application/dns-message"
+
+// DoH returns a Resolver that performs SRV lookups via DNS-over-HTTPS, as
+// specified by RFC 8484, against the server at url, e.g.
+// "https://dns.example.com/dns-query". Apart from the transport, it's the
+// same as DNS, and takes the same options; use Nameservers to give more than
+// one URL. The returned TTL accounts for the time the answer has spent in
+// HTTP caches.
+func DoH(url string, options ...DNSOption) Resolver {
+	r := &dnsResolver{
+		proto:       protoHTTPS,
+		nameservers: []string{url},
+		timeout:     5 * time.Second,
+		ndots:       1,
+		attempts:    1,
+		dohClient:   http.DefaultClient,
+		dohMethod:   "GET",
+	}
+	r.setOptions(options...)
+	r.complete()
+	return r
+}
+
+// DoHMethod sets the HTTP method used by DoH, either "GET" or "POST". GET
+// requests are friendlier to HTTP caches; POST requests are smaller. If
+// DoHMethod isn't provided, GET is used.
+func DoHMethod(method string) DNSOption {
+	return func(r *dnsResolver) { r.dohMethod = strings.ToUpper(method) }
+}
+
+// DoHClient sets the HTTP client used by DoH. If DoHClient isn't provided,
+// http.DefaultClient is used.
+func DoHClient(c *http.Client) DNSOption {
+	return func(r *dnsResolver) { r.dohClient = c }
+}
+
+func (r *dnsResolver) exchangeHTTPS(ctx context.Context, server string, req *dnswire.Message, b []byte) (*dnswire.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var (
+		httpReq *http.Request
+		err     error
+	)
+	switch r.dohMethod {
+	case "POST":
+		httpReq, err = http.NewRequest("POST", server, bytes.NewReader(b))
+		if err == nil {
+			httpReq.Header.Set("Content-Type", dohMediaType)
+		}
+	default:
+		sep := "?"
+		if strings.Contains(server, "?") {
+			sep = "&"
+		}
+		httpReq, err = http.NewRequest("GET", server+sep+"dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Accept", dohMediaType)
+
+	resp, err := r.dohClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != dohMediaType {
+		return nil, fmt.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	var m dnswire.Message
+	if err := m.Unpack(body); err != nil {
+		return nil, err
+	}
+	if !isResponseTo(&m, req) {
+		return nil, fmt.Errorf("response doesn't match query")
+	}
+
+	// The answer may have been cached along the way, in which case its TTLs
+	// have to be reduced by its age; see RFC 8484 section 5.1.
+	if age, err := strconv.ParseUint(resp.Header.Get("Age"), 10, 32); err == nil && age > 0 {
+		for _, rrs := range [][]dnswire.RR{m.Answers, m.Authorities, m.Additionals} {
+			for i := range rrs {
+				if rrs[i].TTL > uint32(age) {
+					rrs[i].TTL -= uint32(age)
+				} else {
+					rrs[i].TTL = 0
+				}
+			}
+		}
+	}
+	return &m, nil
+}
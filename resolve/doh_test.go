@@ -0,0 +1,43 @@
+package resolve_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+	"github.com/peterbourgon/srvproxy/resolve/dnstest"
+)
+
+func TestDoH(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetSRV("foo.internal", dnstest.SRV{Port: 80, Target: "a.internal", TTL: 300 * time.Second})
+
+	for _, method := range []string{"GET", "POST"} {
+		var methods []string
+		hs := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			methods = append(methods, r.Method)
+			w.Header().Set("Age", "60")
+			s.ServeHTTP(w, r)
+		}))
+		defer hs.Close()
+
+		r := resolve.DoH(hs.URL+"/dns-query", resolve.DoHMethod(method), resolve.DoHClient(hs.Client()))
+		endpoints, ttl, err := r.Resolve("foo.internal")
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if want, have := []string{"a.internal:80"}, resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+			t.Errorf("%s: want %v, have %v", method, want, have)
+		}
+		if want, have := 240*time.Second, ttl; want != have {
+			t.Errorf("%s: want TTL %s, have %s", method, want, have)
+		}
+		if want := []string{method}; !reflect.DeepEqual(want, methods) {
+			t.Errorf("want %v, have %v", want, methods)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package resolve
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve/internal/dnswire"
+)
+
+// maxIdleTLS is how many idle DoT connections are kept per server.
+const maxIdleTLS = 2
+
+// DoT returns a Resolver that performs SRV lookups via DNS-over-TLS, as
+// specified by RFC 7858, against the server at addr. Addresses without a port
+// use port 853. Apart from the transport, it's the same as DNS, and takes the
+// same options; use Nameservers to give more than one server. Connections are
+// kept open and reused for later lookups.
+func DoT(addr string, options ...DNSOption) Resolver {
+	r := &dnsResolver{
+		proto:       protoTLS,
+		nameservers: []string{addr},
+		timeout:     5 * time.Second,
+		ndots:       1,
+		attempts:    1,
+	}
+	r.setOptions(options...)
+	r.complete()
+	return r
+}
+
+// DoTConfig sets the TLS configuration used by DoT. If it has no ServerName,
+// the host of each nameserver is used. If DoTConfig isn't provided, the
+// default configuration is used, which verifies the server against the
+// system roots.
+func DoTConfig(c *tls.Config) DNSOption {
+	return func(r *dnsResolver) { r.tlsConfig = c }
+}
+
+func (r *dnsResolver) exchangeTLS(ctx context.Context, server string, req *dnswire.Message, b []byte) (*dnswire.Message, error) {
+	for {
+		conn, reused, err := r.tlsConn(ctx, server)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, reusable, err := r.exchangeConn(ctx, conn, req, b)
+		if err == nil {
+			if reusable {
+				r.putTLSConn(server, conn)
+			} else {
+				conn.Close()
+			}
+			return resp, nil
+		}
+		conn.Close()
+
+		// The server may have closed the connection while it was idle, which
+		// is allowed; see RFC 7766 section 6.2.3. Try again with a new one.
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// exchangeConn exchanges req over an open connection, bounded by the
+// nameserver timeout and ctx. It reports whether the connection may be
+// reused.
+func (r *dnsResolver) exchangeConn(ctx context.Context, conn net.Conn, req *dnswire.Message, b []byte) (*dnswire.Message, bool, error) {
+	deadline := time.Now().Add(r.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+
+	resp, err := exchangeStream(conn, req, b)
+	if !stop() {
+		return resp, false, err // the deadline was clobbered
+	}
+	conn.SetDeadline(time.Time{})
+	return resp, err == nil, err
+}
+
+// tlsConn returns an idle connection to server, or dials a new one. It
+// reports whether the connection was reused.
+func (r *dnsResolver) tlsConn(ctx context.Context, server string) (net.Conn, bool, error) {
+	r.mtx.Lock()
+	if conns := r.idle[server]; len(conns) > 0 {
+		conn := conns[len(conns)-1]
+		r.idle[server] = conns[:len(conns)-1]
+		r.mtx.Unlock()
+		return conn, true, nil
+	}
+	r.mtx.Unlock()
+
+	config := &tls.Config{}
+	if r.tlsConfig != nil {
+		config = r.tlsConfig.Clone()
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return nil, false, err
+		}
+		config.ServerName = host
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	conn, err := (&tls.Dialer{Config: config}).DialContext(ctx, "tcp", server)
+	return conn, false, err
+}
+
+func (r *dnsResolver) putTLSConn(server string, conn net.Conn) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if len(r.idle[server]) >= maxIdleTLS {
+		conn.Close()
+		return
+	}
+	if r.idle == nil {
+		r.idle = map[string][]net.Conn{}
+	}
+	r.idle[server] = append(r.idle[server], conn)
+}
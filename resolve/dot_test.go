@@ -0,0 +1,61 @@
+package resolve_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+	"github.com/peterbourgon/srvproxy/resolve/dnstest"
+)
+
+func TestDoT(t *testing.T) {
+	// Borrow the test certificate of an httptest server, and a client
+	// configuration that trusts it.
+	hs := httptest.NewTLSServer(http.NotFoundHandler())
+	defer hs.Close()
+	clientConfig := hs.Client().Transport.(*http.Transport).TLSClientConfig
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: hs.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetSRV("foo.internal", dnstest.SRV{Port: 80, Target: "a.internal", TTL: 30 * time.Second})
+
+	var conns int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go s.ServeConn(conn)
+		}
+	}()
+
+	r := resolve.DoT(ln.Addr().String(), resolve.DoTConfig(clientConfig))
+	for i := 0; i < 3; i++ {
+		endpoints, ttl, err := r.Resolve("foo.internal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := []string{"a.internal:80"}, resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+			t.Errorf("want %v, have %v", want, have)
+		}
+		if want, have := 30*time.Second, ttl; want != have {
+			t.Errorf("want TTL %s, have %s", want, have)
+		}
+	}
+	if want, have := int32(1), atomic.LoadInt32(&conns); want != have {
+		t.Errorf("want %d connection(s), have %d", want, have)
+	}
+}
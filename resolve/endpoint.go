@@ -0,0 +1,78 @@
+package resolve
+
+import (
+	"net"
+	"sort"
+	"strconv"
+)
+
+// Endpoint is a single resolved host, along with whatever additional
+// information the Resolver could provide about it.
+type Endpoint struct {
+	Address  string            // hostname or IP address, without brackets
+	Port     uint16            // zero if the host has no explicit port
+	Priority uint16            // lower values are preferred, per RFC 2782
+	Weight   uint16            // relative weight among equal priorities
+	Labels   map[string]string // free-form metadata, may be nil
+}
+
+// String returns the endpoint in host[:port] form, suitable for use as the
+// host of a URL.
+func (e Endpoint) String() string {
+	if e.Port == 0 {
+		return e.Address
+	}
+	return net.JoinHostPort(e.Address, strconv.FormatUint(uint64(e.Port), 10))
+}
+
+// ParseEndpoint converts a host[:port] string to an Endpoint. Hosts that
+// can't be split into a host and a numeric port are kept verbatim as the
+// Address, so that String always returns the original host.
+func ParseEndpoint(host string) Endpoint {
+	addr, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return Endpoint{Address: host}
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return Endpoint{Address: host}
+	}
+	return Endpoint{Address: addr, Port: uint16(n)}
+}
+
+// ParseEndpoints converts each host to an Endpoint via ParseEndpoint.
+func ParseEndpoints(hosts []string) []Endpoint {
+	endpoints := make([]Endpoint, len(hosts))
+	for i, host := range hosts {
+		endpoints[i] = ParseEndpoint(host)
+	}
+	return endpoints
+}
+
+// Hosts returns the String form of each endpoint.
+func Hosts(endpoints []Endpoint) []string {
+	hosts := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		hosts[i] = e.String()
+	}
+	return hosts
+}
+
+// sortEndpoints puts endpoints in a stable, canonical order: by priority,
+// then heaviest weight first, then by address and port. Resolvers use it so
+// that the same answer always compares equal.
+func sortEndpoints(endpoints []Endpoint) {
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		a, b := endpoints[i], endpoints[j]
+		switch {
+		case a.Priority != b.Priority:
+			return a.Priority < b.Priority
+		case a.Weight != b.Weight:
+			return a.Weight > b.Weight
+		case a.Address != b.Address:
+			return a.Address < b.Address
+		default:
+			return a.Port < b.Port
+		}
+	})
+}
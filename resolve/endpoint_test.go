@@ -0,0 +1,63 @@
+package resolve_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestEndpointString(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint resolve.Endpoint
+		want     string
+	}{
+		{resolve.Endpoint{Address: "foo.internal", Port: 8080}, "foo.internal:8080"},
+		{resolve.Endpoint{Address: "fd00::1", Port: 8080}, "[fd00::1]:8080"},
+		{resolve.Endpoint{Address: "foo.internal"}, "foo.internal"},
+	} {
+		if have := tc.endpoint.String(); tc.want != have {
+			t.Errorf("%+v: want %q, have %q", tc.endpoint, tc.want, have)
+		}
+	}
+}
+
+func TestParseEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		host string
+		want resolve.Endpoint
+	}{
+		{"foo.internal:8080", resolve.Endpoint{Address: "foo.internal", Port: 8080}},
+		{"[fd00::1]:8080", resolve.Endpoint{Address: "fd00::1", Port: 8080}},
+		{"foo.internal", resolve.Endpoint{Address: "foo.internal"}},
+		{"foo.internal:http", resolve.Endpoint{Address: "foo.internal:http"}},
+		{"≠", resolve.Endpoint{Address: "≠"}},
+	} {
+		have := resolve.ParseEndpoint(tc.host)
+		if !reflect.DeepEqual(tc.want, have) {
+			t.Errorf("%q: want %+v, have %+v", tc.host, tc.want, have)
+		}
+		if want, have := tc.host, have.String(); want != have {
+			t.Errorf("%q: round trip: have %q", want, have)
+		}
+	}
+}
+
+func TestHostsFunc(t *testing.T) {
+	r := resolve.HostsFunc(func(string) ([]string, time.Duration, error) {
+		return []string{"a:1", "b:2"}, time.Minute, nil
+	})
+
+	endpoints, ttl, err := r.Resolve("irrelevant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resolve.Endpoint{{Address: "a", Port: 1}, {Address: "b", Port: 2}}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+	if want, have := time.Minute, ttl; want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
@@ -0,0 +1,212 @@
+package resolve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	execTimeout = 10 * time.Second
+	execTTL     = 30 * time.Second
+)
+
+// Exec returns a resolver that runs the command cmd with args to resolve
+// names, for inventories that can only be reached with command-line tools.
+// The name is passed as the argument "{name}", wherever it appears in args,
+// or else as an extra, final argument. Names starting with '-' are rejected,
+// so that they can't pass as options to the command. The command is killed
+// if it runs for
+// more than 10 seconds; wrap the resolver with Timeout for a shorter limit.
+//
+// The command writes the endpoints to stdout, as either lines or JSON. Lines
+// have the form "host:port [weight]"; blank lines, and lines starting with
+// '#', are ignored, and a line of the form "$TTL ttl" sets the TTL. JSON is
+// either an array of entries, or an object with an "endpoints" array of them
+// and a "ttl". Entries are either "host:port" strings, or objects with an
+// "address", and optionally a "port", "priority", "weight", and "labels". In
+// either format, the TTL is a duration such as "1m30s", or a number of
+// seconds, and if it's not given, a default of 30 seconds is used. As with
+// DNS, TTLs under a second are raised to a second.
+//
+// If the command fails, including by exiting with a non-zero status, the
+// error includes the first line of its stderr, and pool.Stream keeps the
+// last good endpoints. So it does if the command writes nothing at all,
+// which is taken as a failure, rather than as an empty list of endpoints;
+// commands that mean to return none should say so, e.g. with "[]".
+func Exec(cmd string, args ...string) *ExecResolver {
+	return &ExecResolver{cmd: cmd, args: args}
+}
+
+// ExecResolver resolves names by running a command.
+type ExecResolver struct {
+	cmd  string
+	args []string
+}
+
+// Resolve implements Resolver by running the command.
+func (r *ExecResolver) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return r.ResolveContext(context.Background(), name)
+}
+
+// ResolveContext is Resolve, with the command killed when ctx is done.
+func (r *ExecResolver) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	if strings.HasPrefix(name, "-") {
+		return []Endpoint{}, 0, fmt.Errorf("exec: %s: %s: names can't start with '-'", name, r.cmd)
+	}
+	ctx, cancel := context.WithTimeout(ctx, execTimeout)
+	defer cancel()
+
+	var (
+		args     = make([]string, len(r.args))
+		replaced bool
+	)
+	for i, arg := range r.args {
+		args[i] = strings.Replace(arg, "{name}", name, -1)
+		replaced = replaced || args[i] != arg
+	}
+	if !replaced {
+		args = append(args, name)
+	}
+
+	var stdout, stderr bytes.Buffer
+	c := exec.CommandContext(ctx, r.cmd, args...)
+	c.Stdout, c.Stderr = &stdout, &stderr
+	c.WaitDelay = time.Second // for children of the command that outlive it
+	if err := c.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if msg := strings.SplitN(strings.TrimSpace(stderr.String()), "\n", 2)[0]; msg != "" {
+			return []Endpoint{}, 0, fmt.Errorf("exec: %s: %s: %w: %s", name, r.cmd, err, msg)
+		}
+		return []Endpoint{}, 0, fmt.Errorf("exec: %s: %s: %w", name, r.cmd, err)
+	}
+
+	if len(bytes.TrimSpace(stdout.Bytes())) <= 0 {
+		return []Endpoint{}, 0, fmt.Errorf("exec: %s: %s: no output", name, r.cmd)
+	}
+	endpoints, ttl, err := parseExecOutput(stdout.Bytes())
+	if err != nil {
+		return []Endpoint{}, 0, fmt.Errorf("exec: %s: %s: %v", name, r.cmd, err)
+	}
+	return endpoints, ttl, nil
+}
+
+// parseExecOutput parses the stdout of a command run by Exec.
+func parseExecOutput(b []byte) ([]Endpoint, time.Duration, error) {
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		return parseExecJSON(trimmed)
+	}
+
+	var (
+		endpoints = []Endpoint{}
+		ttl       = execTTL
+		s         = bufio.NewScanner(bytes.NewReader(b))
+	)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		switch {
+		case len(fields) <= 0 || strings.HasPrefix(fields[0], "#"):
+			continue
+		case fields[0] == "$TTL":
+			if len(fields) != 2 {
+				return nil, 0, fmt.Errorf("line %d: want $TTL ttl", n)
+			}
+			d, err := parseExecTTL(fields[1])
+			if err != nil {
+				return nil, 0, fmt.Errorf("line %d: %v", n, err)
+			}
+			ttl = d
+			continue
+		case len(fields) > 2:
+			return nil, 0, fmt.Errorf("line %d: want host:port [weight]", n)
+		}
+
+		e := ParseEndpoint(fields[0])
+		if len(fields) == 2 {
+			weight, err := strconv.ParseUint(fields[1], 10, 16)
+			if err != nil {
+				return nil, 0, fmt.Errorf("line %d: bad weight %q", n, fields[1])
+			}
+			e.Weight = uint16(weight)
+		}
+		endpoints = append(endpoints, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, 0, err
+	}
+	sortEndpoints(endpoints)
+	return endpoints, ttl, nil
+}
+
+// parseExecJSON parses JSON output, reusing the HTTP resolver's mapping.
+func parseExecJSON(b []byte) ([]Endpoint, time.Duration, error) {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		mapping HTTPMapping
+		ttl     = execTTL
+	)
+	if obj, ok := doc.(map[string]interface{}); ok {
+		mapping.Endpoints = "endpoints"
+		if v, ok := obj["ttl"]; ok {
+			d, err := parseExecTTL(fmt.Sprint(v))
+			if err != nil {
+				return nil, 0, err
+			}
+			ttl = d
+		}
+	}
+	if entries, _ := lookupPath(doc, mapping.Endpoints, ""); isObjectArray(entries) {
+		mapping.Address = "address"
+		mapping.Port = "port"
+		mapping.Priority = "priority"
+		mapping.Weight = "weight"
+		mapping.Labels = "labels"
+	}
+
+	endpoints, err := mapping.endpoints(doc, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	return endpoints, ttl, nil
+}
+
+// isObjectArray returns true if v is a JSON array whose first element is an
+// object.
+func isObjectArray(v interface{}) bool {
+	a, ok := v.([]interface{})
+	if !ok || len(a) <= 0 {
+		return false
+	}
+	_, ok = a[0].(map[string]interface{})
+	return ok
+}
+
+// parseExecTTL parses a TTL given as a duration, or a number of seconds. It's
+// floored at minTTL, so that a TTL of 0 doesn't run the command in a loop.
+func parseExecTTL(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if n, nerr := strconv.ParseUint(s, 10, 32); nerr == nil {
+		d, err = time.Duration(n)*time.Second, nil
+	}
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("bad TTL %q", s)
+	}
+	if d < minTTL {
+		d = minTTL
+	}
+	return d, nil
+}
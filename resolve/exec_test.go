@@ -0,0 +1,101 @@
+package resolve_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestExecLines(t *testing.T) {
+	// The name is appended to the arguments, so it's $0 of the script.
+	r := resolve.Exec("sh", "-c", `
+		echo "# hosts of $0"
+		echo '$TTL 1m'
+		echo
+		echo '10.0.0.2:8080 3'
+		echo '10.0.0.1:8080'
+	`)
+	endpoints, ttl, err := r.Resolve("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resolve.Endpoint{{Address: "10.0.0.2", Port: 8080, Weight: 3}, {Address: "10.0.0.1", Port: 8080}}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+	if want, have := time.Minute, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+}
+
+func TestExecJSON(t *testing.T) {
+	for _, tc := range []struct {
+		output string
+		want   []resolve.Endpoint
+		ttl    time.Duration
+	}{
+		{
+			`["10.0.0.1:80", "10.0.0.2:80"]`,
+			[]resolve.Endpoint{{Address: "10.0.0.1", Port: 80}, {Address: "10.0.0.2", Port: 80}},
+			30 * time.Second,
+		},
+		{
+			`{"ttl": 10, "endpoints": [{"address": "10.0.0.1", "port": 80, "weight": 2, "labels": {"zone": "a"}}]}`,
+			[]resolve.Endpoint{{Address: "10.0.0.1", Port: 80, Weight: 2, Labels: map[string]string{"zone": "a"}}},
+			10 * time.Second,
+		},
+		{
+			`{"ttl": "1m30s", "endpoints": []}`,
+			[]resolve.Endpoint{},
+			90 * time.Second,
+		},
+		{
+			`{"ttl": 0, "endpoints": ["10.0.0.1:80"]}`,
+			[]resolve.Endpoint{{Address: "10.0.0.1", Port: 80}},
+			time.Second,
+		},
+	} {
+		// The name is substituted for {name}, so it's echoed back.
+		endpoints, ttl, err := resolve.Exec("echo", "{name}").Resolve(tc.output)
+		if err != nil {
+			t.Errorf("%s: %v", tc.output, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.want, endpoints) {
+			t.Errorf("%s: want %+v, have %+v", tc.output, tc.want, endpoints)
+		}
+		if tc.ttl != ttl {
+			t.Errorf("%s: want TTL %s, have %s", tc.output, tc.ttl, ttl)
+		}
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	_, _, err := resolve.Exec("sh", "-c", `echo "no such service: $0" >&2; exit 3`).Resolve("users")
+	if want, have := "exec: users: sh: exit status 3: no such service: users", errString(err); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+
+	if _, _, err := resolve.Exec("echo", "10.0.0.1:80 3 extra").Resolve("users"); err == nil {
+		t.Error("bad line: want error, have none")
+	}
+
+	if _, _, err := resolve.Exec("true").Resolve("users"); err == nil {
+		t.Error("no output: want error, have none")
+	}
+
+	// The name would be taken for the -n option of echo.
+	_, _, err = resolve.Exec("echo").Resolve("-n")
+	if want, have := "exec: -n: echo: names can't start with '-'", errString(err); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+
+	_, _, err = resolve.Timeout(resolve.Exec("sh", "-c", "sleep 10"), 100*time.Millisecond).Resolve("users")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded, have %v", err)
+	}
+}
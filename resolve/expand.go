@@ -0,0 +1,149 @@
+package resolve
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve/internal/dnswire"
+)
+
+// TargetLabel is the label that ExpandTargets sets on each endpoint to the
+// SRV target its address belongs to. It's the name to use for TLS server
+// name verification, as proxy.DialTLS does, and for Happy Eyeballs between
+// the target's addresses.
+const TargetLabel = "target"
+
+// ExpandTargets replaces each SRV target with its A and AAAA addresses, so
+// that no further lookup is needed to connect. Each address becomes an
+// Endpoint with the priority and port of the SRV record, and with its weight
+// split evenly between the addresses of the target. Addresses are taken from
+// the additional section of the SRV response when present, and looked up
+// otherwise; the TTL is the minimum of every record involved. Targets
+// without addresses are dropped. It can't be combined with SVCBRecords, whose
+// endpoints carry address hints instead. If ExpandTargets isn't provided,
+// endpoints carry the SRV targets as given.
+func ExpandTargets(enabled bool) DNSOption {
+	return func(r *dnsResolver) { r.expand = enabled }
+}
+
+func (r *dnsResolver) expandTargets(ctx context.Context, resp *dnswire.Message, endpoints []Endpoint, ttl time.Duration) ([]Endpoint, time.Duration, error) {
+	var (
+		expanded = make([]Endpoint, 0, len(endpoints))
+		cache    = map[string][]net.IP{}
+		lastErr  error
+	)
+	for _, endpoint := range endpoints {
+		if ip := net.ParseIP(endpoint.Address); ip != nil {
+			expanded = append(expanded, endpoint) // already an address
+			continue
+		}
+
+		target := dnswire.Fqdn(endpoint.Address)
+		ips, ok := cache[target]
+		if !ok {
+			var (
+				addrTTL time.Duration
+				err     error
+			)
+			if ips, addrTTL, err = r.addrs(ctx, resp, target); err != nil {
+				lastErr = err
+			}
+			if len(ips) > 0 && addrTTL < ttl {
+				ttl = addrTTL
+			}
+			cache[target] = ips
+		}
+		if len(ips) <= 0 {
+			continue
+		}
+
+		weight := endpoint.Weight / uint16(len(ips))
+		if weight == 0 && endpoint.Weight > 0 {
+			weight = 1 // don't let a split turn it into a standby
+		}
+		for _, ip := range ips {
+			e := endpoint
+			e.Address, e.Weight = ip.String(), weight
+			e.Labels = make(map[string]string, len(endpoint.Labels)+1)
+			for k, v := range endpoint.Labels {
+				e.Labels[k] = v
+			}
+			e.Labels[TargetLabel] = endpoint.Address
+			expanded = append(expanded, e)
+		}
+	}
+	if len(expanded) <= 0 {
+		if lastErr == nil {
+			lastErr = &net.DNSError{Err: "no addresses for SRV targets", Name: resp.Questions[0].Name, IsNotFound: true}
+		}
+		return nil, 0, lastErr
+	}
+	return expanded, ttl, nil
+}
+
+// addrs returns the IPv6 and IPv4 addresses of target, from the additional
+// section of resp if it has any, or else by asking for them.
+func (r *dnsResolver) addrs(ctx context.Context, resp *dnswire.Message, target string) ([]net.IP, time.Duration, error) {
+	ips, ttl := addrRecords(resp.Additionals, target)
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+
+	var lastErr error
+	ips, ttl = nil, 0
+	for _, qtype := range []uint16{dnswire.TypeAAAA, dnswire.TypeA} {
+		m, _, err := r.query(ctx, target, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		rrs, rrsTTL := answers(m, target, qtype)
+		if len(rrs) <= 0 {
+			continue
+		}
+		if len(ips) == 0 || rrsTTL < ttl {
+			ttl = rrsTTL
+		}
+		for _, rr := range rrs {
+			switch data := rr.Data.(type) {
+			case *dnswire.AAAA:
+				ips = append(ips, data.IP)
+			case *dnswire.A:
+				ips = append(ips, data.IP)
+			}
+		}
+	}
+	if len(ips) <= 0 {
+		return nil, 0, lastErr
+	}
+	return ips, ttl, nil
+}
+
+// addrRecords returns the addresses in the AAAA and A records for name in
+// rrs, IPv6 first, and their minimum TTL.
+func addrRecords(rrs []dnswire.RR, name string) ([]net.IP, time.Duration) {
+	var (
+		v6, v4 []net.IP
+		ttl    = ^uint32(0)
+	)
+	for _, rr := range rrs {
+		if !dnswire.EqualNames(rr.Name, name) {
+			continue
+		}
+		switch data := rr.Data.(type) {
+		case *dnswire.AAAA:
+			v6 = append(v6, data.IP)
+		case *dnswire.A:
+			v4 = append(v4, data.IP)
+		default:
+			continue
+		}
+		ttl = minUint32(ttl, rr.TTL)
+	}
+	d := time.Duration(ttl) * time.Second
+	if d < minTTL {
+		d = minTTL
+	}
+	return append(v6, v4...), d
+}
@@ -0,0 +1,57 @@
+package resolve_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+	"github.com/peterbourgon/srvproxy/resolve/dnstest"
+)
+
+func TestExpandTargets(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetSRV("_http._tcp.foo.internal",
+		dnstest.SRV{Weight: 10, Port: 8080, Target: "a.internal", TTL: time.Minute},
+		dnstest.SRV{Weight: 5, Port: 8080, Target: "b.internal", TTL: time.Minute},
+		dnstest.SRV{Weight: 5, Port: 8080, Target: "c.internal", TTL: time.Minute},
+	)
+	s.SetA("a.internal", dnstest.A{IP: "192.0.2.1", TTL: 30 * time.Second}, dnstest.A{IP: "2001:db8::1", TTL: 30 * time.Second})
+	s.SetA("b.internal", dnstest.A{IP: "192.0.2.2", TTL: 120 * time.Second})
+
+	// The addresses are looked up, as the server doesn't give them along
+	// with the SRV records; see TestZoneFileExpandTargets for when it does.
+	r := resolve.DNS(resolve.Nameservers(s.Addr()), resolve.ExpandTargets(true))
+	endpoints, ttl, err := r.Resolve("_http._tcp.foo.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resolve.Endpoint{
+		{Address: "192.0.2.1", Port: 8080, Weight: 5, Labels: map[string]string{resolve.TargetLabel: "a.internal"}},
+		{Address: "192.0.2.2", Port: 8080, Weight: 5, Labels: map[string]string{resolve.TargetLabel: "b.internal"}},
+		{Address: "2001:db8::1", Port: 8080, Weight: 5, Labels: map[string]string{resolve.TargetLabel: "a.internal"}},
+	}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+	if want, have := 30*time.Second, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+	if want, have := "[2001:db8::1]:8080", endpoints[2].String(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func TestExpandTargetsNoAddresses(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetSRV("_http._tcp.foo.internal", dnstest.SRV{Port: 8080, Target: "a.internal", TTL: time.Minute})
+
+	r := resolve.DNS(resolve.Nameservers(s.Addr()), resolve.ExpandTargets(true))
+	_, _, err := r.Resolve("_http._tcp.foo.internal")
+	if e, ok := err.(*net.DNSError); !ok || !e.IsNotFound {
+		t.Errorf("want not found DNSError, have %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package resolve
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve/internal/yaml"
+)
+
+// File returns a resolver that answers from a JSON or YAML file mapping
+// names to hosts. Files ending in .yaml or .yml are read as YAML, and all
+// others as JSON. Each host is either a string, as accepted by
+// ParseEndpoint, or an object with a host and, optionally, a weight, a
+// priority and labels. Names may be wildcards, as in Overrides.
+//
+//	users:
+//	  - 10.0.0.1:8080
+//	  - host: 10.0.0.2:8080
+//	    weight: 10
+//	    labels: {zone: us-east-1a}
+//
+// The file is checked for changes every interval. If it can't be read or
+// parsed, the last good contents are kept, and the error is reported to
+// watchers. File returns an error if the initial contents aren't good.
+func File(path string, options ...FileOption) (*FileResolver, error) {
+	r := &FileResolver{
+		path:     path,
+		interval: time.Second,
+	}
+	r.setOptions(options...)
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// FileOption sets a specific option for the file resolver. This is the
+// functional options idiom.
+type FileOption func(*FileResolver)
+
+// FileInterval sets how often the file is checked for changes. It's also
+// the TTL returned by Resolve. If FileInterval isn't provided, a default
+// value of 1 second is used.
+func FileInterval(d time.Duration) FileOption {
+	return func(r *FileResolver) { r.interval = d }
+}
+
+// FileResolver resolves names from a file. It's both a Resolver and a
+// Watcher, so pool.Stream picks up edits as soon as they're seen.
+type FileResolver struct {
+	path     string
+	interval time.Duration
+
+	mtx     sync.Mutex
+	raw     []byte // last contents read, good or bad
+	names   map[string][]Endpoint
+	err     error // of the last read, if it failed
+	checked time.Time
+	version uint64 // incremented on every change to names or err
+}
+
+func (r *FileResolver) setOptions(options ...FileOption) {
+	for _, f := range options {
+		f(r)
+	}
+}
+
+// Resolve implements Resolver. It answers from the last good contents of the
+// file, even if the file has since become bad.
+func (r *FileResolver) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	r.mtx.Lock()
+	if time.Since(r.checked) >= r.interval {
+		r.reload()
+	}
+	endpoints, ok := matchName(r.names, name)
+	r.mtx.Unlock()
+
+	if !ok {
+		return []Endpoint{}, 0, &net.DNSError{Err: "no such name in " + r.path, Name: name, IsNotFound: true}
+	}
+	return copyEndpoints(endpoints), r.interval, nil
+}
+
+// Watch returns a channel of updates for name. The first update is sent
+// immediately. Subsequent updates are sent when an edit to the file changes
+// the endpoints of name, or when the file becomes bad, once per bad version,
+// and when it becomes good again, even if the endpoints are unchanged. Close
+// done to stop watching; the channel is closed after that.
+func (r *FileResolver) Watch(name string, done <-chan struct{}) <-chan Update {
+	c := make(chan Update)
+	go func() {
+		defer close(c)
+		var (
+			version uint64
+			first   = true
+			changes changeFilter
+		)
+		for {
+			r.mtx.Lock()
+			if !first {
+				r.reload()
+			}
+			var u *Update
+			if first || r.version != version {
+				endpoints, ok := matchName(r.names, name)
+				switch {
+				case r.err != nil:
+					u = &Update{Err: r.err}
+					changes.fail()
+				case !ok:
+					u = &Update{Err: &net.DNSError{Err: "no such name in " + r.path, Name: name, IsNotFound: true}}
+					changes.fail()
+				case changes.changed(endpoints):
+					u = &Update{Endpoints: copyEndpoints(endpoints)}
+				}
+				first, version = false, r.version
+			}
+			r.mtx.Unlock()
+
+			if u != nil {
+				select {
+				case c <- *u:
+				case <-done:
+					return
+				}
+			}
+
+			select {
+			case <-time.After(r.interval):
+			case <-done:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// load reads the file for the first time.
+func (r *FileResolver) load() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.reload()
+	return r.err
+}
+
+// reload reads the file, and updates the state if its contents changed. The
+// mutex must be held.
+func (r *FileResolver) reload() {
+	r.checked = time.Now()
+	b, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		if r.err == nil || r.err.Error() != err.Error() {
+			r.raw, r.err = nil, err
+			r.version++
+		}
+		return
+	}
+	if r.raw != nil && bytes.Equal(b, r.raw) {
+		return
+	}
+	r.raw = b
+
+	names, err := parseFile(r.path, b)
+	if err != nil {
+		r.err = err
+		r.version++
+		return
+	}
+	r.names, r.err = names, nil
+	r.version++
+}
+
+func parseFile(path string, b []byte) (map[string][]Endpoint, error) {
+	var (
+		m   map[string][]fileEntry
+		err error
+	)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &m)
+	default:
+		err = json.Unmarshal(b, &m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	names := make(map[string][]Endpoint, len(m))
+	for name, entries := range m {
+		endpoints := make([]Endpoint, 0, len(entries))
+		for _, e := range entries {
+			if e.Host == "" {
+				return nil, fmt.Errorf("%s: %s: entry without host", path, name)
+			}
+			endpoint := ParseEndpoint(e.Host)
+			endpoint.Priority, endpoint.Weight, endpoint.Labels = e.Priority, e.Weight, e.Labels
+			endpoints = append(endpoints, endpoint)
+		}
+		sortEndpoints(endpoints)
+		names[name] = endpoints
+	}
+	return names, nil
+}
+
+// fileEntry is a host in a file, given either as a string or as an object.
+type fileEntry struct {
+	Host     string            `json:"host"`
+	Weight   uint16            `json:"weight"`
+	Priority uint16            `json:"priority"`
+	Labels   map[string]string `json:"labels"`
+}
+
+func (e *fileEntry) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &e.Host)
+	}
+	type plain fileEntry // without this method
+	return json.Unmarshal(b, (*plain)(e))
+}
@@ -0,0 +1,107 @@
+package resolve_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestFile(t *testing.T) {
+	for _, tc := range []struct{ name, contents string }{
+		{"hosts.json", `{"users": ["10.0.0.1:8080", {"host": "10.0.0.2:8080", "weight": 10, "labels": {"zone": "a"}}]}`},
+		{"hosts.yaml", "users:\n  - 10.0.0.1:8080\n  - host: 10.0.0.2:8080\n    weight: 10\n    labels: {zone: a}\n"},
+	} {
+		path := filepath.Join(t.TempDir(), tc.name)
+		writeFile(t, path, tc.contents)
+
+		r, err := resolve.File(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		endpoints, _, err := r.Resolve("users")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		want := []resolve.Endpoint{
+			{Address: "10.0.0.2", Port: 8080, Weight: 10, Labels: map[string]string{"zone": "a"}},
+			{Address: "10.0.0.1", Port: 8080},
+		}
+		if !reflect.DeepEqual(want, endpoints) {
+			t.Errorf("%s: want %+v, have %+v", tc.name, want, endpoints)
+		}
+		if _, _, err := r.Resolve("unknown"); err == nil {
+			t.Errorf("%s: want error for unknown name, have none", tc.name)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "hosts.json")
+	writeFile(t, path, `{"users": [`)
+	if _, err := resolve.File(path); err == nil {
+		t.Error("want error for malformed file, have none")
+	}
+}
+
+func TestFileWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.json")
+	writeFile(t, path, `{"users": ["a:80"]}`)
+	r, err := resolve.File(path, resolve.FileInterval(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	updates := r.Watch("users", done)
+	if u := recvUpdate(t, updates); !reflect.DeepEqual([]string{"a:80"}, resolve.Hosts(u.Endpoints)) {
+		t.Errorf("update 1: have %+v", u)
+	}
+
+	writeFile(t, path, `{"users": ["a:80", "b:80"]}`)
+	if u := recvUpdate(t, updates); !reflect.DeepEqual([]string{"a:80", "b:80"}, resolve.Hosts(u.Endpoints)) {
+		t.Errorf("update 2: have %+v", u)
+	}
+
+	// A bad edit is reported, and doesn't wipe the last good state.
+	writeFile(t, path, `{"users": ["a:80",`)
+	select {
+	case u := <-updates:
+		if u.Err == nil {
+			t.Errorf("update 3: want error, have %+v", u)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for update")
+	}
+	endpoints, _, err := r.Resolve("users")
+	if err != nil || !reflect.DeepEqual([]string{"a:80", "b:80"}, resolve.Hosts(endpoints)) {
+		t.Errorf("want last good state, have %v (%v)", endpoints, err)
+	}
+
+	// Fixing it is reported, even though the endpoints are back where they
+	// were.
+	writeFile(t, path, `{"users": ["a:80", "b:80"]}`)
+	if u := recvUpdate(t, updates); !reflect.DeepEqual([]string{"a:80", "b:80"}, resolve.Hosts(u.Endpoints)) {
+		t.Errorf("update 4: have %+v", u)
+	}
+
+	writeFile(t, path, `{"users": ["c:80"]}`)
+	if u := recvUpdate(t, updates); !reflect.DeepEqual([]string{"c:80"}, resolve.Hosts(u.Endpoints)) {
+		t.Errorf("update 5: have %+v", u)
+	}
+}
+
+// writeFile replaces the file atomically, so watchers never see it half
+// written.
+func writeFile(t *testing.T, path, contents string) {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,383 @@
+package resolve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPMapping says where the endpoints are in a JSON document. Each field is
+// a path of object keys separated by dots, e.g. "data.instances", in which
+// "{name}" is replaced by the name being resolved. Numbers in the document
+// may also be given as strings.
+type HTTPMapping struct {
+	Endpoints string // the array of entries; empty for the document itself
+	Address   string // within each entry; if empty, entries are host[:port] strings
+	Port      string // within each entry; if empty, the address may be host:port
+	Priority  string // within each entry; optional
+	Weight    string // within each entry; optional
+	Labels    string // within each entry, an object of strings; optional
+}
+
+// HTTP returns a resolver that reads endpoints from the JSON documents
+// served at rawurl, as published by many discovery platforms. If rawurl
+// contains "{name}", it's replaced by the path-escaped name being resolved;
+// otherwise, every name reads the same document, and mapping should tell
+// them apart. The TTL of the endpoints is the max-age of the response's
+// Cache-Control header, less its Age, but at least a second, so that
+// documents that may not be cached aren't polled continuously. Responses are revalidated with their
+// ETag, so polling a document that hasn't changed costs the server a 304.
+// A 404 is reported as a *net.DNSError with IsNotFound set.
+func HTTP(rawurl string, mapping HTTPMapping, options ...HTTPOption) *HTTPResolver {
+	r := &HTTPResolver{
+		url:     rawurl,
+		mapping: mapping,
+		client:  http.DefaultClient,
+		header:  http.Header{},
+		ttl:     5 * time.Second,
+		cache:   map[string]httpCacheEntry{},
+	}
+	r.setOptions(options...)
+	return r
+}
+
+// HTTPOption sets a specific option for the HTTP resolver. This is the
+// functional options idiom.
+type HTTPOption func(*HTTPResolver)
+
+// HTTPClient sets the HTTP client used to fetch documents. If HTTPClient
+// isn't provided, http.DefaultClient is used.
+func HTTPClient(c *http.Client) HTTPOption {
+	return func(r *HTTPResolver) { r.client = c }
+}
+
+// HTTPHeader adds a header, e.g. for authorization, to each request. It may
+// be provided more than once.
+func HTTPHeader(key, value string) HTTPOption {
+	return func(r *HTTPResolver) { r.header.Add(key, value) }
+}
+
+// HTTPTTL sets the TTL of documents served without a Cache-Control max-age.
+// If HTTPTTL isn't provided, a default value of 5 seconds is used.
+func HTTPTTL(d time.Duration) HTTPOption {
+	return func(r *HTTPResolver) { r.ttl = d }
+}
+
+// HTTPLongPoll tells Watch that the server holds conditional requests until
+// the document changes, for at most wait, as advertised to it with a
+// "Prefer: wait" header (RFC 7240). Watch then asks again as soon as each
+// held response arrives, rather than after the TTL. Only documents with an
+// ETag can be waited on. If HTTPLongPoll isn't provided, Watch waits for the
+// TTL between requests.
+func HTTPLongPoll(wait time.Duration) HTTPOption {
+	return func(r *HTTPResolver) { r.wait = wait }
+}
+
+// HTTPResolver resolves names via JSON documents served over HTTP. It's both
+// a Resolver and a Watcher.
+type HTTPResolver struct {
+	url     string
+	mapping HTTPMapping
+	client  *http.Client
+	header  http.Header
+	ttl     time.Duration
+	wait    time.Duration
+
+	mtx   sync.Mutex
+	cache map[string]httpCacheEntry // by name
+}
+
+type httpCacheEntry struct {
+	etag      string
+	endpoints []Endpoint
+}
+
+func (r *HTTPResolver) setOptions(options ...HTTPOption) {
+	for _, f := range options {
+		f(r)
+	}
+}
+
+// Resolve implements Resolver by fetching the document of name.
+func (r *HTTPResolver) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return r.ResolveContext(context.Background(), name)
+}
+
+// ResolveContext is Resolve, with the request bound to ctx.
+func (r *HTTPResolver) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	endpoints, ttl, _, _, err := r.fetch(ctx, name, 0)
+	if err != nil {
+		return []Endpoint{}, 0, err
+	}
+	return endpoints, ttl, nil
+}
+
+// Watch returns a channel of updates for name. The first update is sent as
+// soon as the document is first fetched. After that, the document is
+// revalidated after each TTL, or continuously with HTTPLongPoll, and updates
+// are only sent when the set of endpoints changes, or when a request fails,
+// in which case Watch backs off and tries again, and the next success is
+// sent even if the endpoints are unchanged. Requests are at least a second
+// apart, whatever the TTL, unless the server held the last one as asked by
+// HTTPLongPoll; a server that answers at once, because it ignores the
+// "Prefer: wait" header, or has no ETag to wait on, is polled after each
+// TTL instead. Close done to stop watching; the channel is closed after
+// that.
+func (r *HTTPResolver) Watch(name string, done <-chan struct{}) <-chan Update {
+	var (
+		c           = make(chan Update)
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+	go func() {
+		<-done
+		cancel()
+	}()
+	go func() {
+		defer close(c)
+		var (
+			changes changeFilter
+			backoff time.Duration
+			wait    time.Duration // zero for the first request, which mustn't block
+		)
+		for {
+			begin := time.Now()
+			endpoints, ttl, modified, held, err := r.fetch(ctx, name, wait)
+			if ctx.Err() != nil {
+				return
+			}
+			took := time.Since(begin)
+
+			var delay time.Duration
+			switch {
+			case err != nil:
+				delay = nextBackoff(backoff)
+			case wait <= 0 && r.wait > 0:
+				delay = 0 // start the long poll right after the first request
+			case held && (modified || took >= httpMinInterval):
+				delay = httpMinInterval - took
+			default:
+				delay = ttl // at least httpMinInterval
+			}
+
+			var u *Update
+			switch {
+			case err != nil:
+				backoff = delay
+				u = &Update{Err: err}
+				changes.fail()
+			case changes.changed(endpoints):
+				backoff, wait = 0, r.wait
+				u = &Update{Endpoints: endpoints}
+			default:
+				backoff, wait = 0, r.wait
+			}
+
+			if u != nil {
+				select {
+				case c <- *u:
+				case <-done:
+					return
+				}
+			}
+			if delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return c
+}
+
+// httpMinInterval is the least TTL, and the least time between the requests
+// of Watch, unless the server holds them.
+const httpMinInterval = time.Second
+
+// fetch gets the document of name, conditionally if it's been fetched
+// before. If wait is non-zero, and the document has an ETag to wait on, the
+// server is asked to hold the request for that long, waiting for the
+// document to change. It returns the endpoints, their TTL, whether the
+// document was modified, and whether the server was asked to hold the
+// request.
+func (r *HTTPResolver) fetch(ctx context.Context, name string, wait time.Duration) (endpoints []Endpoint, ttl time.Duration, modified, held bool, err error) {
+	u := strings.Replace(r.url, "{name}", url.PathEscape(name), -1)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, false, false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+
+	r.mtx.Lock()
+	cached, ok := r.cache[name]
+	r.mtx.Unlock()
+	if ok && cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+		if wait > 0 {
+			req.Header.Set("Prefer", "wait="+strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			held = true
+		}
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, false, false, err
+	}
+	defer resp.Body.Close()
+	ttl = r.maxAge(resp.Header)
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && ok:
+		return cached.endpoints, ttl, false, held, nil
+	case resp.StatusCode == http.StatusNotFound:
+		r.mtx.Lock()
+		delete(r.cache, name)
+		r.mtx.Unlock()
+		return nil, 0, false, false, &net.DNSError{Err: "no such name at " + u, Name: name, IsNotFound: true}
+	case resp.StatusCode != http.StatusOK:
+		return nil, 0, false, false, fmt.Errorf("http: %s: HTTP %d %s", name, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	var doc interface{}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, 0, false, false, fmt.Errorf("http: %s: %v", name, err)
+	}
+	endpoints, err = r.mapping.endpoints(doc, name)
+	if err != nil {
+		return nil, 0, false, false, fmt.Errorf("http: %s: %v", name, err)
+	}
+
+	r.mtx.Lock()
+	r.cache[name] = httpCacheEntry{etag: resp.Header.Get("ETag"), endpoints: endpoints}
+	r.mtx.Unlock()
+	return endpoints, ttl, true, held, nil
+}
+
+// maxAge returns the TTL given by the Cache-Control and Age headers h, or
+// the default TTL if there's no max-age, floored at httpMinInterval.
+func (r *HTTPResolver) maxAge(h http.Header) time.Duration {
+	ttl := r.ttl
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(kv[0], "max-age") {
+			continue
+		}
+		maxAge, err := strconv.ParseUint(strings.Trim(kv[1], `"`), 10, 32)
+		if err != nil {
+			break
+		}
+		age, _ := strconv.ParseUint(h.Get("Age"), 10, 32)
+		ttl = 0
+		if age < maxAge {
+			ttl = time.Duration(maxAge-age) * time.Second
+		}
+		break
+	}
+	if ttl < httpMinInterval {
+		ttl = httpMinInterval
+	}
+	return ttl
+}
+
+// endpoints extracts the endpoints of name from doc, sorted.
+func (m HTTPMapping) endpoints(doc interface{}, name string) ([]Endpoint, error) {
+	v, ok := lookupPath(doc, m.Endpoints, name)
+	if !ok {
+		return nil, fmt.Errorf("no %q in document", m.Endpoints)
+	}
+	entries, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%q isn't an array", m.Endpoints)
+	}
+
+	endpoints := make([]Endpoint, 0, len(entries))
+	for i, entry := range entries {
+		if m.Address == "" {
+			s, ok := entry.(string)
+			if !ok {
+				return nil, fmt.Errorf("entry %d isn't a string", i)
+			}
+			endpoints = append(endpoints, ParseEndpoint(s))
+			continue
+		}
+
+		v, ok := lookupPath(entry, m.Address, name)
+		s, isString := v.(string)
+		if !ok || !isString || s == "" {
+			return nil, fmt.Errorf("entry %d: no %q", i, m.Address)
+		}
+		var e Endpoint
+		if m.Port == "" {
+			e = ParseEndpoint(s)
+		} else {
+			e.Address = s
+		}
+		for _, f := range []struct {
+			path string
+			dst  *uint16
+		}{
+			{m.Port, &e.Port},
+			{m.Priority, &e.Priority},
+			{m.Weight, &e.Weight},
+		} {
+			if f.path == "" {
+				continue
+			}
+			v, ok := lookupPath(entry, f.path, name)
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseUint(fmt.Sprint(v), 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("entry %d: %q isn't a 16-bit number", i, f.path)
+			}
+			*f.dst = uint16(n)
+		}
+		if m.Labels != "" {
+			v, _ := lookupPath(entry, m.Labels, name)
+			labels, _ := v.(map[string]interface{})
+			for k, v := range labels {
+				if e.Labels == nil {
+					e.Labels = map[string]string{}
+				}
+				e.Labels[k] = fmt.Sprint(v)
+			}
+		}
+		endpoints = append(endpoints, e)
+	}
+	sortEndpoints(endpoints)
+	return endpoints, nil
+}
+
+// lookupPath returns the value at path in v, a decoded JSON value. An empty
+// path is v itself.
+func lookupPath(v interface{}, path, name string) (interface{}, bool) {
+	if path == "" {
+		return v, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[strings.Replace(key, "{name}", name, -1)]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,315 @@
+package resolve_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestHTTPResolve(t *testing.T) {
+	d := newFakeDiscovery(`{"services": {"users": {"instances": [
+		{"ip": "10.0.0.2", "port": "8080", "weight": 1, "meta": {"zone": "b", "canary": true}},
+		{"ip": "10.0.0.1", "port": 8080, "weight": 3}
+	]}}}`)
+	s := httptest.NewServer(d)
+	defer s.Close()
+
+	r := resolve.HTTP(s.URL+"/catalog", resolve.HTTPMapping{
+		Endpoints: "services.{name}.instances",
+		Address:   "ip",
+		Port:      "port",
+		Weight:    "weight",
+		Labels:    "meta",
+	}, resolve.HTTPHeader("Authorization", "Bearer secret"))
+
+	endpoints, ttl, err := r.Resolve("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resolve.Endpoint{
+		{Address: "10.0.0.1", Port: 8080, Weight: 3},
+		{Address: "10.0.0.2", Port: 8080, Weight: 1, Labels: map[string]string{"zone": "b", "canary": "true"}},
+	}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+	if want, have := 50*time.Second, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+	if want, have := "Bearer secret", d.lastRequest().Header.Get("Authorization"); want != have {
+		t.Errorf("want Authorization %q, have %q", want, have)
+	}
+
+	// The document hasn't changed, so the second request is answered with a
+	// 304, and the endpoints come from the first.
+	if endpoints, _, err = r.Resolve("users"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+	if want, have := 1, d.notModified(); want != have {
+		t.Errorf("want %d 304s, have %d", want, have)
+	}
+
+	// Names that aren't in the document are errors.
+	if _, _, err := r.Resolve("orders"); err == nil {
+		t.Error("want error, have none")
+	}
+}
+
+func TestHTTPResolveStrings(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/services/users.prod" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `["10.0.0.1:8080", "[2001:db8::1]:8080"]`)
+	}))
+	defer s.Close()
+
+	r := resolve.HTTP(s.URL+"/services/{name}", resolve.HTTPMapping{}, resolve.HTTPTTL(time.Minute))
+	endpoints, ttl, err := r.Resolve("users.prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"10.0.0.1:8080", "[2001:db8::1]:8080"}, resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want, have := time.Minute, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+
+	_, _, err = r.Resolve("orders.prod")
+	if e, ok := err.(*net.DNSError); !ok || !e.IsNotFound {
+		t.Errorf("want not found, have %v", err)
+	}
+}
+
+func TestHTTPWatch(t *testing.T) {
+	d := newFakeDiscovery(`["10.0.0.1:80"]`)
+	s := httptest.NewServer(d)
+	defer s.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	r := resolve.HTTP(s.URL, resolve.HTTPMapping{}, resolve.HTTPLongPoll(time.Minute))
+	updates := r.Watch("users", done)
+
+	u := recvUpdate(t, updates)
+	if want, have := []string{"10.0.0.1:80"}, resolve.Hosts(u.Endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	// The watcher is now parked in a long poll, which should return as soon
+	// as the document changes.
+	d.set(`["10.0.0.1:80", "10.0.0.2:80"]`)
+	u = recvUpdate(t, updates)
+	if want, have := []string{"10.0.0.1:80", "10.0.0.2:80"}, resolve.Hosts(u.Endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	req := d.lastRequest()
+	if want, have := "wait=60", req.Header.Get("Prefer"); want != have {
+		t.Errorf("want Prefer %q, have %q", want, have)
+	}
+	if req.Header.Get("If-None-Match") == "" {
+		t.Error("want conditional request, have none")
+	}
+}
+
+func TestHTTPWatchRateLimit(t *testing.T) {
+	// None of these servers give Watch a reason to wait between requests,
+	// so it must rate limit them itself.
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		options []resolve.HTTPOption
+	}{
+		{"max-age=0", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=0")
+			fmt.Fprint(w, `["10.0.0.1:80"]`)
+		}, nil},
+		{"HTTPTTL(0)", func(w http.ResponseWriter, _ *http.Request) {
+			fmt.Fprint(w, `["10.0.0.1:80"]`)
+		}, []resolve.HTTPOption{resolve.HTTPTTL(0)}},
+		{"long poll without ETag", func(w http.ResponseWriter, _ *http.Request) {
+			fmt.Fprint(w, `["10.0.0.1:80"]`)
+		}, []resolve.HTTPOption{resolve.HTTPLongPoll(time.Minute), resolve.HTTPTTL(0)}},
+		{"long poll ignored", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprint(w, `["10.0.0.1:80"]`)
+		}, []resolve.HTTPOption{resolve.HTTPLongPoll(time.Minute)}},
+	} {
+		var (
+			mtx      sync.Mutex
+			requests int
+		)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mtx.Lock()
+			requests++
+			mtx.Unlock()
+			tc.handler(w, r)
+		}))
+
+		done := make(chan struct{})
+		recvUpdate(t, resolve.HTTP(s.URL, resolve.HTTPMapping{}, tc.options...).Watch("users", done))
+		time.Sleep(500 * time.Millisecond)
+		close(done)
+		s.Close()
+
+		mtx.Lock()
+		if requests > 2 {
+			t.Errorf("%s: want at most 2 requests, have %d", tc.name, requests)
+		}
+		mtx.Unlock()
+	}
+}
+
+func TestHTTPWatchRecovery(t *testing.T) {
+	// The second request fails, and the third returns what the first did,
+	// which must be sent anyway, so the error is known to be over.
+	var (
+		mtx      sync.Mutex
+		requests int
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mtx.Lock()
+		requests++
+		n := requests
+		mtx.Unlock()
+		if n == 2 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		fmt.Fprint(w, `["10.0.0.1:80"]`)
+	}))
+	defer s.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	updates := resolve.HTTP(s.URL, resolve.HTTPMapping{}).Watch("users", done)
+
+	for i, wantErr := range []bool{false, true, false} {
+		select {
+		case u := <-updates:
+			if haveErr := u.Err != nil; wantErr != haveErr {
+				t.Errorf("update %d: want error %v, have %+v", i, wantErr, u)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("update %d: timeout", i)
+		}
+	}
+}
+
+func TestHTTPMaxAge(t *testing.T) {
+	for _, tc := range []struct {
+		cacheControl, age string
+		want              time.Duration
+	}{
+		{"", "", 5 * time.Second},
+		{"public, max-age=30", "", 30 * time.Second},
+		{"max-age=30", "10", 20 * time.Second},
+		{"max-age=30", "45", time.Second},
+		{"max-age=0", "", time.Second},
+		{"no-cache", "", 5 * time.Second},
+	} {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.cacheControl != "" {
+				w.Header().Set("Cache-Control", tc.cacheControl)
+			}
+			if tc.age != "" {
+				w.Header().Set("Age", tc.age)
+			}
+			fmt.Fprint(w, `["10.0.0.1:80"]`)
+		}))
+		_, ttl, err := resolve.HTTP(s.URL, resolve.HTTPMapping{}).Resolve("users")
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl != tc.want {
+			t.Errorf("%q, Age %q: want TTL %s, have %s", tc.cacheControl, tc.age, tc.want, ttl)
+		}
+	}
+}
+
+// fakeDiscovery serves a single, mutable JSON document, with an ETag and a
+// max-age of 50 seconds. Conditional requests with a Prefer: wait header are
+// held until the document changes.
+type fakeDiscovery struct {
+	mtx     sync.Mutex
+	doc     string
+	version int
+	changed chan struct{}
+	last    *http.Request
+	notMod  int
+}
+
+func newFakeDiscovery(doc string) *fakeDiscovery {
+	return &fakeDiscovery{doc: doc, version: 1, changed: make(chan struct{})}
+}
+
+func (d *fakeDiscovery) set(doc string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.doc = doc
+	d.version++
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+func (d *fakeDiscovery) lastRequest() *http.Request {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.last
+}
+
+func (d *fakeDiscovery) notModified() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.notMod
+}
+
+func (d *fakeDiscovery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mtx.Lock()
+	d.last = r
+	etag, changed := `"v`+strconv.Itoa(d.version)+`"`, d.changed
+	d.mtx.Unlock()
+
+	match := r.Header.Get("If-None-Match") == etag
+	if wait := strings.TrimPrefix(r.Header.Get("Prefer"), "wait="); match && wait != "" {
+		seconds, _ := strconv.Atoi(wait)
+		select {
+		case <-changed:
+		case <-time.After(time.Duration(seconds) * time.Second):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	w.Header().Set("Cache-Control", "max-age=50")
+	w.Header().Set("ETag", `"v`+strconv.Itoa(d.version)+`"`)
+	if r.Header.Get("If-None-Match") == w.Header().Get("ETag") {
+		d.notMod++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	fmt.Fprint(w, d.doc)
+}
@@ -0,0 +1,332 @@
+package dnswire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Resource record types of DNSSEC (RFC 4034 and 5155).
+const (
+	TypeDS     uint16 = 43
+	TypeRRSIG  uint16 = 46
+	TypeNSEC   uint16 = 47
+	TypeDNSKEY uint16 = 48
+	TypeNSEC3  uint16 = 50
+)
+
+// NSEC3HashSHA1 is the only NSEC3 hash algorithm (RFC 5155).
+const NSEC3HashSHA1 uint8 = 1
+
+// EDNS0FlagDO is the DNSSEC OK bit of the extended flags in the TTL of an OPT
+// record (RFC 3225).
+const EDNS0FlagDO uint32 = 0x8000
+
+// DNSKEY flags.
+const (
+	DNSKEYFlagZone uint16 = 0x0100 // the key signs the zone's records
+	DNSKEYFlagSEP  uint16 = 0x0001 // the key is a key signing key
+)
+
+// DS is the RDATA of a DS record.
+type DS struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+func (d *DS) pack(b []byte) ([]byte, error) {
+	b = appendUint16(b, d.KeyTag)
+	b = append(b, d.Algorithm, d.DigestType)
+	return append(b, d.Digest...), nil
+}
+
+// DNSKEY is the RDATA of a DNSKEY record.
+type DNSKEY struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+func (d *DNSKEY) pack(b []byte) ([]byte, error) {
+	b = appendUint16(b, d.Flags)
+	b = append(b, d.Protocol, d.Algorithm)
+	return append(b, d.PublicKey...), nil
+}
+
+// KeyTag returns the key tag of the key, as computed in RFC 4034 appendix B.
+func (d *DNSKEY) KeyTag() uint16 {
+	b, _ := d.pack(nil)
+	var ac uint32
+	for i, c := range b {
+		if i&1 == 0 {
+			ac += uint32(c) << 8
+		} else {
+			ac += uint32(c)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac)
+}
+
+// RRSIG is the RDATA of an RRSIG record.
+type RRSIG struct {
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OriginalTTL uint32
+	Expiration  uint32 // seconds since the epoch, modulo 2^32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+}
+
+func (d *RRSIG) pack(b []byte) ([]byte, error) {
+	b = d.appendHead(b)
+	b, err := appendName(b, d.SignerName, nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, d.Signature...), nil
+}
+
+// appendHead appends the fixed-size fields of d.
+func (d *RRSIG) appendHead(b []byte) []byte {
+	b = appendUint16(b, d.TypeCovered)
+	b = append(b, d.Algorithm, d.Labels)
+	b = appendUint32(b, d.OriginalTTL)
+	b = appendUint32(b, d.Expiration)
+	b = appendUint32(b, d.Inception)
+	return appendUint16(b, d.KeyTag)
+}
+
+// NSEC is the RDATA of an NSEC record, which proves that no names exist
+// between its owner and NextName, in canonical order.
+type NSEC struct {
+	NextName    string
+	TypeBitMaps []byte // uninterpreted
+}
+
+func (d *NSEC) pack(b []byte) ([]byte, error) {
+	b, err := appendName(b, d.NextName, nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, d.TypeBitMaps...), nil
+}
+
+// NSEC3 is the RDATA of an NSEC3 record, which proves that no names exist
+// whose hashes lie between the hash in its owner name and NextHashed.
+type NSEC3 struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte
+	TypeBitMaps   []byte // uninterpreted
+}
+
+func (d *NSEC3) pack(b []byte) ([]byte, error) {
+	if len(d.Salt) > 255 || len(d.NextHashed) > 255 {
+		return nil, errors.New("NSEC3 salt or hash too long")
+	}
+	b = append(b, d.HashAlgorithm, d.Flags)
+	b = appendUint16(b, d.Iterations)
+	b = append(b, byte(len(d.Salt)))
+	b = append(b, d.Salt...)
+	b = append(b, byte(len(d.NextHashed)))
+	b = append(b, d.NextHashed...)
+	return append(b, d.TypeBitMaps...), nil
+}
+
+func readDNSSEC(b []byte, off, end int, typ uint16) (RData, error) {
+	rdata := b[off:end]
+	switch typ {
+	case TypeNSEC:
+		next, i, err := readName(b[:end], off)
+		if err != nil {
+			return nil, err
+		}
+		return &NSEC{NextName: next, TypeBitMaps: append([]byte{}, b[i:end]...)}, nil
+
+	case TypeNSEC3:
+		if len(rdata) < 5 {
+			return nil, ErrShort
+		}
+		d := &NSEC3{HashAlgorithm: rdata[0], Flags: rdata[1], Iterations: binary.BigEndian.Uint16(rdata[2:])}
+		i := 4
+		for _, field := range []*[]byte{&d.Salt, &d.NextHashed} {
+			if i >= len(rdata) || i+1+int(rdata[i]) > len(rdata) {
+				return nil, ErrShort
+			}
+			*field = append([]byte{}, rdata[i+1:i+1+int(rdata[i])]...)
+			i += 1 + int(rdata[i])
+		}
+		d.TypeBitMaps = append([]byte{}, rdata[i:]...)
+		return d, nil
+
+	case TypeDS:
+		if len(rdata) < 4 {
+			return nil, ErrShort
+		}
+		return &DS{
+			KeyTag:     binary.BigEndian.Uint16(rdata),
+			Algorithm:  rdata[2],
+			DigestType: rdata[3],
+			Digest:     append([]byte{}, rdata[4:]...),
+		}, nil
+
+	case TypeDNSKEY:
+		if len(rdata) < 4 {
+			return nil, ErrShort
+		}
+		return &DNSKEY{
+			Flags:     binary.BigEndian.Uint16(rdata),
+			Protocol:  rdata[2],
+			Algorithm: rdata[3],
+			PublicKey: append([]byte{}, rdata[4:]...),
+		}, nil
+
+	default: // TypeRRSIG
+		if len(rdata) < 19 {
+			return nil, ErrShort
+		}
+		signer, i, err := readName(b[:end], off+18)
+		if err != nil {
+			return nil, err
+		}
+		return &RRSIG{
+			TypeCovered: binary.BigEndian.Uint16(rdata),
+			Algorithm:   rdata[2],
+			Labels:      rdata[3],
+			OriginalTTL: binary.BigEndian.Uint32(rdata[4:]),
+			Expiration:  binary.BigEndian.Uint32(rdata[8:]),
+			Inception:   binary.BigEndian.Uint32(rdata[12:]),
+			KeyTag:      binary.BigEndian.Uint16(rdata[16:]),
+			SignerName:  signer,
+			Signature:   append([]byte{}, b[i:end]...),
+		}, nil
+	}
+}
+
+// CanonicalName returns the canonical wire form of name (RFC 4034 section
+// 6.2): lowercased, and uncompressed.
+func CanonicalName(name string) ([]byte, error) {
+	return appendName(nil, strings.ToLower(name), nil)
+}
+
+// CanonicalRData returns the canonical wire form of d, in which the names of
+// the record types listed in RFC 4034 section 6.2 are lowercased.
+func CanonicalRData(d RData) ([]byte, error) {
+	switch d := d.(type) {
+	case *SRV:
+		c := *d
+		c.Target = strings.ToLower(c.Target)
+		return c.pack(nil)
+	case *CNAME:
+		return (&CNAME{Target: strings.ToLower(d.Target)}).pack(nil)
+	case *PTR:
+		return (&PTR{Target: strings.ToLower(d.Target)}).pack(nil)
+	case *RRSIG:
+		c := *d
+		c.SignerName = strings.ToLower(c.SignerName)
+		return c.pack(nil)
+	default:
+		return d.pack(nil)
+	}
+}
+
+// CompareNames compares two names in the canonical order of RFC 4034 section
+// 6.1, label by label from the right, ignoring case. It returns -1, 0 or 1.
+func CompareNames(a, b string) int {
+	la, lb := Labels(a), Labels(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := strings.ToLower(la[len(la)-i]), strings.ToLower(lb[len(lb)-i])
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(la) < len(lb):
+		return -1
+	case len(la) > len(lb):
+		return 1
+	}
+	return 0
+}
+
+// Labels returns the labels of name, without the root; none for the root.
+func Labels(name string) []string {
+	name = strings.TrimSuffix(Fqdn(name), ".")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// SignatureLabels returns the number of labels of owner, as counted by the
+// Labels field of the RRSIGs that cover it: without the root, and without a
+// leading wildcard label.
+func SignatureLabels(owner string) int {
+	labels := Labels(owner)
+	if len(labels) > 0 && labels[0] == "*" {
+		return len(labels) - 1
+	}
+	return len(labels)
+}
+
+// SignedData returns the data that sig signs for rrs, an RRset covered by it,
+// as specified in RFC 4034 section 3.1.8.1 and RFC 4035 section 5.3.2. The
+// owner names of wildcard expansions are replaced by the wildcard, per the
+// Labels field of sig, which mustn't exceed the labels of the owner.
+func SignedData(sig *RRSIG, rrs []RR) ([]byte, error) {
+	b := sig.appendHead(nil)
+	signer, err := CanonicalName(sig.SignerName)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, signer...)
+	if len(rrs) <= 0 {
+		return b, nil
+	}
+
+	owner := strings.ToLower(Fqdn(rrs[0].Name))
+	if n := SignatureLabels(owner); int(sig.Labels) > n {
+		return nil, errors.New("RRSIG labels exceed those of the owner")
+	} else if int(sig.Labels) < n {
+		labels := Labels(owner)
+		owner = Fqdn("*." + strings.Join(labels[len(labels)-int(sig.Labels):], "."))
+	}
+	name, err := CanonicalName(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	// The RRs are sorted by their canonical RDATA, and duplicates dropped.
+	rdatas := make([][]byte, 0, len(rrs))
+	for _, rr := range rrs {
+		rdata, err := CanonicalRData(rr.Data)
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		b = append(b, name...)
+		b = appendUint16(b, rrs[0].Type)
+		b = appendUint16(b, rrs[0].Class)
+		b = appendUint32(b, sig.OriginalTTL)
+		b = appendUint16(b, uint16(len(rdata)))
+		b = append(b, rdata...)
+	}
+	return b, nil
+}
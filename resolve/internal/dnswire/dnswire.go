@@ -0,0 +1,591 @@
+// Package dnswire implements the subset of the DNS wire format (RFC 1035)
+// that package resolve and its test helpers need to speak DNS directly.
+package dnswire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Resource record types.
+const (
+	TypeA     uint16 = 1
+	TypeCNAME uint16 = 5
+	TypePTR   uint16 = 12
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeSRV   uint16 = 33
+	TypeOPT   uint16 = 41
+	TypeSVCB  uint16 = 64
+	TypeHTTPS uint16 = 65
+)
+
+// SvcParamKeys of SVCB and HTTPS records (RFC 9460 section 14.3.2).
+const (
+	SVCKeyMandatory     uint16 = 0
+	SVCKeyALPN          uint16 = 1
+	SVCKeyNoDefaultALPN uint16 = 2
+	SVCKeyPort          uint16 = 3
+	SVCKeyIPv4Hint      uint16 = 4
+	SVCKeyECH           uint16 = 5
+	SVCKeyIPv6Hint      uint16 = 6
+)
+
+// ClassINET is the Internet class.
+const ClassINET uint16 = 1
+
+// Response codes.
+const (
+	RcodeSuccess        = 0
+	RcodeFormatError    = 1
+	RcodeServerFailure  = 2
+	RcodeNameError      = 3
+	RcodeNotImplemented = 4
+	RcodeRefused        = 5
+)
+
+const (
+	headerLen  = 12
+	maxNameLen = 255
+	maxLabel   = 63
+	maxPointer = 0x3FFF
+)
+
+var (
+	// ErrShort indicates a message ended before a field could be read.
+	ErrShort = errors.New("dns message too short")
+
+	errPointerLoop = errors.New("dns name compression loop")
+	errLabelLen    = errors.New("dns label too long")
+	errNameLen     = errors.New("dns name too long")
+)
+
+// Header is the fixed-size header of a DNS message.
+type Header struct {
+	ID                 uint16
+	Response           bool
+	Opcode             int
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	AuthenticData      bool
+	CheckingDisabled   bool
+	Rcode              int
+}
+
+func (h Header) flags() uint16 {
+	f := uint16(h.Opcode&0xF)<<11 | uint16(h.Rcode&0xF)
+	if h.Response {
+		f |= 1 << 15
+	}
+	if h.Authoritative {
+		f |= 1 << 10
+	}
+	if h.Truncated {
+		f |= 1 << 9
+	}
+	if h.RecursionDesired {
+		f |= 1 << 8
+	}
+	if h.RecursionAvailable {
+		f |= 1 << 7
+	}
+	if h.AuthenticData {
+		f |= 1 << 5
+	}
+	if h.CheckingDisabled {
+		f |= 1 << 4
+	}
+	return f
+}
+
+func (h *Header) setFlags(f uint16) {
+	h.Response = f&(1<<15) != 0
+	h.Opcode = int(f>>11) & 0xF
+	h.Authoritative = f&(1<<10) != 0
+	h.Truncated = f&(1<<9) != 0
+	h.RecursionDesired = f&(1<<8) != 0
+	h.RecursionAvailable = f&(1<<7) != 0
+	h.AuthenticData = f&(1<<5) != 0
+	h.CheckingDisabled = f&(1<<4) != 0
+	h.Rcode = int(f & 0xF)
+}
+
+// Question is an entry in the question section.
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// RR is a resource record. Data holds the decoded RDATA; types that this
+// package doesn't understand are carried as *Raw.
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  RData
+}
+
+// RData is the type-specific payload of a resource record.
+type RData interface {
+	pack(b []byte) ([]byte, error)
+}
+
+// SRV is the RDATA of an SRV record (RFC 2782).
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func (d *SRV) pack(b []byte) ([]byte, error) {
+	b = appendUint16(b, d.Priority)
+	b = appendUint16(b, d.Weight)
+	b = appendUint16(b, d.Port)
+	return appendName(b, d.Target, nil)
+}
+
+// A is the RDATA of an A record.
+type A struct {
+	IP net.IP
+}
+
+func (d *A) pack(b []byte) ([]byte, error) {
+	ip := d.IP.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid A address %v", d.IP)
+	}
+	return append(b, ip...), nil
+}
+
+// AAAA is the RDATA of an AAAA record.
+type AAAA struct {
+	IP net.IP
+}
+
+func (d *AAAA) pack(b []byte) ([]byte, error) {
+	ip := d.IP.To16()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid AAAA address %v", d.IP)
+	}
+	return append(b, ip...), nil
+}
+
+// CNAME is the RDATA of a CNAME record.
+type CNAME struct {
+	Target string
+}
+
+func (d *CNAME) pack(b []byte) ([]byte, error) {
+	return appendName(b, d.Target, nil)
+}
+
+// PTR is the RDATA of a PTR record.
+type PTR struct {
+	Target string
+}
+
+func (d *PTR) pack(b []byte) ([]byte, error) {
+	return appendName(b, d.Target, nil)
+}
+
+// TXT is the RDATA of a TXT record.
+type TXT struct {
+	Strings []string
+}
+
+func (d *TXT) pack(b []byte) ([]byte, error) {
+	for _, s := range d.Strings {
+		if len(s) > 255 {
+			return nil, fmt.Errorf("TXT string too long (%d bytes)", len(s))
+		}
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return b, nil
+}
+
+// SVCB is the RDATA of an SVCB or HTTPS record (RFC 9460). A Priority of 0
+// means AliasMode, anything else ServiceMode. Params are kept in wire form,
+// and must be in strictly ascending order of key.
+type SVCB struct {
+	Priority uint16
+	Target   string
+	Params   []SVCParam
+}
+
+// SVCParam is a single SvcParam of an SVCB record.
+type SVCParam struct {
+	Key   uint16
+	Value []byte
+}
+
+// Param returns the value of the param with the given key, if present.
+func (d *SVCB) Param(key uint16) ([]byte, bool) {
+	for _, p := range d.Params {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (d *SVCB) pack(b []byte) ([]byte, error) {
+	b = appendUint16(b, d.Priority)
+	b, err := appendName(b, d.Target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range d.Params {
+		if i > 0 && p.Key <= d.Params[i-1].Key {
+			return nil, fmt.Errorf("SvcParamKeys out of order (%d after %d)", p.Key, d.Params[i-1].Key)
+		}
+		if len(p.Value) > 0xFFFF {
+			return nil, fmt.Errorf("SvcParamValue too long (%d bytes)", len(p.Value))
+		}
+		b = appendUint16(b, p.Key)
+		b = appendUint16(b, uint16(len(p.Value)))
+		b = append(b, p.Value...)
+	}
+	return b, nil
+}
+
+// Raw is uninterpreted RDATA.
+type Raw struct {
+	Data []byte
+}
+
+func (d *Raw) pack(b []byte) ([]byte, error) {
+	return append(b, d.Data...), nil
+}
+
+// Message is a complete DNS message.
+type Message struct {
+	Header
+	Questions   []Question
+	Answers     []RR
+	Authorities []RR
+	Additionals []RR
+}
+
+// Pack encodes the message. Owner and question names are compressed; names
+// inside RDATA are not.
+func (m *Message) Pack() ([]byte, error) {
+	b := make([]byte, headerLen, 512)
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	binary.BigEndian.PutUint16(b[2:], m.flags())
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(m.Authorities)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.Additionals)))
+
+	var (
+		comp = map[string]int{}
+		err  error
+	)
+	for _, q := range m.Questions {
+		if b, err = appendName(b, q.Name, comp); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, q.Type)
+		b = appendUint16(b, q.Class)
+	}
+	for _, section := range [][]RR{m.Answers, m.Authorities, m.Additionals} {
+		for _, rr := range section {
+			if b, err = appendRR(b, rr, comp); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+// Unpack decodes a message from b.
+func (m *Message) Unpack(b []byte) error {
+	if len(b) < headerLen {
+		return ErrShort
+	}
+	*m = Message{}
+	m.ID = binary.BigEndian.Uint16(b[0:])
+	m.setFlags(binary.BigEndian.Uint16(b[2:]))
+	var (
+		qd  = int(binary.BigEndian.Uint16(b[4:]))
+		an  = int(binary.BigEndian.Uint16(b[6:]))
+		ns  = int(binary.BigEndian.Uint16(b[8:]))
+		ar  = int(binary.BigEndian.Uint16(b[10:]))
+		off = headerLen
+		err error
+	)
+	for i := 0; i < qd; i++ {
+		var q Question
+		if q.Name, off, err = readName(b, off); err != nil {
+			return err
+		}
+		if off+4 > len(b) {
+			return ErrShort
+		}
+		q.Type = binary.BigEndian.Uint16(b[off:])
+		q.Class = binary.BigEndian.Uint16(b[off+2:])
+		off += 4
+		m.Questions = append(m.Questions, q)
+	}
+	for _, s := range []struct {
+		n    int
+		dest *[]RR
+	}{{an, &m.Answers}, {ns, &m.Authorities}, {ar, &m.Additionals}} {
+		for i := 0; i < s.n; i++ {
+			var rr RR
+			if rr, off, err = readRR(b, off); err != nil {
+				return err
+			}
+			*s.dest = append(*s.dest, rr)
+		}
+	}
+	return nil
+}
+
+func appendRR(b []byte, rr RR, comp map[string]int) ([]byte, error) {
+	b, err := appendName(b, rr.Name, comp)
+	if err != nil {
+		return nil, err
+	}
+	b = appendUint16(b, rr.Type)
+	b = appendUint16(b, rr.Class)
+	b = appendUint32(b, rr.TTL)
+	lenOff := len(b)
+	b = appendUint16(b, 0)
+	if rr.Data != nil {
+		if b, err = rr.Data.pack(b); err != nil {
+			return nil, err
+		}
+	}
+	rdlen := len(b) - lenOff - 2
+	if rdlen > 0xFFFF {
+		return nil, fmt.Errorf("rdata too long (%d bytes)", rdlen)
+	}
+	binary.BigEndian.PutUint16(b[lenOff:], uint16(rdlen))
+	return b, nil
+}
+
+func readRR(b []byte, off int) (RR, int, error) {
+	var (
+		rr  RR
+		err error
+	)
+	if rr.Name, off, err = readName(b, off); err != nil {
+		return rr, 0, err
+	}
+	if off+10 > len(b) {
+		return rr, 0, ErrShort
+	}
+	rr.Type = binary.BigEndian.Uint16(b[off:])
+	rr.Class = binary.BigEndian.Uint16(b[off+2:])
+	rr.TTL = binary.BigEndian.Uint32(b[off+4:])
+	rdlen := int(binary.BigEndian.Uint16(b[off+8:]))
+	off += 10
+	end := off + rdlen
+	if end > len(b) {
+		return rr, 0, ErrShort
+	}
+	if rr.Data, err = readRData(b, off, end, rr.Type); err != nil {
+		return rr, 0, fmt.Errorf("type %d: %v", rr.Type, err)
+	}
+	return rr, end, nil
+}
+
+func readRData(b []byte, off, end int, typ uint16) (RData, error) {
+	rdata := b[off:end]
+	switch typ {
+	case TypeA:
+		if len(rdata) != net.IPv4len {
+			return nil, ErrShort
+		}
+		return &A{IP: net.IP(append([]byte{}, rdata...))}, nil
+
+	case TypeAAAA:
+		if len(rdata) != net.IPv6len {
+			return nil, ErrShort
+		}
+		return &AAAA{IP: net.IP(append([]byte{}, rdata...))}, nil
+
+	case TypeSRV:
+		if len(rdata) < 7 {
+			return nil, ErrShort
+		}
+		target, _, err := readName(b[:end], off+6)
+		if err != nil {
+			return nil, err
+		}
+		return &SRV{
+			Priority: binary.BigEndian.Uint16(rdata[0:]),
+			Weight:   binary.BigEndian.Uint16(rdata[2:]),
+			Port:     binary.BigEndian.Uint16(rdata[4:]),
+			Target:   target,
+		}, nil
+
+	case TypeCNAME:
+		target, _, err := readName(b[:end], off)
+		if err != nil {
+			return nil, err
+		}
+		return &CNAME{Target: target}, nil
+
+	case TypePTR:
+		target, _, err := readName(b[:end], off)
+		if err != nil {
+			return nil, err
+		}
+		return &PTR{Target: target}, nil
+
+	case TypeTXT:
+		txt := &TXT{}
+		for i := 0; i < len(rdata); {
+			n := int(rdata[i])
+			if i+1+n > len(rdata) {
+				return nil, ErrShort
+			}
+			txt.Strings = append(txt.Strings, string(rdata[i+1:i+1+n]))
+			i += 1 + n
+		}
+		return txt, nil
+
+	case TypeSVCB, TypeHTTPS:
+		if len(rdata) < 3 {
+			return nil, ErrShort
+		}
+		target, i, err := readName(b[:end], off+2)
+		if err != nil {
+			return nil, err
+		}
+		svcb := &SVCB{Priority: binary.BigEndian.Uint16(rdata[0:]), Target: target}
+		for i < end {
+			if i+4 > end {
+				return nil, ErrShort
+			}
+			key, n := binary.BigEndian.Uint16(b[i:]), int(binary.BigEndian.Uint16(b[i+2:]))
+			if i+4+n > end {
+				return nil, ErrShort
+			}
+			if len(svcb.Params) > 0 && key <= svcb.Params[len(svcb.Params)-1].Key {
+				return nil, fmt.Errorf("SvcParamKeys out of order (%d)", key)
+			}
+			svcb.Params = append(svcb.Params, SVCParam{Key: key, Value: append([]byte{}, b[i+4:i+4+n]...)})
+			i += 4 + n
+		}
+		return svcb, nil
+
+	case TypeDS, TypeDNSKEY, TypeRRSIG, TypeNSEC, TypeNSEC3:
+		return readDNSSEC(b, off, end, typ)
+
+	default:
+		return &Raw{Data: append([]byte{}, rdata...)}, nil
+	}
+}
+
+// appendName appends the wire encoding of name. If comp is non-nil, it's used
+// to compress the name against previously written names, and updated with
+// the suffixes written by this call.
+func appendName(b []byte, name string, comp map[string]int) ([]byte, error) {
+	name = Fqdn(name)
+	if len(name) > maxNameLen {
+		return nil, errNameLen
+	}
+	if name == "." {
+		name = ""
+	}
+	for name != "" {
+		key := strings.ToLower(name)
+		if ptr, ok := comp[key]; ok {
+			return appendUint16(b, 0xC000|uint16(ptr)), nil
+		}
+		if comp != nil && len(b) <= maxPointer {
+			comp[key] = len(b)
+		}
+		i := strings.IndexByte(name, '.')
+		if i == 0 || i > maxLabel {
+			return nil, errLabelLen
+		}
+		b = append(b, byte(i))
+		b = append(b, name[:i]...)
+		name = name[i+1:]
+	}
+	return append(b, 0), nil
+}
+
+// readName reads a possibly-compressed name starting at off, and returns it
+// in fully-qualified form along with the offset just past it.
+func readName(b []byte, off int) (string, int, error) {
+	var (
+		labels []string
+		next   = -1
+		hops   = 0
+		length = 0
+	)
+	for {
+		if off >= len(b) {
+			return "", 0, ErrShort
+		}
+		c := int(b[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				return strings.Join(labels, ".") + ".", next, nil
+			}
+			if off+1+c > len(b) {
+				return "", 0, ErrShort
+			}
+			if length += c + 1; length > maxNameLen {
+				return "", 0, errNameLen
+			}
+			labels = append(labels, string(b[off+1:off+1+c]))
+			off += 1 + c
+
+		case 0xC0:
+			if off+2 > len(b) {
+				return "", 0, ErrShort
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			if hops++; hops > 64 {
+				return "", 0, errPointerLoop
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & maxPointer)
+
+		default:
+			return "", 0, fmt.Errorf("unsupported label type %#x", c&0xC0)
+		}
+	}
+}
+
+// Fqdn returns name with a trailing dot.
+func Fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// EqualNames reports whether two names are equal, ignoring case and any
+// trailing dot.
+func EqualNames(a, b string) bool {
+	return strings.EqualFold(Fqdn(a), Fqdn(b))
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
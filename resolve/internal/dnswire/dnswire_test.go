@@ -0,0 +1,74 @@
+package dnswire
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	want := &Message{
+		Header: Header{ID: 0xBEEF, Response: true, Authoritative: true, RecursionDesired: true, Rcode: RcodeSuccess},
+		Questions: []Question{
+			{Name: "_http._tcp.foo.internal.", Type: TypeSRV, Class: ClassINET},
+		},
+		Answers: []RR{
+			{Name: "_http._tcp.foo.internal.", Type: TypeSRV, Class: ClassINET, TTL: 60, Data: &SRV{Priority: 1, Weight: 2, Port: 8080, Target: "a.foo.internal."}},
+			{Name: "_http._tcp.foo.internal.", Type: TypeTXT, Class: ClassINET, TTL: 60, Data: &TXT{Strings: []string{"k=v", ""}}},
+			{Name: "_http._tcp.foo.internal.", Type: TypePTR, Class: ClassINET, TTL: 60, Data: &PTR{Target: "a._http._tcp.foo.internal."}},
+			{Name: "foo.internal.", Type: TypeHTTPS, Class: ClassINET, TTL: 60, Data: &SVCB{Priority: 1, Target: ".", Params: []SVCParam{
+				{Key: SVCKeyALPN, Value: []byte("\x02h2")},
+				{Key: SVCKeyPort, Value: []byte{0x1F, 0x90}},
+			}}},
+		},
+		Additionals: []RR{
+			{Name: "a.foo.internal.", Type: TypeA, Class: ClassINET, TTL: 30, Data: &A{IP: net.IPv4(10, 0, 0, 1).To4()}},
+			{Name: "a.foo.internal.", Type: TypeAAAA, Class: ClassINET, TTL: 30, Data: &AAAA{IP: net.ParseIP("fd00::1")}},
+			{Name: "foo.internal.", Type: TypeDNSKEY, Class: ClassINET, TTL: 60, Data: &DNSKEY{Flags: DNSKEYFlagZone, Protocol: 3, Algorithm: 13, PublicKey: []byte{1, 2, 3}}},
+			{Name: "foo.internal.", Type: TypeDS, Class: ClassINET, TTL: 60, Data: &DS{KeyTag: 1234, Algorithm: 13, DigestType: 2, Digest: []byte{4, 5, 6}}},
+			{Name: "foo.internal.", Type: TypeRRSIG, Class: ClassINET, TTL: 60, Data: &RRSIG{TypeCovered: TypeDS, Algorithm: 13, Labels: 2, OriginalTTL: 60, Expiration: 2, Inception: 1, KeyTag: 1234, SignerName: "internal.", Signature: []byte{7, 8, 9}}},
+			{Name: ".", Type: TypeOPT, Class: 1232, TTL: EDNS0FlagDO, Data: &Raw{Data: []byte{}}},
+		},
+	}
+
+	b, err := want.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var have Message
+	if err := have.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, &have) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	m := &Message{
+		Questions: []Question{{Name: "foo.internal.", Type: TypeSRV, Class: ClassINET}},
+		Answers:   []RR{{Name: "foo.internal.", Type: TypeCNAME, Class: ClassINET, Data: &CNAME{Target: "bar.internal."}}},
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The answer's owner name should be a pointer to the question's name.
+	const owner = headerLen + len("\x03foo\x08internal\x00") + 4
+	if want, have := []byte{0xC0, headerLen}, b[owner:owner+2]; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %x, have %x", want, have)
+	}
+}
+
+func TestPointerLoop(t *testing.T) {
+	b := make([]byte, headerLen, headerLen+6)
+	b[5] = 1 // one question
+	b = append(b, 0xC0, headerLen, 0, 33, 0, 1)
+
+	var m Message
+	if err := m.Unpack(b); err != errPointerLoop {
+		t.Errorf("want %v, have %v", errPointerLoop, err)
+	}
+}
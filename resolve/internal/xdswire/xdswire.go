@@ -0,0 +1,476 @@
+// Package xdswire implements the subset of the Envoy xDS protocol that
+// package resolve and its tests need to speak EDS over ADS: the protobuf
+// encoding of the few messages involved, and gRPC message framing.
+package xdswire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ADSPath is the HTTP/2 path of the gRPC method that opens an Aggregated
+// Discovery Service stream.
+const ADSPath = "/envoy.service.discovery.v3.AggregatedDiscoveryService/StreamAggregatedResources"
+
+// TypeClusterLoadAssignment is the type URL of EDS resources.
+const TypeClusterLoadAssignment = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+// MaxMessageSize is the largest gRPC message ReadMessage accepts, which is
+// also gRPC's default.
+const MaxMessageSize = 4 << 20
+
+// HealthStatus is the health of an endpoint, as seen by the control plane.
+type HealthStatus int32
+
+// Health statuses.
+const (
+	HealthUnknown   HealthStatus = 0
+	HealthHealthy   HealthStatus = 1
+	HealthUnhealthy HealthStatus = 2
+	HealthDraining  HealthStatus = 3
+	HealthTimeout   HealthStatus = 4
+	HealthDegraded  HealthStatus = 5
+)
+
+var (
+	// ErrShort means a message ended in the middle of a field.
+	ErrShort = errors.New("xdswire: message too short")
+
+	// ErrTooLarge means a gRPC message is larger than MaxMessageSize.
+	ErrTooLarge = errors.New("xdswire: message too large")
+
+	// ErrCompressed means a gRPC message is compressed, which isn't
+	// supported, and isn't asked for.
+	ErrCompressed = errors.New("xdswire: compressed messages aren't supported")
+)
+
+// Node identifies the client to the control plane.
+type Node struct {
+	ID      string
+	Cluster string
+}
+
+// Status is a google.rpc.Status, as sent with a NACK.
+type Status struct {
+	Code    int32
+	Message string
+}
+
+// DiscoveryRequest is sent by the client to subscribe to resources, and to
+// ACK or NACK each response. A NACK has an ErrorDetail.
+type DiscoveryRequest struct {
+	VersionInfo   string
+	Node          *Node
+	ResourceNames []string
+	TypeURL       string
+	ResponseNonce string
+	ErrorDetail   *Status
+}
+
+// DiscoveryResponse is sent by the control plane with the current version
+// of the subscribed resources.
+type DiscoveryResponse struct {
+	VersionInfo string
+	Resources   []Any
+	TypeURL     string
+	Nonce       string
+}
+
+// Any is a google.protobuf.Any: a packed message of some type.
+type Any struct {
+	TypeURL string
+	Value   []byte
+}
+
+// ClusterLoadAssignment is an EDS resource: the endpoints of a cluster.
+type ClusterLoadAssignment struct {
+	ClusterName string
+	Endpoints   []LocalityLbEndpoints
+}
+
+// LocalityLbEndpoints is a group of endpoints in the same locality, with the
+// same priority.
+type LocalityLbEndpoints struct {
+	Locality            Locality
+	LbEndpoints         []LbEndpoint
+	LoadBalancingWeight uint32 // zero if unset
+	Priority            uint32
+}
+
+// Locality is where endpoints run.
+type Locality struct {
+	Region  string
+	Zone    string
+	SubZone string
+}
+
+// LbEndpoint is an endpoint. Its socket address is flattened into Address
+// and Port; other kinds of address are ignored.
+type LbEndpoint struct {
+	Address             string
+	Port                uint32
+	Hostname            string
+	HealthStatus        HealthStatus
+	LoadBalancingWeight uint32 // zero if unset
+}
+
+// Marshal returns the protobuf encoding of r.
+func (r *DiscoveryRequest) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, r.VersionInfo)
+	if r.Node != nil {
+		var n []byte
+		n = appendString(n, 1, r.Node.ID)
+		n = appendString(n, 2, r.Node.Cluster)
+		b = appendBytes(b, 2, n)
+	}
+	for _, name := range r.ResourceNames {
+		b = appendBytes(b, 3, []byte(name))
+	}
+	b = appendString(b, 4, r.TypeURL)
+	b = appendString(b, 5, r.ResponseNonce)
+	if r.ErrorDetail != nil {
+		var s []byte
+		s = appendVarint(s, 1, uint64(uint32(r.ErrorDetail.Code)))
+		s = appendString(s, 2, r.ErrorDetail.Message)
+		b = appendBytes(b, 6, s)
+	}
+	return b
+}
+
+// Unmarshal decodes the protobuf encoding of a DiscoveryRequest into r.
+func (r *DiscoveryRequest) Unmarshal(b []byte) error {
+	*r = DiscoveryRequest{}
+	return walk(b, func(num int, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			r.VersionInfo = string(data)
+		case 2:
+			r.Node = &Node{}
+			return walk(data, func(num int, v uint64, data []byte) error {
+				switch num {
+				case 1:
+					r.Node.ID = string(data)
+				case 2:
+					r.Node.Cluster = string(data)
+				}
+				return nil
+			})
+		case 3:
+			r.ResourceNames = append(r.ResourceNames, string(data))
+		case 4:
+			r.TypeURL = string(data)
+		case 5:
+			r.ResponseNonce = string(data)
+		case 6:
+			r.ErrorDetail = &Status{}
+			return walk(data, func(num int, v uint64, data []byte) error {
+				switch num {
+				case 1:
+					r.ErrorDetail.Code = int32(v)
+				case 2:
+					r.ErrorDetail.Message = string(data)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// Marshal returns the protobuf encoding of r.
+func (r *DiscoveryResponse) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, r.VersionInfo)
+	for _, res := range r.Resources {
+		var a []byte
+		a = appendString(a, 1, res.TypeURL)
+		a = appendBytes(a, 2, res.Value)
+		b = appendBytes(b, 2, a)
+	}
+	b = appendString(b, 4, r.TypeURL)
+	return appendString(b, 5, r.Nonce)
+}
+
+// Unmarshal decodes the protobuf encoding of a DiscoveryResponse into r.
+func (r *DiscoveryResponse) Unmarshal(b []byte) error {
+	*r = DiscoveryResponse{}
+	return walk(b, func(num int, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			r.VersionInfo = string(data)
+		case 2:
+			var a Any
+			if err := walk(data, func(num int, v uint64, data []byte) error {
+				switch num {
+				case 1:
+					a.TypeURL = string(data)
+				case 2:
+					a.Value = append([]byte{}, data...)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			r.Resources = append(r.Resources, a)
+		case 4:
+			r.TypeURL = string(data)
+		case 5:
+			r.Nonce = string(data)
+		}
+		return nil
+	})
+}
+
+// Marshal returns the protobuf encoding of c.
+func (c *ClusterLoadAssignment) Marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, c.ClusterName)
+	for _, l := range c.Endpoints {
+		var lb []byte
+		var loc []byte
+		loc = appendString(loc, 1, l.Locality.Region)
+		loc = appendString(loc, 2, l.Locality.Zone)
+		loc = appendString(loc, 3, l.Locality.SubZone)
+		lb = appendBytes(lb, 1, loc)
+		for _, e := range l.LbEndpoints {
+			var sock, addr, endpoint, lbe []byte
+			sock = appendString(sock, 2, e.Address)
+			sock = appendVarint(sock, 3, uint64(e.Port))
+			addr = appendBytes(addr, 1, sock)
+			endpoint = appendBytes(endpoint, 1, addr)
+			endpoint = appendString(endpoint, 3, e.Hostname)
+			lbe = appendBytes(lbe, 1, endpoint)
+			lbe = appendVarint(lbe, 2, uint64(e.HealthStatus))
+			lbe = appendWeight(lbe, 4, e.LoadBalancingWeight)
+			lb = appendBytes(lb, 2, lbe)
+		}
+		lb = appendWeight(lb, 3, l.LoadBalancingWeight)
+		lb = appendVarint(lb, 5, uint64(l.Priority))
+		b = appendBytes(b, 2, lb)
+	}
+	return b
+}
+
+// Unmarshal decodes the protobuf encoding of a ClusterLoadAssignment into c.
+func (c *ClusterLoadAssignment) Unmarshal(b []byte) error {
+	*c = ClusterLoadAssignment{}
+	return walk(b, func(num int, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			c.ClusterName = string(data)
+		case 2:
+			var l LocalityLbEndpoints
+			if err := l.unmarshal(data); err != nil {
+				return err
+			}
+			c.Endpoints = append(c.Endpoints, l)
+		}
+		return nil
+	})
+}
+
+func (l *LocalityLbEndpoints) unmarshal(b []byte) error {
+	return walk(b, func(num int, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			return walk(data, func(num int, v uint64, data []byte) error {
+				switch num {
+				case 1:
+					l.Locality.Region = string(data)
+				case 2:
+					l.Locality.Zone = string(data)
+				case 3:
+					l.Locality.SubZone = string(data)
+				}
+				return nil
+			})
+		case 2:
+			var e LbEndpoint
+			if err := e.unmarshal(data); err != nil {
+				return err
+			}
+			l.LbEndpoints = append(l.LbEndpoints, e)
+		case 3:
+			return readWeight(data, &l.LoadBalancingWeight)
+		case 5:
+			l.Priority = uint32(v)
+		}
+		return nil
+	})
+}
+
+func (e *LbEndpoint) unmarshal(b []byte) error {
+	return walk(b, func(num int, v uint64, data []byte) error {
+		switch num {
+		case 1: // Endpoint
+			return walk(data, func(num int, v uint64, data []byte) error {
+				switch num {
+				case 1: // Address
+					return walk(data, func(num int, v uint64, data []byte) error {
+						if num != 1 { // not a SocketAddress
+							return nil
+						}
+						return walk(data, func(num int, v uint64, data []byte) error {
+							switch num {
+							case 2:
+								e.Address = string(data)
+							case 3:
+								e.Port = uint32(v)
+							}
+							return nil
+						})
+					})
+				case 3:
+					e.Hostname = string(data)
+				}
+				return nil
+			})
+		case 2:
+			e.HealthStatus = HealthStatus(v)
+		case 4:
+			return readWeight(data, &e.LoadBalancingWeight)
+		}
+		return nil
+	})
+}
+
+// WriteMessage writes msg to w as a single, uncompressed gRPC message.
+func WriteMessage(w io.Writer, msg []byte) error {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+// ReadMessage reads a single gRPC message from r. It returns io.EOF if r
+// ends cleanly before the message starts.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, ErrCompressed
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > MaxMessageSize {
+		return nil, ErrTooLarge
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendTag(b []byte, num, typ int) []byte {
+	return binary.AppendUvarint(b, uint64(num)<<3|uint64(typ))
+}
+
+// appendVarint appends a varint field, unless v is zero, the default.
+func appendVarint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.AppendUvarint(appendTag(b, num, wireVarint), v)
+}
+
+// appendString appends a string field, unless s is empty, the default.
+func appendString(b []byte, num int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendBytes(b, num, []byte(s))
+}
+
+// appendBytes appends a length-delimited field, even if data is empty, as
+// embedded messages are present when empty.
+func appendBytes(b []byte, num int, data []byte) []byte {
+	b = binary.AppendUvarint(appendTag(b, num, wireBytes), uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendWeight appends a google.protobuf.UInt32Value field, unless v is zero,
+// which stands for unset.
+func appendWeight(b []byte, num int, v uint32) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendBytes(b, num, appendVarint(nil, 1, uint64(v)))
+}
+
+func readWeight(b []byte, v *uint32) error {
+	return walk(b, func(num int, n uint64, _ []byte) error {
+		if num == 1 {
+			*v = uint32(n)
+		}
+		return nil
+	})
+}
+
+// walk calls f with each field of the protobuf message b, in order: the
+// value of varint fields, and the data of length-delimited ones. Fixed-size
+// fields are skipped, as none of the messages here use them.
+func walk(b []byte, f func(num int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return ErrShort
+		}
+		b = b[n:]
+		num, typ := int(tag>>3), int(tag&7)
+		if num <= 0 {
+			return fmt.Errorf("xdswire: bad field number %d", num)
+		}
+
+		var (
+			v    uint64
+			data []byte
+		)
+		switch typ {
+		case wireVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return ErrShort
+			}
+			b = b[n:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return ErrShort
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		case wireFixed64:
+			if len(b) < 8 {
+				return ErrShort
+			}
+			b = b[8:]
+			continue
+		case wireFixed32:
+			if len(b) < 4 {
+				return ErrShort
+			}
+			b = b[4:]
+			continue
+		default:
+			return fmt.Errorf("xdswire: unsupported wire type %d", typ)
+		}
+		if err := f(num, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package xdswire
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	cla := &ClusterLoadAssignment{
+		ClusterName: "users",
+		Endpoints: []LocalityLbEndpoints{
+			{
+				Locality:            Locality{Region: "eu", Zone: "eu-1a", SubZone: "rack1"},
+				LoadBalancingWeight: 10,
+				LbEndpoints: []LbEndpoint{
+					{Address: "10.0.0.1", Port: 8080, HealthStatus: HealthHealthy, LoadBalancingWeight: 3},
+					{Address: "10.0.0.2", Port: 8080, Hostname: "b.internal", HealthStatus: HealthDraining},
+				},
+			},
+			{Locality: Locality{Zone: "eu-1b"}, Priority: 1, LbEndpoints: []LbEndpoint{{Address: "10.0.1.1", Port: 8080}}},
+		},
+	}
+	var haveCLA ClusterLoadAssignment
+	if err := haveCLA.Unmarshal(cla.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cla, &haveCLA) {
+		t.Errorf("want %+v, have %+v", cla, haveCLA)
+	}
+
+	req := &DiscoveryRequest{
+		VersionInfo:   "v1",
+		Node:          &Node{ID: "srvproxy", Cluster: "edge"},
+		ResourceNames: []string{"users", "orders"},
+		TypeURL:       TypeClusterLoadAssignment,
+		ResponseNonce: "n2",
+		ErrorDetail:   &Status{Code: 3, Message: "bad resource"},
+	}
+	var haveReq DiscoveryRequest
+	if err := haveReq.Unmarshal(req.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(req, &haveReq) {
+		t.Errorf("want %+v, have %+v", req, haveReq)
+	}
+
+	resp := &DiscoveryResponse{
+		VersionInfo: "v2",
+		Resources:   []Any{{TypeURL: TypeClusterLoadAssignment, Value: cla.Marshal()}},
+		TypeURL:     TypeClusterLoadAssignment,
+		Nonce:       "n2",
+	}
+	var haveResp DiscoveryResponse
+	if err := haveResp.Unmarshal(resp.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp, &haveResp) {
+		t.Errorf("want %+v, have %+v", resp, haveResp)
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	// A ClusterLoadAssignment with a policy (field 4), a fixed64 field, and a
+	// pipe address instead of a socket address, all of which are skipped.
+	b := (&ClusterLoadAssignment{ClusterName: "users"}).Marshal()
+	b = appendBytes(b, 4, appendVarint(nil, 2, 1))
+	b = append(appendTag(b, 9, wireFixed64), 1, 2, 3, 4, 5, 6, 7, 8)
+	pipe := appendBytes(nil, 1, appendBytes(nil, 2, appendString(nil, 1, "/run/users.sock")))
+	b = appendBytes(b, 2, appendBytes(nil, 2, appendBytes(nil, 1, pipe)))
+
+	var c ClusterLoadAssignment
+	if err := c.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	want := ClusterLoadAssignment{ClusterName: "users", Endpoints: []LocalityLbEndpoints{{LbEndpoints: []LbEndpoint{{}}}}}
+	if !reflect.DeepEqual(want, c) {
+		t.Errorf("want %+v, have %+v", want, c)
+	}
+
+	if err := c.Unmarshal(b[:len(b)-1]); err != ErrShort {
+		t.Errorf("want %v, have %v", ErrShort, err)
+	}
+}
+
+func TestFraming(t *testing.T) {
+	var buf bytes.Buffer
+	for _, msg := range [][]byte{[]byte("hello"), {}} {
+		if err := WriteMessage(&buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range [][]byte{[]byte("hello"), {}} {
+		have, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want, have) {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+	if _, err := ReadMessage(&buf); err != io.EOF {
+		t.Errorf("want EOF, have %v", err)
+	}
+
+	if _, err := ReadMessage(bytes.NewReader([]byte{1, 0, 0, 0, 0})); err != ErrCompressed {
+		t.Errorf("want %v, have %v", ErrCompressed, err)
+	}
+	if _, err := ReadMessage(bytes.NewReader([]byte{0, 0xFF, 0, 0, 0})); err != ErrTooLarge {
+		t.Errorf("want %v, have %v", ErrTooLarge, err)
+	}
+	if _, err := ReadMessage(bytes.NewReader([]byte{0, 0, 0, 0, 5, 'h'})); err != io.ErrUnexpectedEOF {
+		t.Errorf("want %v, have %v", io.ErrUnexpectedEOF, err)
+	}
+}
@@ -0,0 +1,612 @@
+// Package yaml parses the subset of YAML used by configuration files like
+// kubeconfig: block mappings and sequences, plain and quoted scalars, block
+// scalars, simple flow collections, and comments. Anchors, aliases, tags and
+// multi-document streams aren't supported.
+package yaml
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Unmarshal parses the YAML document in b and stores the result in the value
+// pointed to by v, following the rules of encoding/json. Numbers are stored
+// as their original text in string fields, so unquoted values like port names
+// "8080" and label values "1.10" come out as written.
+func Unmarshal(b []byte, v interface{}) error {
+	doc, err := Parse(b)
+	if err != nil {
+		return err
+	}
+	j, err := json.Marshal(normalize(doc, reflect.TypeOf(v)))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+// Parse parses the YAML document in b into nil, bool, Number, string,
+// []interface{} and map[string]interface{} values.
+func Parse(b []byte) (interface{}, error) {
+	p := &parser{}
+	for i, raw := range strings.Split(strings.Replace(string(b), "\r\n", "\n", -1), "\n") {
+		p.lines = append(p.lines, line{num: i + 1, raw: raw})
+	}
+	p.skip()
+	if p.eof() {
+		return nil, nil
+	}
+	v, err := p.node(p.cur().indent())
+	if err != nil {
+		return nil, err
+	}
+	if p.skip(); !p.eof() {
+		return nil, p.errorf("unexpected content")
+	}
+	return v, nil
+}
+
+type line struct {
+	num int
+	raw string
+	col int // additional indent, for sequence entries parsed in place
+}
+
+func (l line) indent() int {
+	return l.col + len(l.raw) - len(strings.TrimLeft(l.raw, " "))
+}
+
+func (l line) text() string {
+	return stripComment(strings.TrimSpace(l.raw))
+}
+
+type parser struct {
+	lines []line
+	pos   int
+}
+
+func (p *parser) eof() bool { return p.pos >= len(p.lines) }
+func (p *parser) cur() line { return p.lines[p.pos] }
+
+// skip advances past blank lines, comments and document markers.
+func (p *parser) skip() {
+	for !p.eof() {
+		t := p.cur().text()
+		if t != "" && t != "---" && t != "..." && !strings.HasPrefix(t, "%") {
+			return
+		}
+		p.pos++
+	}
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	num := 0
+	if !p.eof() {
+		num = p.cur().num
+	} else if len(p.lines) > 0 {
+		num = p.lines[len(p.lines)-1].num
+	}
+	return fmt.Errorf("yaml: line %d: %s", num, fmt.Sprintf(format, args...))
+}
+
+// node parses the block node starting at the current line, which must be
+// indented by exactly indent.
+func (p *parser) node(indent int) (interface{}, error) {
+	l := p.cur()
+	if strings.ContainsRune(l.raw[:len(l.raw)-len(strings.TrimLeft(l.raw, " \t"))], '\t') {
+		return nil, p.errorf("tabs can't be used for indentation")
+	}
+	t := l.text()
+	switch {
+	case t == "-" || strings.HasPrefix(t, "- "):
+		return p.sequence(indent)
+	case splitKey(t) >= 0:
+		return p.mapping(indent)
+	default:
+		p.pos++
+		return scalar(t, p)
+	}
+}
+
+func (p *parser) sequence(indent int) (interface{}, error) {
+	seq := []interface{}{}
+	for p.skip(); !p.eof(); p.skip() {
+		l := p.cur()
+		t := l.text()
+		if l.indent() != indent || !(t == "-" || strings.HasPrefix(t, "- ")) {
+			break
+		}
+		if t == "-" {
+			p.pos++
+			v, err := p.child(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+
+		// Re-parse the rest of the line in place, as if the dash were
+		// indentation, so "- key: value" starts a nested mapping.
+		rest := strings.TrimLeft(l.raw, " ")[1:]
+		trimmed := strings.TrimLeft(rest, " ")
+		p.lines[p.pos] = line{num: l.num, raw: trimmed, col: indent + 1 + len(rest) - len(trimmed)}
+		v, err := p.node(p.cur().indent())
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+	return seq, nil
+}
+
+func (p *parser) mapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.skip(); !p.eof(); p.skip() {
+		l := p.cur()
+		t := l.text()
+		if l.indent() != indent {
+			if l.indent() > indent {
+				return nil, p.errorf("unexpected indentation")
+			}
+			break
+		}
+		i := splitKey(t)
+		if i < 0 {
+			return nil, p.errorf("expected a mapping key")
+		}
+		key, err := scalar(strings.TrimSpace(t[:i]), p)
+		if err != nil {
+			return nil, err
+		}
+		k := fmt.Sprint(key)
+		if key == nil {
+			k = "null"
+		}
+		if _, ok := m[k]; ok {
+			return nil, p.errorf("duplicate key %q", k)
+		}
+
+		value := strings.TrimSpace(t[i+1:])
+		p.pos++
+		switch {
+		case value == "":
+			if m[k], err = p.child(indent, true); err != nil {
+				return nil, err
+			}
+		case value[0] == '|' || value[0] == '>':
+			m[k] = p.blockScalar(indent, value)
+		default:
+			if m[k], err = scalar(value, p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// child parses the node nested under a key or dash at the given indent. In
+// mappings, a sequence may sit at the same indent as its key.
+func (p *parser) child(indent int, inMapping bool) (interface{}, error) {
+	if p.skip(); p.eof() {
+		return nil, nil
+	}
+	l := p.cur()
+	t := l.text()
+	switch {
+	case l.indent() > indent:
+		return p.node(l.indent())
+	case inMapping && l.indent() == indent && (t == "-" || strings.HasPrefix(t, "- ")):
+		return p.sequence(indent)
+	default:
+		return nil, nil
+	}
+}
+
+// blockScalar reads a literal (|) or folded (>) scalar whose lines are
+// indented deeper than indent.
+func (p *parser) blockScalar(indent int, header string) string {
+	var (
+		lines []string
+		base  = -1
+	)
+	for ; !p.eof(); p.pos++ {
+		raw := p.cur().raw
+		if strings.TrimSpace(raw) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		n := p.cur().indent()
+		if n <= indent {
+			break
+		}
+		if base < 0 {
+			base = n
+		}
+		if n < base {
+			break
+		}
+		lines = append(lines, raw[base-p.cur().col:])
+	}
+
+	// Trailing blank lines belong to chomping, not content.
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+
+	var s string
+	if header[0] == '|' {
+		s = strings.Join(lines, "\n")
+	} else {
+		var b strings.Builder
+		for i, l := range lines {
+			switch {
+			case i == 0, l != "" && lines[i-1] == "":
+			case l == "", strings.HasPrefix(l, " "), strings.HasPrefix(lines[i-1], " "):
+				b.WriteString("\n")
+			default:
+				b.WriteString(" ")
+			}
+			b.WriteString(l)
+		}
+		s = b.String()
+	}
+
+	switch {
+	case strings.Contains(header, "-"):
+		return s
+	case strings.Contains(header, "+"):
+		return s + strings.Repeat("\n", trailing+1)
+	case s == "":
+		return s
+	default:
+		return s + "\n"
+	}
+}
+
+// scalar interprets a single-line value: a flow collection, a quoted string,
+// or a plain scalar.
+func scalar(t string, p *parser) (interface{}, error) {
+	if t == "" {
+		return nil, nil
+	}
+	switch t[0] {
+	case '[', '{':
+		f := &flow{s: t}
+		v, err := f.value()
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if f.skipSpace(); f.i < len(f.s) {
+			return nil, p.errorf("unexpected %q after flow collection", f.s[f.i:])
+		}
+		return v, nil
+	case '"', '\'':
+		s, n, err := quoted(t)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if strings.TrimSpace(t[n:]) != "" {
+			return nil, p.errorf("unexpected %q after quoted string", t[n:])
+		}
+		return s, nil
+	case '&', '*', '!':
+		return nil, p.errorf("anchors, aliases and tags aren't supported")
+	}
+	return plain(t), nil
+}
+
+// plain resolves a plain scalar per the YAML 1.2 core schema.
+func plain(s string) interface{} {
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if _, err := Number(s).Float64(); err == nil {
+		return Number(s)
+	}
+	return s
+}
+
+// Number is a plain scalar that resolves to a number per the YAML 1.2 core
+// schema. Like json.Number, it holds the original text, so callers that
+// expect a string, e.g. for unquoted Kubernetes port names, lose nothing.
+type Number string
+
+// String returns the original text of the number.
+func (n Number) String() string { return string(n) }
+
+// Int64 returns the number as an int64. Hexadecimal (0x) and octal (0o)
+// forms are supported.
+func (n Number) Int64() (int64, error) {
+	s := string(n)
+	switch {
+	case strings.HasPrefix(s, "0x"):
+		return strconv.ParseInt(s[2:], 16, 64)
+	case strings.HasPrefix(s, "0o"):
+		return strconv.ParseInt(s[2:], 8, 64)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// Float64 returns the number as a float64, including the infinities.
+func (n Number) Float64() (float64, error) {
+	switch s := string(n); s {
+	case ".inf", ".Inf", ".INF", "+.inf", "+.Inf", "+.INF":
+		return math.Inf(1), nil
+	case "-.inf", "-.Inf", "-.INF":
+		return math.Inf(-1), nil
+	default:
+		if i, err := n.Int64(); err == nil {
+			return float64(i), nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err == nil && strings.IndexAny(s, "0123456789") < 0 {
+			err = fmt.Errorf("invalid number %q", s) // e.g. "Inf" or "NaN"
+		}
+		return f, err
+	}
+}
+
+// normalize prepares a parsed document for encoding/json and decoding into a
+// value of type t: Numbers are replaced by their text where t has a string,
+// and by their value everywhere else.
+func normalize(node interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch n := node.(type) {
+	case Number:
+		if t != nil && t.Kind() == reflect.String {
+			return string(n)
+		}
+		if i, err := n.Int64(); err == nil {
+			return json.Number(strconv.FormatInt(i, 10))
+		}
+		f, _ := n.Float64()
+		return f
+
+	case []interface{}:
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		a := make([]interface{}, len(n))
+		for i, v := range n {
+			a[i] = normalize(v, elem)
+		}
+		return a
+
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(n))
+		for k, v := range n {
+			m[k] = normalize(v, fieldType(t, k))
+		}
+		return m
+	}
+	return node
+}
+
+// fieldType returns the type of the map element or struct field that
+// encoding/json would decode key into, or nil if it can't tell. Struct types
+// are looked into even if they implement json.Unmarshaler, as they usually
+// decode their fields the usual way.
+func fieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		var folded reflect.Type
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+			switch {
+			case f.PkgPath != "" || name == "-":
+				continue
+			case name == "":
+				name = f.Name
+			}
+			if name == key {
+				return f.Type
+			}
+			if folded == nil && strings.EqualFold(name, key) {
+				folded = f.Type
+			}
+		}
+		return folded
+	}
+	return nil
+}
+
+// quoted decodes the quoted string at the start of s, and returns it along
+// with the number of bytes consumed.
+func quoted(s string) (string, int, error) {
+	q := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == q:
+			return b.String(), i + 1, nil
+		case c == '\\' && q == '"' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			case 'x', 'u', 'U':
+				width := map[byte]int{'x': 2, 'u': 4, 'U': 8}[s[i]]
+				if i+width >= len(s) {
+					return "", 0, fmt.Errorf("short escape in %s", s)
+				}
+				r, err := strconv.ParseUint(s[i+1:i+1+width], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("bad escape in %s", s)
+				}
+				b.WriteRune(rune(r))
+				i += width
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string %s", s)
+}
+
+// splitKey returns the index of the colon separating a mapping key from its
+// value, or -1 if t isn't a mapping entry.
+func splitKey(t string) int {
+	if t == "" || t[0] == '[' || t[0] == '{' {
+		return -1
+	}
+	start := 0
+	if t[0] == '"' || t[0] == '\'' {
+		_, n, err := quoted(t)
+		if err != nil {
+			return -1
+		}
+		start = n
+	}
+	for i := start; i < len(t); i++ {
+		if t[i] == ':' && (i+1 == len(t) || t[i+1] == ' ') {
+			return i
+		}
+	}
+	return -1
+}
+
+// stripComment removes a trailing comment from t, taking care not to
+// mistake a # inside quotes for one.
+func stripComment(t string) string {
+	var q byte
+	for i := 0; i < len(t); i++ {
+		c := t[i]
+		switch {
+		case q != 0:
+			if c == q {
+				q = 0
+			} else if c == '\\' && q == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || t[i-1] == ' ' || strings.IndexByte("[{,:", t[i-1]) >= 0 {
+				q = c
+			}
+		case c == '#' && (i == 0 || t[i-1] == ' '):
+			return strings.TrimRight(t[:i], " ")
+		}
+	}
+	return t
+}
+
+// flow parses flow collections, e.g. [a, b] and {k: v}.
+type flow struct {
+	s string
+	i int
+}
+
+func (f *flow) skipSpace() {
+	for f.i < len(f.s) && f.s[f.i] == ' ' {
+		f.i++
+	}
+}
+
+func (f *flow) value() (interface{}, error) {
+	f.skipSpace()
+	if f.i >= len(f.s) {
+		return nil, fmt.Errorf("unexpected end of flow collection")
+	}
+	switch f.s[f.i] {
+	case '[':
+		f.i++
+		seq := []interface{}{}
+		for {
+			if f.skipSpace(); f.i < len(f.s) && f.s[f.i] == ']' {
+				f.i++
+				return seq, nil
+			}
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			if err := f.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.i++
+		m := map[string]interface{}{}
+		for {
+			if f.skipSpace(); f.i < len(f.s) && f.s[f.i] == '}' {
+				f.i++
+				return m, nil
+			}
+			k, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			if f.skipSpace(); f.i >= len(f.s) || f.s[f.i] != ':' {
+				return nil, fmt.Errorf("expected ':' in flow mapping")
+			}
+			f.i++
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = v
+			if err := f.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	case '"', '\'':
+		s, n, err := quoted(f.s[f.i:])
+		if err != nil {
+			return nil, err
+		}
+		f.i += n
+		return s, nil
+	default:
+		start := f.i
+		for f.i < len(f.s) && strings.IndexByte(",]}", f.s[f.i]) < 0 && !(f.s[f.i] == ':' && (f.i+1 == len(f.s) || f.s[f.i+1] == ' ')) {
+			f.i++
+		}
+		return plain(strings.TrimSpace(f.s[start:f.i])), nil
+	}
+}
+
+func (f *flow) separator(end byte) error {
+	f.skipSpace()
+	switch {
+	case f.i < len(f.s) && f.s[f.i] == ',':
+		f.i++
+		return nil
+	case f.i < len(f.s) && f.s[f.i] == end:
+		return nil
+	default:
+		return fmt.Errorf("expected ',' or %q in flow collection", end)
+	}
+}
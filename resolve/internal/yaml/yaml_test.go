@@ -0,0 +1,151 @@
+package yaml
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	doc := `
+# a kubeconfig-shaped document
+apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    server: https://127.0.0.1:6443   # local
+    insecure-skip-tls-verify: true
+  name: "local"
+users:
+  - name: 'dev''s'
+    user:
+      token: abc#def
+contexts: []
+preferences: {}
+ports: [80, "443", {name: http}]
+empty:
+note: |
+  line one
+  line two
+
+folded: >-
+  one
+  two
+
+  three
+`
+	want := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Config",
+		"clusters": []interface{}{
+			map[string]interface{}{
+				"cluster": map[string]interface{}{
+					"server":                   "https://127.0.0.1:6443",
+					"insecure-skip-tls-verify": true,
+				},
+				"name": "local",
+			},
+		},
+		"users": []interface{}{
+			map[string]interface{}{
+				"name": "dev's",
+				"user": map[string]interface{}{"token": "abc#def"},
+			},
+		},
+		"contexts":    []interface{}{},
+		"preferences": map[string]interface{}{},
+		"ports":       []interface{}{Number("80"), "443", map[string]interface{}{"name": "http"}},
+		"empty":       nil,
+		"note":        "line one\nline two\n",
+		"folded":      "one two\nthree",
+	}
+
+	have, err := Parse([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want %#v, have %#v", want, have)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	var v struct {
+		Name  string `json:"name"`
+		Port  int    `json:"port"`
+		Hosts []struct {
+			Addr   string `json:"addr"`
+			Weight int    `json:"weight"`
+		} `json:"hosts"`
+	}
+	doc := "name: users\nport: 8080\nhosts:\n  - addr: 10.0.0.1:80\n    weight: 3\n  - addr: 10.0.0.2:80\n"
+	if err := Unmarshal([]byte(doc), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "users" || v.Port != 8080 || len(v.Hosts) != 2 || v.Hosts[0].Addr != "10.0.0.1:80" || v.Hosts[0].Weight != 3 {
+		t.Errorf("unexpected result %+v", v)
+	}
+}
+
+func TestUnmarshalNumbers(t *testing.T) {
+	var v struct {
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+		Labels map[string]string `json:"labels"`
+		Scale  float64           `json:"scale"`
+		Mode   int               `json:"mode"`
+		Any    interface{}       `json:"any"`
+	}
+	doc := "ports:\n  - name: 8080\n    port: 8080\nlabels:\n  version: 1.10\n  build: 0x1F\nscale: 1.5\nmode: 0o644\nany: 3\n"
+	if err := Unmarshal([]byte(doc), &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Ports) != 1 || v.Ports[0].Name != "8080" || v.Ports[0].Port != 8080 {
+		t.Errorf("ports: unexpected result %+v", v.Ports)
+	}
+	if want, have := map[string]string{"version": "1.10", "build": "0x1F"}, v.Labels; !reflect.DeepEqual(want, have) {
+		t.Errorf("labels: want %v, have %v", want, have)
+	}
+	if v.Scale != 1.5 || v.Mode != 0644 || v.Any != float64(3) {
+		t.Errorf("unexpected result %+v", v)
+	}
+}
+
+func TestNumber(t *testing.T) {
+	for _, tc := range []struct {
+		n    Number
+		want float64
+	}{
+		{"10", 10},
+		{"010", 10},
+		{"0x1F", 31},
+		{"0o17", 15},
+		{"-1.5e3", -1500},
+		{"+.inf", math.Inf(1)},
+	} {
+		if have, err := tc.n.Float64(); err != nil || tc.want != have {
+			t.Errorf("%s: want %v, have %v (%v)", tc.n, tc.want, have, err)
+		}
+	}
+	for _, s := range []string{"Inf", "NaN", "1.2.3", "0x"} {
+		if v, _ := Parse([]byte("a: " + s)); !reflect.DeepEqual(map[string]interface{}{"a": s}, v) {
+			t.Errorf("%q: want a string, have %#v", s, v)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, doc := range []string{
+		"a: 1\n  b: 2\n",
+		"a: 1\na: 2\n",
+		"a: \"unterminated\n",
+		"a: *alias\n",
+		"a: [1, 2\n",
+	} {
+		if _, err := Parse([]byte(doc)); err == nil {
+			t.Errorf("%q: want error, have none", doc)
+		}
+	}
+}
@@ -0,0 +1,646 @@
+package resolve
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve/internal/yaml"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Kubernetes returns a resolver that reads discovery.k8s.io/v1 EndpointSlices
+// from the Kubernetes API. By default, it uses the in-cluster service account
+// credentials; use KubeConfig to connect with a kubeconfig file instead.
+//
+// Names have the form service.namespace, optionally prefixed with the port
+// name and protocol in the style of Kubernetes SRV records, as in
+// _http._tcp.service.namespace. A trailing .svc or .svc.cluster.local is
+// ignored. If the namespace is omitted, the namespace of the credentials is
+// used. If the port name is omitted, the service must have a single port, or
+// an unnamed one. Only ready endpoints are returned. Each address becomes an
+// Endpoint, labeled with its "zone" and "node", when known.
+func Kubernetes(options ...KubernetesOption) (*KubernetesResolver, error) {
+	r := &KubernetesResolver{
+		ttl: 5 * time.Second,
+	}
+	r.setOptions(options...)
+
+	var err error
+	if r.kubeconfig == "" {
+		err = r.loadInCluster()
+	} else {
+		err = r.loadKubeConfig(r.kubeconfig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %v", err)
+	}
+	return r, nil
+}
+
+// KubernetesOption sets a specific option for the Kubernetes resolver. This
+// is the functional options idiom.
+type KubernetesOption func(*KubernetesResolver)
+
+// KubeConfig connects using the current context of the kubeconfig file at
+// path, rather than in-cluster credentials.
+func KubeConfig(path string) KubernetesOption {
+	return func(r *KubernetesResolver) { r.kubeconfig = path }
+}
+
+// KubernetesTTL sets the TTL returned by Resolve. If KubernetesTTL isn't
+// provided, a default value of 5 seconds is used.
+func KubernetesTTL(d time.Duration) KubernetesOption {
+	return func(r *KubernetesResolver) { r.ttl = d }
+}
+
+// KubernetesResolver resolves names via Kubernetes EndpointSlices. It's both
+// a Resolver and a Watcher, so pool.Stream picks up changes immediately.
+type KubernetesResolver struct {
+	kubeconfig string
+	ttl        time.Duration
+	server     string
+	namespace  string
+	token      string
+	tokenFile  string
+	client     *http.Client
+}
+
+func (r *KubernetesResolver) setOptions(options ...KubernetesOption) {
+	for _, f := range options {
+		f(r)
+	}
+}
+
+// Resolve implements Resolver with a single list of the service's
+// EndpointSlices.
+func (r *KubernetesResolver) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return r.ResolveContext(context.Background(), name)
+}
+
+// ResolveContext is Resolve, with the list request bound to ctx.
+func (r *KubernetesResolver) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	svc, err := r.parseName(name)
+	if err != nil {
+		return []Endpoint{}, 0, err
+	}
+	slices, _, err := r.list(ctx, svc)
+	if err != nil {
+		return []Endpoint{}, 0, err
+	}
+	endpoints, err := svc.endpoints(slices)
+	if err != nil {
+		return []Endpoint{}, 0, err
+	}
+	return endpoints, r.ttl, nil
+}
+
+// Watch returns a channel of updates for the named service, driven by a
+// Kubernetes watch on its EndpointSlices. The first update is sent after the
+// initial list; subsequent updates are only sent when the set of endpoints
+// changes, or when the API fails, in which case Watch backs off and relists,
+// and sends the next result even if it's unchanged. When the server ends a
+// watch cleanly, Watch resumes it, after backing off if it ended without
+// delivering an event. Close done to stop watching; the channel is closed
+// after that.
+func (r *KubernetesResolver) Watch(name string, done <-chan struct{}) <-chan Update {
+	var (
+		c           = make(chan Update)
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+	go func() {
+		<-done
+		cancel()
+	}()
+	go func() {
+		defer close(c)
+
+		send := func(u Update) bool {
+			select {
+			case c <- u:
+				return true
+			case <-done:
+				return false
+			}
+		}
+
+		svc, err := r.parseName(name)
+		if err != nil {
+			send(Update{Err: err})
+			<-done
+			return
+		}
+
+		var (
+			changes changeFilter
+			backoff time.Duration
+		)
+		emit := func(slices map[string]endpointSlice) bool {
+			endpoints, err := svc.endpoints(slices)
+			if err != nil {
+				changes.fail()
+				return send(Update{Err: err})
+			}
+			if !changes.changed(endpoints) {
+				return true
+			}
+			return send(Update{Endpoints: endpoints})
+		}
+		pause := func() bool {
+			backoff = nextBackoff(backoff)
+			select {
+			case <-time.After(backoff):
+				return true
+			case <-done:
+				return false
+			}
+		}
+		fail := func(err error) bool {
+			changes.fail()
+			return send(Update{Err: err}) && pause()
+		}
+
+		for {
+			slices, rv, err := r.list(ctx, svc)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				if !fail(err) {
+					return
+				}
+				continue
+			}
+			if !emit(slices) {
+				return
+			}
+
+			for {
+				received, err := r.watch(ctx, svc, &rv, slices, emit)
+				if ctx.Err() != nil {
+					return
+				}
+				if received {
+					backoff = 0
+				}
+				if err == nil {
+					// The server ended the watch; resume it, but don't hammer
+					// a server that ends them straight away.
+					if !received && !pause() {
+						return
+					}
+					continue
+				}
+				if err != errResourceGone && !fail(err) {
+					return
+				}
+				break // relist
+			}
+		}
+	}()
+	return c
+}
+
+// errResourceGone means a watch's resource version is too old, and the
+// caller must relist.
+var errResourceGone = errors.New("resource version too old")
+
+// list fetches all EndpointSlices of the service, keyed by slice name, and
+// returns the resource version to watch from.
+func (r *KubernetesResolver) list(ctx context.Context, svc kubernetesService) (map[string]endpointSlice, string, error) {
+	resp, err := r.get(ctx, svc, url.Values{})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []endpointSlice `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", fmt.Errorf("kubernetes: %s: %v", svc, err)
+	}
+
+	slices := make(map[string]endpointSlice, len(list.Items))
+	for _, s := range list.Items {
+		slices[s.Metadata.Name] = s
+	}
+	return slices, list.Metadata.ResourceVersion, nil
+}
+
+// watch applies watch events to slices, calling emit after each change, until
+// the server ends the watch or an error occurs. It keeps rv up to date so the
+// watch can be resumed, and reports whether any event was received.
+func (r *KubernetesResolver) watch(ctx context.Context, svc kubernetesService, rv *string, slices map[string]endpointSlice, emit func(map[string]endpointSlice) bool) (received bool, err error) {
+	resp, err := r.get(ctx, svc, url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {*rv},
+		"allowWatchBookmarks": {"true"},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			if err == io.EOF {
+				return received, nil
+			}
+			return received, fmt.Errorf("kubernetes: %s: %v", svc, err)
+		}
+
+		if event.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return received, errResourceGone
+			}
+			return received, fmt.Errorf("kubernetes: %s: watch error: %s", svc, status.Message)
+		}
+
+		var s endpointSlice
+		if err := json.Unmarshal(event.Object, &s); err != nil {
+			return received, fmt.Errorf("kubernetes: %s: %v", svc, err)
+		}
+		if s.Metadata.ResourceVersion != "" {
+			*rv = s.Metadata.ResourceVersion
+		}
+		received = true
+
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			slices[s.Metadata.Name] = s
+		case "DELETED":
+			delete(slices, s.Metadata.Name)
+		default:
+			continue // BOOKMARK, or something new
+		}
+		if !emit(slices) {
+			return received, ctx.Err()
+		}
+	}
+}
+
+func (r *KubernetesResolver) get(ctx context.Context, svc kubernetesService, q url.Values) (*http.Response, error) {
+	q.Set("labelSelector", "kubernetes.io/service-name="+svc.name)
+	u := r.server + "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(svc.namespace) + "/endpointslices?" + q.Encode()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	token := r.token
+	if r.tokenFile != "" {
+		// Bound service account tokens are rotated, so always use the
+		// latest one.
+		b, err := ioutil.ReadFile(r.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes: %v", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return nil, errResourceGone
+		}
+		return nil, fmt.Errorf("kubernetes: %s: HTTP %d %s", svc, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return resp, nil
+}
+
+func (r *KubernetesResolver) loadInCluster() error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return errors.New("not running in a cluster (KUBERNETES_SERVICE_HOST/PORT not set)")
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return err
+	}
+	namespace, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, err := newTLSConfig(ca, nil, nil, false, "")
+	if err != nil {
+		return err
+	}
+	r.server = "https://" + net.JoinHostPort(host, port)
+	r.namespace = strings.TrimSpace(string(namespace))
+	r.tokenFile = filepath.Join(serviceAccountDir, "token")
+	r.client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}}
+	return nil
+}
+
+func (r *KubernetesResolver) loadKubeConfig(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg struct {
+		CurrentContext string `json:"current-context"`
+		Contexts       []struct {
+			Name    string `json:"name"`
+			Context struct {
+				Cluster   string `json:"cluster"`
+				User      string `json:"user"`
+				Namespace string `json:"namespace"`
+			} `json:"context"`
+		} `json:"contexts"`
+		Clusters []struct {
+			Name    string `json:"name"`
+			Cluster struct {
+				Server                   string `json:"server"`
+				CertificateAuthority     string `json:"certificate-authority"`
+				CertificateAuthorityData string `json:"certificate-authority-data"`
+				InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+				TLSServerName            string `json:"tls-server-name"`
+			} `json:"cluster"`
+		} `json:"clusters"`
+		Users []struct {
+			Name string `json:"name"`
+			User struct {
+				Token                 string `json:"token"`
+				TokenFile             string `json:"tokenFile"`
+				ClientCertificate     string `json:"client-certificate"`
+				ClientCertificateData string `json:"client-certificate-data"`
+				ClientKey             string `json:"client-key"`
+				ClientKeyData         string `json:"client-key-data"`
+			} `json:"user"`
+		} `json:"users"`
+	}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	var (
+		dir         = filepath.Dir(path)
+		clusterName string
+		userName    string
+	)
+	r.namespace = "default"
+	for _, c := range cfg.Contexts {
+		if c.Name == cfg.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+			if c.Context.Namespace != "" {
+				r.namespace = c.Context.Namespace
+			}
+		}
+	}
+	if clusterName == "" {
+		return fmt.Errorf("%s: current context %q not found", path, cfg.CurrentContext)
+	}
+
+	var (
+		ca, cert, key []byte
+		insecure      bool
+		serverName    string
+	)
+	for _, c := range cfg.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		r.server = strings.TrimRight(c.Cluster.Server, "/")
+		insecure, serverName = c.Cluster.InsecureSkipTLSVerify, c.Cluster.TLSServerName
+		if ca, err = fileOrData(dir, c.Cluster.CertificateAuthority, c.Cluster.CertificateAuthorityData); err != nil {
+			return err
+		}
+	}
+	if r.server == "" {
+		return fmt.Errorf("%s: cluster %q not found", path, clusterName)
+	}
+
+	for _, u := range cfg.Users {
+		if u.Name != userName {
+			continue
+		}
+		r.token = u.User.Token
+		if u.User.TokenFile != "" {
+			r.tokenFile = resolvePath(dir, u.User.TokenFile)
+		}
+		if cert, err = fileOrData(dir, u.User.ClientCertificate, u.User.ClientCertificateData); err != nil {
+			return err
+		}
+		if key, err = fileOrData(dir, u.User.ClientKey, u.User.ClientKeyData); err != nil {
+			return err
+		}
+	}
+
+	tlsConfig, err := newTLSConfig(ca, cert, key, insecure, serverName)
+	if err != nil {
+		return err
+	}
+	r.client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}}
+	return nil
+}
+
+// fileOrData returns the base64-decoded data if it's set, or else the
+// contents of the file, relative to dir, if that's set.
+func fileOrData(dir, file, data string) ([]byte, error) {
+	switch {
+	case data != "":
+		return base64.StdEncoding.DecodeString(data)
+	case file != "":
+		return ioutil.ReadFile(resolvePath(dir, file))
+	default:
+		return nil, nil
+	}
+}
+
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func newTLSConfig(ca, cert, key []byte, insecure bool, serverName string) (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: insecure, ServerName: serverName}
+	if len(ca) > 0 {
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no valid certificates in certificate authority")
+		}
+	}
+	if len(cert) > 0 || len(key) > 0 {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{pair}
+	}
+	return c, nil
+}
+
+// kubernetesService is a parsed name.
+type kubernetesService struct {
+	name      string
+	namespace string
+	port      string // port name, or empty
+	protocol  string // upper case, or empty
+}
+
+func (s kubernetesService) String() string {
+	return s.name + "." + s.namespace
+}
+
+func (r *KubernetesResolver) parseName(name string) (kubernetesService, error) {
+	var svc kubernetesService
+	n := strings.TrimSuffix(name, ".")
+	for _, suffix := range []string{".svc.cluster.local", ".svc"} {
+		n = strings.TrimSuffix(n, suffix)
+	}
+
+	labels := strings.Split(n, ".")
+	if len(labels) >= 2 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_") {
+		svc.port = labels[0][1:]
+		svc.protocol = strings.ToUpper(labels[1][1:])
+		labels = labels[2:]
+	}
+
+	switch len(labels) {
+	case 1:
+		svc.name, svc.namespace = labels[0], r.namespace
+	case 2:
+		svc.name, svc.namespace = labels[0], labels[1]
+	default:
+		return svc, fmt.Errorf("kubernetes: %q isn't of the form [_port._proto.]service[.namespace]", name)
+	}
+	if svc.name == "" || svc.namespace == "" {
+		return svc, fmt.Errorf("kubernetes: %q isn't of the form [_port._proto.]service[.namespace]", name)
+	}
+	return svc, nil
+}
+
+// endpoints converts the ready endpoints of the slices to Endpoints on the
+// selected port.
+func (s kubernetesService) endpoints(slices map[string]endpointSlice) ([]Endpoint, error) {
+	var (
+		endpoints = []Endpoint{}
+		seen      = map[string]bool{}
+	)
+	for _, slice := range slices {
+		port, err := s.selectPort(slice.Ports)
+		if err != nil {
+			return nil, err
+		}
+		if port == 0 {
+			continue
+		}
+		for _, e := range slice.Endpoints {
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+			var labels map[string]string
+			for k, v := range map[string]string{"zone": e.Zone, "node": e.NodeName} {
+				if v == "" {
+					continue
+				}
+				if labels == nil {
+					labels = map[string]string{}
+				}
+				labels[k] = v
+			}
+			for _, addr := range e.Addresses {
+				endpoint := Endpoint{Address: addr, Port: port, Labels: labels}
+				if key := endpoint.String(); !seen[key] {
+					seen[key] = true
+					endpoints = append(endpoints, endpoint)
+				}
+			}
+		}
+	}
+	sortEndpoints(endpoints)
+	return endpoints, nil
+}
+
+// selectPort picks the port number for the service from a slice's ports. It
+// returns zero if the slice doesn't carry the port.
+func (s kubernetesService) selectPort(ports []endpointPort) (uint16, error) {
+	var candidates []endpointPort
+	for _, p := range ports {
+		if p.Port == nil {
+			continue
+		}
+		if s.protocol != "" && p.Protocol != "" && !strings.EqualFold(p.Protocol, s.protocol) {
+			continue
+		}
+		if s.port != "" && p.Name != s.port {
+			continue
+		}
+		candidates = append(candidates, p)
+	}
+
+	switch {
+	case len(candidates) == 1:
+		return uint16(*candidates[0].Port), nil
+	case len(candidates) == 0:
+		return 0, nil
+	}
+	for _, p := range candidates {
+		if p.Name == "" {
+			return uint16(*p.Port), nil
+		}
+	}
+	return 0, fmt.Errorf("kubernetes: %s has multiple ports; name one as _port._proto.%s", s, s)
+}
+
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+		NodeName string `json:"nodeName"`
+		Zone     string `json:"zone"`
+	} `json:"endpoints"`
+	Ports []endpointPort `json:"ports"`
+}
+
+type endpointPort struct {
+	Name     string `json:"name"`
+	Port     *int32 `json:"port"`
+	Protocol string `json:"protocol"`
+}
@@ -0,0 +1,293 @@
+package resolve_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestKubernetesResolve(t *testing.T) {
+	api := newFakeKubernetes()
+	api.slices["users-abc"] = slice("users-abc", "1", []port{{"http", 8080}, {"metrics", 9090}},
+		ep{"10.0.0.1", true, "us-east-1a"},
+		ep{"10.0.0.2", false, "us-east-1b"},
+	)
+	s := httptest.NewServer(api)
+	defer s.Close()
+
+	r, err := resolve.Kubernetes(resolve.KubeConfig(writeKubeConfig(t, s.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoints, _, err := r.Resolve("_http._tcp.users.prod.svc.cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resolve.Endpoint{{Address: "10.0.0.1", Port: 8080, Labels: map[string]string{"zone": "us-east-1a", "node": "node-1"}}}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+
+	req := api.lastRequest()
+	if want, have := "/apis/discovery.k8s.io/v1/namespaces/prod/endpointslices", req.URL.Path; want != have {
+		t.Errorf("want path %q, have %q", want, have)
+	}
+	if want, have := "kubernetes.io/service-name=users", req.URL.Query().Get("labelSelector"); want != have {
+		t.Errorf("want selector %q, have %q", want, have)
+	}
+	if want, have := "Bearer s3cr3t", req.Header.Get("Authorization"); want != have {
+		t.Errorf("want auth %q, have %q", want, have)
+	}
+
+	// With two named ports, the port must be given.
+	if _, _, err := r.Resolve("users"); err == nil {
+		t.Error("want error for ambiguous port, have none")
+	}
+}
+
+func TestKubernetesWatch(t *testing.T) {
+	api := newFakeKubernetes()
+	api.slices["users-abc"] = slice("users-abc", "1", []port{{"", 80}}, ep{"10.0.0.1", true, ""})
+	s := httptest.NewServer(api)
+	defer s.Close()
+
+	r, err := resolve.Kubernetes(resolve.KubeConfig(writeKubeConfig(t, s.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	updates := r.Watch("users", done)
+
+	u := recvUpdate(t, updates)
+	if want, have := []string{"10.0.0.1:80"}, resolve.Hosts(u.Endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	<-api.watching
+	api.event("ADDED", slice("users-def", "2", []port{{"", 80}}, ep{"10.0.0.2", true, ""}))
+	u = recvUpdate(t, updates)
+	if want, have := []string{"10.0.0.1:80", "10.0.0.2:80"}, resolve.Hosts(u.Endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	api.event("DELETED", slice("users-abc", "3", nil))
+	u = recvUpdate(t, updates)
+	if want, have := []string{"10.0.0.2:80"}, resolve.Hosts(u.Endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestKubernetesWatchRecovery(t *testing.T) {
+	// The watch fails, and the relist returns what the first list did, which
+	// must be sent anyway, so the error is known to be over.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "true" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"type":   "ERROR",
+				"object": map[string]interface{}{"code": 500, "message": "etcd unavailable"},
+			})
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"metadata": map[string]interface{}{"resourceVersion": "1"},
+			"items":    []interface{}{slice("users-abc", "1", []port{{"", 80}}, ep{"10.0.0.1", true, ""})},
+		})
+	}))
+	defer s.Close()
+
+	r, err := resolve.Kubernetes(resolve.KubeConfig(writeKubeConfig(t, s.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	updates := r.Watch("users", done)
+
+	recvUpdate(t, updates)
+	select {
+	case u := <-updates:
+		if u.Err == nil {
+			t.Errorf("want error, have %+v", u)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for update")
+	}
+	if u := recvUpdate(t, updates); !reflect.DeepEqual([]string{"10.0.0.1:80"}, resolve.Hosts(u.Endpoints)) {
+		t.Errorf("have %+v", u)
+	}
+}
+
+func TestKubernetesWatchBackoff(t *testing.T) {
+	// A server that ends each watch at once, without an event, mustn't be
+	// hammered with new ones.
+	var (
+		mtx     sync.Mutex
+		watches int
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "true" {
+			mtx.Lock()
+			watches++
+			mtx.Unlock()
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"metadata": map[string]interface{}{"resourceVersion": "1"},
+			"items":    []interface{}{slice("users-abc", "1", []port{{"", 80}}, ep{"10.0.0.1", true, ""})},
+		})
+	}))
+	defer s.Close()
+
+	r, err := resolve.Kubernetes(resolve.KubeConfig(writeKubeConfig(t, s.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	updates := r.Watch("users", done)
+	recvUpdate(t, updates)
+	time.Sleep(500 * time.Millisecond)
+	close(done)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if watches > 5 {
+		t.Errorf("want at most 5 watches, have %d", watches)
+	}
+}
+
+func writeKubeConfig(t *testing.T, server string) string {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: test
+contexts:
+- name: test
+  context:
+    cluster: fake
+    user: tester
+    namespace: prod
+clusters:
+- name: fake
+  cluster:
+    server: %s
+users:
+- name: tester
+  user:
+    token: s3cr3t
+`, server)
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type port struct {
+	name string
+	port int32
+}
+
+type ep struct {
+	addr  string
+	ready bool
+	zone  string
+}
+
+func slice(name, rv string, ports []port, endpoints ...ep) map[string]interface{} {
+	var ps, es []interface{}
+	for _, p := range ports {
+		ps = append(ps, map[string]interface{}{"name": p.name, "port": p.port, "protocol": "TCP"})
+	}
+	for _, e := range endpoints {
+		es = append(es, map[string]interface{}{
+			"addresses":  []string{e.addr},
+			"conditions": map[string]interface{}{"ready": e.ready},
+			"nodeName":   "node-1",
+			"zone":       e.zone,
+		})
+	}
+	return map[string]interface{}{
+		"metadata":  map[string]interface{}{"name": name, "resourceVersion": rv},
+		"endpoints": es,
+		"ports":     ps,
+	}
+}
+
+// fakeKubernetes serves EndpointSlice lists and watches. Events passed to
+// event are delivered to any open watch.
+type fakeKubernetes struct {
+	mtx      sync.Mutex
+	slices   map[string]map[string]interface{}
+	watches  []chan []byte
+	watching chan struct{}
+	last     *http.Request
+}
+
+func newFakeKubernetes() *fakeKubernetes {
+	return &fakeKubernetes{
+		slices:   map[string]map[string]interface{}{},
+		watching: make(chan struct{}, 16),
+	}
+}
+
+func (k *fakeKubernetes) lastRequest() *http.Request {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	return k.last
+}
+
+func (k *fakeKubernetes) event(typ string, object map[string]interface{}) {
+	b, _ := json.Marshal(map[string]interface{}{"type": typ, "object": object})
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	for _, w := range k.watches {
+		w <- append(b, '\n')
+	}
+}
+
+func (k *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mtx.Lock()
+	k.last = r
+	if r.URL.Query().Get("watch") != "true" {
+		items := []interface{}{}
+		for _, s := range k.slices {
+			items = append(items, s)
+		}
+		k.mtx.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"metadata": map[string]interface{}{"resourceVersion": "1"},
+			"items":    items,
+		})
+		return
+	}
+
+	events := make(chan []byte, 16)
+	k.watches = append(k.watches, events)
+	k.mtx.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	k.watching <- struct{}{}
+	for {
+		select {
+		case b := <-events:
+			w.Write(b)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package resolve
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+// Metrics receives measurements of the resolution of names. Implementations
+// must be safe for concurrent use. Instrument records lookups and updates,
+// and pool.Stream records changes, with the Metrics option.
+type Metrics interface {
+	// Lookup records a lookup of name, which took d, and resolved to the
+	// endpoints, or failed with err. Use ErrorKind to classify err.
+	Lookup(name string, d time.Duration, endpoints []Endpoint, err error)
+
+	// Update records an update yielded by a Watcher for name, with the
+	// endpoints, or the error err. Updates arrive whenever the source pushes
+	// them, so unlike lookups they have no duration.
+	Update(name string, endpoints []Endpoint, err error)
+
+	// Change records a change to the endpoints of name, relative to the
+	// previous ones: the number of hosts added and removed, and the new
+	// number of endpoints.
+	Change(name string, added, removed, total int)
+}
+
+// SourceMetrics is implemented by Metrics that also record the failures of
+// the sources of Fallback and Union, which Lookup doesn't see when another
+// source answers. Instrument passes them to the Fallbacks and Unions it
+// wraps, directly or via other resolvers that pass on the context.
+type SourceMetrics interface {
+	Metrics
+
+	// SourceError records that source failed to resolve name with err.
+	SourceError(name, source string, err error)
+}
+
+// Kinds of resolution errors, as returned by ErrorKind.
+const (
+	ErrorKindBogus     = "bogus"
+	ErrorKindTimeout   = "timeout"
+	ErrorKindCanceled  = "canceled"
+	ErrorKindNotFound  = "not_found"
+	ErrorKindTemporary = "temporary"
+	ErrorKindOther     = "other"
+)
+
+// ErrorKind classifies a resolution error, for metrics: it returns one of
+// the ErrorKind constants, or the empty string if err is nil. Aggregate
+// errors, like SearchError, are classified by all of their errors, with the
+// kinds checked in the order they're declared.
+func ErrorKind(err error) string {
+	var (
+		bogus  *BogusError
+		netErr net.Error
+	)
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &bogus):
+		return ErrorKindBogus
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorKindTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorKindCanceled
+	case hasDNSError(err, func(e *net.DNSError) bool { return e.IsTimeout }):
+		return ErrorKindTimeout
+	case hasDNSError(err, func(e *net.DNSError) bool { return e.IsNotFound }):
+		return ErrorKindNotFound
+	case hasDNSError(err, func(e *net.DNSError) bool { return e.IsTemporary }):
+		return ErrorKindTemporary
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorKindTimeout
+	default:
+		return ErrorKindOther
+	}
+}
+
+// hasDNSError returns true if err, or any error it wraps, is a *net.DNSError
+// for which f returns true. Unlike errors.As, it doesn't stop at the first.
+func hasDNSError(err error, f func(*net.DNSError) bool) bool {
+	if e, ok := err.(*net.DNSError); ok && f(e) {
+		return true
+	}
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return hasDNSError(e.Unwrap(), f)
+	case interface{ Unwrap() []error }:
+		for _, err := range e.Unwrap() {
+			if hasDNSError(err, f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Instrument returns a Resolver that records each lookup made through r with
+// m. If r is a Watcher, so is the returned Resolver, and each update it
+// yields is recorded with Update. If m is a SourceMetrics,
+// failed sources of Fallback and Union are recorded as well.
+func Instrument(r Resolver, m Metrics) ContextResolver {
+	i := instrument{WithContext(r), m}
+	if w, ok := r.(Watcher); ok {
+		return instrumentWatcher{i, w}
+	}
+	return i
+}
+
+type instrument struct {
+	r ContextResolver
+	m Metrics
+}
+
+func (i instrument) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return i.ResolveContext(context.Background(), name)
+}
+
+func (i instrument) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	if m, ok := i.m.(SourceMetrics); ok {
+		ctx = context.WithValue(ctx, sourceMetricsKey{}, m)
+	}
+	begin := time.Now()
+	endpoints, ttl, err := i.r.ResolveContext(ctx, name)
+	i.m.Lookup(name, time.Since(begin), endpoints, err)
+	return endpoints, ttl, err
+}
+
+type instrumentWatcher struct {
+	instrument
+	w Watcher
+}
+
+func (i instrumentWatcher) Watch(name string, done <-chan struct{}) <-chan Update {
+	var (
+		in  = i.w.Watch(name, done)
+		out = make(chan Update)
+	)
+	go func() {
+		defer close(out)
+		for u := range in {
+			i.m.Update(name, u.Endpoints, u.Err)
+			select {
+			case out <- u:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// ExpvarKeyResolve is the key name for the expvar that captures resolution
+// metrics recorded by Expvar. Pass it to expvar.Get to inspect current
+// statistics.
+const ExpvarKeyResolve = "srvproxy_resolve"
+
+// Expvar is a SourceMetrics that publishes to the expvar map ExpvarKeyResolve.
+// The map is keyed by name, and each name is a map of:
+//
+//	lookups          count of lookups
+//	lookup_seconds   total duration of lookups
+//	last_lookup      duration of the last lookup, in seconds
+//	updates          count of updates from watches
+//	errors           count of failed lookups and updates, by ErrorKind
+//	last_success     time of the last successful lookup or update, in RFC 3339 form
+//	hosts            number of endpoints
+//	hosts_added      count of hosts added by changes
+//	hosts_removed    count of hosts removed by changes
+//	source_errors    count of failures of Fallback and Union sources, by source
+var Expvar SourceMetrics = &expvarMetrics{
+	names: expvar.NewMap(ExpvarKeyResolve),
+	vars:  map[string]expvarName{},
+}
+
+type expvarMetrics struct {
+	mtx   sync.Mutex
+	names *expvar.Map
+	vars  map[string]expvarName
+}
+
+type expvarName struct {
+	lookups, updates, hosts   *expvar.Int
+	added, removed            *expvar.Int
+	lookupSeconds, lastLookup *expvar.Float
+	errors, sourceErrors      *expvar.Map
+	lastSuccess               *expvar.String
+}
+
+func (m *expvarMetrics) Lookup(name string, d time.Duration, endpoints []Endpoint, err error) {
+	n := m.get(name)
+	n.lookups.Add(1)
+	n.lookupSeconds.Add(d.Seconds())
+	n.lastLookup.Set(d.Seconds())
+	n.result(endpoints, err)
+}
+
+func (m *expvarMetrics) Update(name string, endpoints []Endpoint, err error) {
+	n := m.get(name)
+	n.updates.Add(1)
+	n.result(endpoints, err)
+}
+
+// result records the outcome of a lookup or an update.
+func (n expvarName) result(endpoints []Endpoint, err error) {
+	if err != nil {
+		n.errors.Add(ErrorKind(err), 1)
+		return
+	}
+	n.lastSuccess.Set(time.Now().UTC().Format(time.RFC3339))
+	n.hosts.Set(int64(len(endpoints)))
+}
+
+func (m *expvarMetrics) SourceError(name, source string, _ error) {
+	m.get(name).sourceErrors.Add(source, 1)
+}
+
+func (m *expvarMetrics) Change(name string, added, removed, total int) {
+	n := m.get(name)
+	n.added.Add(int64(added))
+	n.removed.Add(int64(removed))
+	n.hosts.Set(int64(total))
+}
+
+// get returns the vars of name, publishing them if they're new.
+func (m *expvarMetrics) get(name string) expvarName {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if n, ok := m.vars[name]; ok {
+		return n
+	}
+	n := expvarName{
+		lookups:       new(expvar.Int),
+		updates:       new(expvar.Int),
+		hosts:         new(expvar.Int),
+		added:         new(expvar.Int),
+		removed:       new(expvar.Int),
+		lookupSeconds: new(expvar.Float),
+		lastLookup:    new(expvar.Float),
+		errors:        new(expvar.Map).Init(),
+		sourceErrors:  new(expvar.Map).Init(),
+		lastSuccess:   new(expvar.String),
+	}
+	v := new(expvar.Map).Init()
+	v.Set("lookups", n.lookups)
+	v.Set("lookup_seconds", n.lookupSeconds)
+	v.Set("last_lookup", n.lastLookup)
+	v.Set("updates", n.updates)
+	v.Set("errors", n.errors)
+	v.Set("last_success", n.lastSuccess)
+	v.Set("hosts", n.hosts)
+	v.Set("hosts_added", n.added)
+	v.Set("hosts_removed", n.removed)
+	v.Set("source_errors", n.sourceErrors)
+	m.names.Set(name, v)
+	m.vars[name] = n
+	return n
+}
@@ -0,0 +1,206 @@
+package resolve_test
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestInstrument(t *testing.T) {
+	var (
+		m   = &recordingMetrics{}
+		err error
+	)
+	r := resolve.Instrument(resolve.ResolverFunc(func(name string) ([]resolve.Endpoint, time.Duration, error) {
+		time.Sleep(time.Millisecond)
+		return resolve.ParseEndpoints([]string{"a", "b"}), time.Minute, err
+	}), m)
+
+	if _, _, err := r.Resolve("users"); err != nil {
+		t.Fatal(err)
+	}
+	err = &net.DNSError{Err: "no such host", Name: "orders", IsNotFound: true}
+	r.Resolve("orders")
+
+	if want, have := 2, len(m.lookups); want != have {
+		t.Fatalf("want %d lookups, have %d", want, have)
+	}
+	if l := m.lookups[0]; l.name != "users" || l.d < time.Millisecond || l.n != 2 || l.kind != "" {
+		t.Errorf("first lookup: have %+v", l)
+	}
+	if l := m.lookups[1]; l.name != "orders" || l.kind != resolve.ErrorKindNotFound {
+		t.Errorf("second lookup: have %+v", l)
+	}
+}
+
+func TestInstrumentWatcher(t *testing.T) {
+	// Updates are pushed, not looked up, so they must not be recorded as
+	// lookups, whose durations would be skewed by them.
+	var (
+		m       = &recordingMetrics{}
+		updates = make(chan resolve.Update, 2)
+		done    = make(chan struct{})
+	)
+	defer close(done)
+	updates <- resolve.Update{Endpoints: resolve.ParseEndpoints([]string{"a", "b"})}
+	updates <- resolve.Update{Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}
+	w := resolve.Instrument(fakeWatcher(updates), m).(resolve.Watcher)
+
+	c := w.Watch("users", done)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-c:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for update")
+		}
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if want, have := 0, len(m.lookups); want != have {
+		t.Errorf("want %d lookups, have %d", want, have)
+	}
+	want := []lookup{{name: "users", n: 2}, {name: "users", kind: resolve.ErrorKindTimeout}}
+	if !reflect.DeepEqual(want, m.updates) {
+		t.Errorf("want updates %+v, have %+v", want, m.updates)
+	}
+}
+
+// fakeWatcher is a Watcher that yields the updates of its channel.
+type fakeWatcher chan resolve.Update
+
+func (w fakeWatcher) Resolve(string) ([]resolve.Endpoint, time.Duration, error) {
+	return nil, 0, errors.New("not implemented")
+}
+
+func (w fakeWatcher) Watch(string, <-chan struct{}) <-chan resolve.Update {
+	return w
+}
+
+func TestErrorKind(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{errors.New("boom"), resolve.ErrorKindOther},
+		{context.DeadlineExceeded, resolve.ErrorKindTimeout},
+		{fmt.Errorf("exec: users: %w", context.Canceled), resolve.ErrorKindCanceled},
+		{&net.DNSError{IsTimeout: true}, resolve.ErrorKindTimeout},
+		{&net.DNSError{IsNotFound: true}, resolve.ErrorKindNotFound},
+		{&net.DNSError{IsTemporary: true}, resolve.ErrorKindTemporary},
+		{&resolve.BogusError{Name: "users", Type: "SRV"}, resolve.ErrorKindBogus},
+		{&resolve.SearchError{Errs: []error{&net.DNSError{IsNotFound: true}, &net.DNSError{IsTimeout: true}}}, resolve.ErrorKindTimeout},
+		{&resolve.FallbackError{Errs: []error{errors.New("boom"), &net.DNSError{IsTemporary: true}}}, resolve.ErrorKindTemporary},
+	} {
+		if have := resolve.ErrorKind(tc.err); tc.want != have {
+			t.Errorf("%v: want %q, have %q", tc.err, tc.want, have)
+		}
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	// Vars are global, so this test uses a name of its own, and compares
+	// against what was there before, for -count.
+	const name = "_http._tcp.expvar-test"
+	before := expvarInt(name, "lookups")
+	beforeUpdates := expvarInt(name, "updates")
+	beforeErrs := expvarInt(name, "errors", resolve.ErrorKindTimeout)
+	beforeAdded := expvarInt(name, "hosts_added")
+	beforeSource := expvarInt(name, "source_errors", "consul")
+
+	resolve.Expvar.Lookup(name, 10*time.Millisecond, resolve.ParseEndpoints([]string{"a", "b", "c"}), nil)
+	resolve.Expvar.Lookup(name, time.Second, nil, context.DeadlineExceeded)
+	resolve.Expvar.Update(name, resolve.ParseEndpoints([]string{"a", "b"}), nil)
+	resolve.Expvar.Change(name, 2, 1, 4)
+	resolve.Expvar.SourceError(name, "consul", errors.New("unreachable"))
+
+	if want, have := before+2, expvarInt(name, "lookups"); want != have {
+		t.Errorf("lookups: want %d, have %d", want, have)
+	}
+	if want, have := beforeUpdates+1, expvarInt(name, "updates"); want != have {
+		t.Errorf("updates: want %d, have %d", want, have)
+	}
+	if want, have := beforeErrs+1, expvarInt(name, "errors", resolve.ErrorKindTimeout); want != have {
+		t.Errorf("timeouts: want %d, have %d", want, have)
+	}
+	if want, have := beforeAdded+2, expvarInt(name, "hosts_added"); want != have {
+		t.Errorf("hosts_added: want %d, have %d", want, have)
+	}
+	if want, have := beforeSource+1, expvarInt(name, "source_errors", "consul"); want != have {
+		t.Errorf("source_errors: want %d, have %d", want, have)
+	}
+	if want, have := int64(4), expvarInt(name, "hosts"); want != have {
+		t.Errorf("hosts: want %d, have %d", want, have)
+	}
+	if want, have := "1", expvarVar(name, "last_lookup").String(); want != have {
+		t.Errorf("last_lookup: want %s, have %s", want, have)
+	}
+	s, _ := strconv.Unquote(expvarVar(name, "last_success").String())
+	if ts, err := time.Parse(time.RFC3339, s); err != nil || time.Since(ts) > time.Minute {
+		t.Errorf("last_success: have %q (%v)", s, err)
+	}
+}
+
+// expvarVar returns the var at the path under the map of name.
+func expvarVar(name string, path ...string) expvar.Var {
+	v := expvar.Get(resolve.ExpvarKeyResolve).(*expvar.Map).Get(name)
+	for _, key := range path {
+		m, ok := v.(*expvar.Map)
+		if !ok {
+			return nil
+		}
+		v = m.Get(key)
+	}
+	return v
+}
+
+func expvarInt(name string, path ...string) int64 {
+	if i, ok := expvarVar(name, path...).(*expvar.Int); ok {
+		return i.Value()
+	}
+	return 0
+}
+
+type lookup struct {
+	name string
+	d    time.Duration
+	n    int
+	kind string
+}
+
+type recordingMetrics struct {
+	mtx          sync.Mutex
+	lookups      []lookup
+	updates      []lookup
+	sourceErrors []string
+}
+
+func (m *recordingMetrics) Lookup(name string, d time.Duration, endpoints []resolve.Endpoint, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.lookups = append(m.lookups, lookup{name, d, len(endpoints), resolve.ErrorKind(err)})
+}
+
+func (m *recordingMetrics) Update(name string, endpoints []resolve.Endpoint, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.updates = append(m.updates, lookup{name: name, n: len(endpoints), kind: resolve.ErrorKind(err)})
+}
+
+func (m *recordingMetrics) SourceError(name, source string, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.sourceErrors = append(m.sourceErrors, name+" "+source+": "+err.Error())
+}
+
+func (m *recordingMetrics) Change(string, int, int, int) {}
@@ -0,0 +1,125 @@
+package resolve
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// OverridePrefix is the prefix of environment variables read by
+// OverridesFromEnv.
+const OverridePrefix = "SRVPROXY_OVERRIDE_"
+
+// Override returns a Resolver that answers from overrides, and asks base
+// about every name overrides doesn't know. A name is unknown to overrides if
+// it returns an error that's a *net.DNSError with IsNotFound set; other
+// errors are returned as-is. Overrides is typically an Overrides table, but
+// may be any Resolver, e.g. a file resolver for overrides that can be edited
+// at runtime.
+func Override(base, overrides Resolver) ContextResolver {
+	return override{WithContext(base), WithContext(overrides)}
+}
+
+type override struct {
+	base      ContextResolver
+	overrides ContextResolver
+}
+
+func (o override) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return o.ResolveContext(context.Background(), name)
+}
+
+func (o override) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	endpoints, ttl, err := o.overrides.ResolveContext(ctx, name)
+	if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+		return o.base.ResolveContext(ctx, name)
+	}
+	return endpoints, ttl, err
+}
+
+// Overrides is a static table of names to endpoints, like /etc/hosts for
+// SRV names. A name of the form "*.domain" is a wildcard, which matches every
+// name under the domain, at any depth. Exact names take precedence over
+// wildcards, and more specific wildcards over less specific ones. Names are
+// case-insensitive, and trailing dots are ignored.
+type Overrides map[string][]Endpoint
+
+// overrideTTL is the TTL returned for names in an Overrides table.
+const overrideTTL = time.Minute
+
+// Resolve implements Resolver.
+func (o Overrides) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	endpoints, ok := matchName(o, name)
+	if !ok {
+		return []Endpoint{}, 0, &net.DNSError{Err: "not overridden", Name: name, IsNotFound: true}
+	}
+	return copyEndpoints(endpoints), overrideTTL, nil
+}
+
+// ReadOverrides reads an Overrides table from a file in the same format as
+// File.
+func ReadOverrides(path string) (Overrides, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	names, err := parseFile(path, b)
+	if err != nil {
+		return nil, err
+	}
+	return Overrides(names), nil
+}
+
+// OverridesFromEnv builds an Overrides table from the environment, which is
+// typically os.Environ(). Each variable of the form
+// SRVPROXY_OVERRIDE_<name>=<host>[,<host>...] overrides the name with the
+// hosts, as parsed by ParseEndpoint. The name is taken verbatim, so names
+// with dots or wildcards must be set with a tool like env(1), rather than a
+// shell.
+func OverridesFromEnv(environ []string) Overrides {
+	o := Overrides{}
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, OverridePrefix) {
+			continue
+		}
+		kv = strings.TrimPrefix(kv, OverridePrefix)
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			continue
+		}
+		var hosts []string
+		for _, host := range strings.Split(kv[i+1:], ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+		endpoints := ParseEndpoints(hosts)
+		sortEndpoints(endpoints)
+		o[kv[:i]] = endpoints
+	}
+	return o
+}
+
+// matchName finds name in a table whose keys may be wildcards; see
+// Overrides.
+func matchName(table map[string][]Endpoint, name string) ([]Endpoint, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var (
+		endpoints []Endpoint
+		best      = -1 // length of the best wildcard domain so far
+	)
+	for key, e := range table {
+		key = strings.ToLower(strings.TrimSuffix(key, "."))
+		switch {
+		case key == name:
+			return e, true
+		case key == "*" && best < 0:
+			endpoints, best = e, 0
+		case strings.HasPrefix(key, "*.") && strings.HasSuffix(name, key[1:]) && len(key) > best:
+			endpoints, best = e, len(key)
+		}
+	}
+	return endpoints, best >= 0
+}
@@ -0,0 +1,39 @@
+package resolve_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestOverride(t *testing.T) {
+	base := fixed([]string{"dns:80"}, time.Second, nil)
+	overrides := resolve.OverridesFromEnv([]string{
+		"HOME=/root",
+		"SRVPROXY_OVERRIDE_users=127.0.0.1:8080",
+		"SRVPROXY_OVERRIDE_*.staging.internal=127.0.0.1:9000, 127.0.0.1:9001",
+		"SRVPROXY_OVERRIDE_*.db.staging.internal=127.0.0.1:5432",
+	})
+	r := resolve.Override(base, overrides)
+
+	for name, want := range map[string][]string{
+		"users":                    {"127.0.0.1:8080"},
+		"Users.":                   {"127.0.0.1:8080"},
+		"billing.staging.internal": {"127.0.0.1:9000", "127.0.0.1:9001"},
+		"a.b.staging.internal":     {"127.0.0.1:9000", "127.0.0.1:9001"},
+		"pg.db.staging.internal":   {"127.0.0.1:5432"},
+		"staging.internal":         {"dns:80"},
+		"billing":                  {"dns:80"},
+	} {
+		endpoints, _, err := r.Resolve(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if have := resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+			t.Errorf("%s: want %v, have %v", name, want, have)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package resolve
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResolvConf is the subset of resolv.conf(5) that the DNS resolver
+// understands. Pass it to the DNS resolver with FromResolvConf.
+type ResolvConf struct {
+	Nameservers []string      // addresses, with port 53 if none was given
+	Search      []string      // search list, tried in order for short names
+	Ndots       int           // names with fewer dots are searched first
+	Timeout     time.Duration // how long to wait for each nameserver
+	Attempts    int           // how many times to try the full nameserver list
+	Rotate      bool          // spread queries across nameservers
+}
+
+// ReadResolvConf parses the resolv.conf(5) file at path.
+func ReadResolvConf(path string) (*ResolvConf, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseResolvConf(f)
+}
+
+// ParseResolvConf parses resolv.conf(5) data. Unknown keywords and options
+// are ignored, and limits are clamped the same way as glibc. If no nameserver
+// is given, the local nameserver is used.
+func ParseResolvConf(r io.Reader) (*ResolvConf, error) {
+	c := &ResolvConf{
+		Ndots:    1,
+		Timeout:  5 * time.Second,
+		Attempts: 2,
+	}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			c.Nameservers = append(c.Nameservers, withPort(fields[1], "53"))
+
+		case "domain":
+			c.Search = []string{fields[1]}
+
+		case "search":
+			c.Search = append([]string{}, fields[1:]...)
+
+		case "options":
+			for _, opt := range fields[1:] {
+				switch {
+				case strings.HasPrefix(opt, "ndots:"):
+					c.Ndots = clamp(atoi(opt[6:], c.Ndots), 0, 15)
+				case strings.HasPrefix(opt, "timeout:"):
+					c.Timeout = time.Duration(clamp(atoi(opt[8:], 5), 1, 30)) * time.Second
+				case strings.HasPrefix(opt, "attempts:"):
+					c.Attempts = clamp(atoi(opt[9:], c.Attempts), 1, 5)
+				case opt == "rotate":
+					c.Rotate = true
+				}
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(c.Nameservers) <= 0 {
+		c.Nameservers = []string{"127.0.0.1:53", "[::1]:53"}
+	}
+	return c, nil
+}
+
+func atoi(s string, fallback int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
@@ -0,0 +1,53 @@
+package resolve_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	c, err := resolve.ParseResolvConf(strings.NewReader(`
+# generated by the container runtime
+nameserver 10.0.0.10
+nameserver fd00::53 ; secondary
+domain ignored.internal
+search default.svc.cluster.local svc.cluster.local cluster.local
+options ndots:5 timeout:1 attempts:9 rotate unknown:1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &resolve.ResolvConf{
+		Nameservers: []string{"10.0.0.10:53", "[fd00::53]:53"},
+		Search:      []string{"default.svc.cluster.local", "svc.cluster.local", "cluster.local"},
+		Ndots:       5,
+		Timeout:     time.Second,
+		Attempts:    5,
+		Rotate:      true,
+	}
+	if !reflect.DeepEqual(want, c) {
+		t.Errorf("want %+v, have %+v", want, c)
+	}
+}
+
+func TestParseResolvConfDefaults(t *testing.T) {
+	c, err := resolve.ParseResolvConf(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &resolve.ResolvConf{
+		Nameservers: []string{"127.0.0.1:53", "[::1]:53"},
+		Ndots:       1,
+		Timeout:     5 * time.Second,
+		Attempts:    2,
+	}
+	if !reflect.DeepEqual(want, c) {
+		t.Errorf("want %+v, have %+v", want, c)
+	}
+}
@@ -1,19 +1,151 @@
 package resolve
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // Resolver represents anything that can resolve an abstract name to a set of
-// hosts, inclusive ports when appropriate, and their TTL.
+// endpoints, and their TTL.
 type Resolver interface {
-	Resolve(name string) (hosts []string, ttl time.Duration, err error)
+	Resolve(name string) (endpoints []Endpoint, ttl time.Duration, err error)
 }
 
 // ResolverFunc is an adapter that allows use of ordinary functions as
 // Resolvers. If f is a function with the appropriate signature,
 // ResolverFunc(f) is a Resolver object that calls f.
-type ResolverFunc func(name string) (hosts []string, ttl time.Duration, err error)
+type ResolverFunc func(name string) (endpoints []Endpoint, ttl time.Duration, err error)
 
 // Resolve calls f(name).
-func (f ResolverFunc) Resolve(name string) (hosts []string, ttl time.Duration, err error) {
+func (f ResolverFunc) Resolve(name string) (endpoints []Endpoint, ttl time.Duration, err error) {
 	return f(name)
 }
+
+// ResolveContext calls f(name), and abandons it if ctx is done first.
+func (f ResolverFunc) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	return resolveAsync(ctx, f, name)
+}
+
+// ContextResolver represents a Resolver whose lookups can be bounded by a
+// context. Resolvers that do I/O should implement it, so that a slow or
+// unresponsive backend can be given up on.
+type ContextResolver interface {
+	Resolver
+	ResolveContext(ctx context.Context, name string) (endpoints []Endpoint, ttl time.Duration, err error)
+}
+
+// ContextResolverFunc is an adapter that allows use of ordinary functions as
+// ContextResolvers. If f is a function with the appropriate signature,
+// ContextResolverFunc(f) is a ContextResolver object that calls f.
+type ContextResolverFunc func(ctx context.Context, name string) (endpoints []Endpoint, ttl time.Duration, err error)
+
+// Resolve calls f(context.Background(), name).
+func (f ContextResolverFunc) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return f(context.Background(), name)
+}
+
+// ResolveContext calls f(ctx, name).
+func (f ContextResolverFunc) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	return f(ctx, name)
+}
+
+// WithContext converts a Resolver to a ContextResolver. If r is already a
+// ContextResolver, it's returned as-is. Otherwise, each lookup runs r.Resolve
+// in its own goroutine, and is abandoned if the context is done first. The
+// abandoned lookup keeps running until r returns, but its result is dropped.
+func WithContext(r Resolver) ContextResolver {
+	if cr, ok := r.(ContextResolver); ok {
+		return cr
+	}
+	return asyncResolver{r}
+}
+
+type asyncResolver struct{ Resolver }
+
+func (r asyncResolver) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	return resolveAsync(ctx, r.Resolver, name)
+}
+
+// Timeout returns a ContextResolver that bounds each lookup made through r
+// by d. Lookups that take longer fail with context.DeadlineExceeded. A
+// non-positive d disables the bound.
+func Timeout(r Resolver, d time.Duration) ContextResolver {
+	return timeoutResolver{WithContext(r), d}
+}
+
+type timeoutResolver struct {
+	next    ContextResolver
+	timeout time.Duration
+}
+
+func (r timeoutResolver) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return r.ResolveContext(context.Background(), name)
+}
+
+func (r timeoutResolver) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	return r.next.ResolveContext(ctx, name)
+}
+
+// resolveAsync runs r.Resolve(name) in a goroutine, and returns either its
+// result or, if ctx is done first, the context's error.
+func resolveAsync(ctx context.Context, r Resolver, name string) ([]Endpoint, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return []Endpoint{}, 0, err
+	}
+
+	type result struct {
+		endpoints []Endpoint
+		ttl       time.Duration
+		err       error
+	}
+	c := make(chan result, 1) // buffered, so an abandoned lookup can exit
+	go func() {
+		endpoints, ttl, err := r.Resolve(name)
+		c <- result{endpoints, ttl, err}
+	}()
+
+	select {
+	case res := <-c:
+		return res.endpoints, res.ttl, res.err
+	case <-ctx.Done():
+		return []Endpoint{}, 0, ctx.Err()
+	}
+}
+
+// HostResolver represents anything that can resolve an abstract name to a
+// set of hosts, inclusive ports when appropriate, and their TTL. It's the
+// string-based form of Resolver; wrap it with FromHosts to use it as one.
+type HostResolver interface {
+	Resolve(name string) (hosts []string, ttl time.Duration, err error)
+}
+
+// FromHosts converts a HostResolver to a Resolver. Each host is converted to
+// an Endpoint via ParseEndpoint.
+func FromHosts(r HostResolver) Resolver {
+	return HostsFunc(r.Resolve)
+}
+
+// HostsFunc is an adapter that allows use of ordinary functions that return
+// hosts as Resolvers. If f is a function with the appropriate signature,
+// HostsFunc(f) is a Resolver object that calls f and converts each host to an
+// Endpoint via ParseEndpoint.
+type HostsFunc func(name string) (hosts []string, ttl time.Duration, err error)
+
+// Resolve calls f(name).
+func (f HostsFunc) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	hosts, ttl, err := f(name)
+	if err != nil {
+		return []Endpoint{}, ttl, err
+	}
+	return ParseEndpoints(hosts), ttl, nil
+}
+
+// ResolveContext calls f(name), and abandons it if ctx is done first.
+func (f HostsFunc) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	return resolveAsync(ctx, f, name)
+}
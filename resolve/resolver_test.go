@@ -0,0 +1,57 @@
+package resolve_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestWithContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := resolve.ResolverFunc(func(string) ([]resolve.Endpoint, time.Duration, error) {
+		<-release
+		return []resolve.Endpoint{{Address: "a", Port: 80}}, time.Minute, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := resolve.WithContext(slow).ResolveContext(ctx, "irrelevant"); err != context.DeadlineExceeded {
+		t.Errorf("want %v, have %v", context.DeadlineExceeded, err)
+	}
+
+	fast := resolve.ContextResolverFunc(func(ctx context.Context, _ string) ([]resolve.Endpoint, time.Duration, error) {
+		return []resolve.Endpoint{{Address: "b", Port: 80}}, time.Minute, ctx.Err()
+	})
+	if _, ok := resolve.WithContext(fast).(resolve.ContextResolverFunc); !ok {
+		t.Error("want ContextResolvers passed through unchanged")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	calls := 0
+	r := resolve.HostsFunc(func(string) ([]string, time.Duration, error) {
+		if calls++; calls > 1 {
+			<-release
+		}
+		return []string{"a:80"}, time.Minute, nil
+	})
+	timeout := resolve.Timeout(r, 10*time.Millisecond)
+
+	endpoints, _, err := timeout.Resolve("irrelevant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"a:80"}, resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	if _, _, err := timeout.Resolve("irrelevant"); err != context.DeadlineExceeded {
+		t.Errorf("want %v, have %v", context.DeadlineExceeded, err)
+	}
+}
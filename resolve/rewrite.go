@@ -0,0 +1,123 @@
+package resolve
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Rule maps a name to the name that's actually resolved. It returns false if
+// it doesn't apply to the name.
+type Rule func(name string) (string, bool)
+
+// Template returns a Rule that expands short names, i.e. names without dots,
+// through tmpl. The placeholder {name} in tmpl is replaced by the name, and
+// every other placeholder by its value in vars. For example, with vars
+// service=http, proto=tcp and env=prod, the template
+//
+//	_{service}._{proto}.{name}.{env}.internal
+//
+// maps "users" to "_http._tcp.users.prod.internal". Placeholders without a
+// value are an error.
+func Template(tmpl string, vars map[string]string) (Rule, error) {
+	var (
+		parts []string // literals at even indices, placeholders at odd ones
+		rest  = tmpl
+	)
+	for {
+		i := strings.Index(rest, "{")
+		if i < 0 {
+			parts = append(parts, rest)
+			break
+		}
+		j := strings.Index(rest[i:], "}")
+		if j < 0 {
+			return nil, fmt.Errorf("template %q: unterminated placeholder", tmpl)
+		}
+		key := rest[i+1 : i+j]
+		if _, ok := vars[key]; !ok && key != "name" {
+			return nil, fmt.Errorf("template %q: no value for {%s}", tmpl, key)
+		}
+		parts = append(parts, rest[:i], key)
+		rest = rest[i+j+1:]
+	}
+
+	return func(name string) (string, bool) {
+		if name == "" || strings.Contains(name, ".") {
+			return "", false
+		}
+		var b strings.Builder
+		for i, part := range parts {
+			switch {
+			case i%2 == 0:
+				b.WriteString(part)
+			case part == "name":
+				b.WriteString(name)
+			default:
+				b.WriteString(vars[part])
+			}
+		}
+		return b.String(), true
+	}, nil
+}
+
+// Regexp returns a Rule that rewrites names matching pattern to replacement,
+// which may refer to submatches as in regexp.Regexp.Expand, e.g. "$1". The
+// pattern is matched against the whole name; it's anchored implicitly.
+func Regexp(pattern, replacement string) (Rule, error) {
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return nil, err
+	}
+	return func(name string) (string, bool) {
+		match := re.FindStringSubmatchIndex(name)
+		if match == nil {
+			return "", false
+		}
+		return string(re.ExpandString(nil, replacement, name, match)), true
+	}, nil
+}
+
+// Rewrite returns a Resolver that maps names through the first of the rules
+// that applies, and resolves the result with r. Names that no rule applies to
+// are resolved as-is. If r is a Watcher, so is the returned Resolver.
+func Rewrite(r Resolver, rules ...Rule) ContextResolver {
+	rw := rewrite{WithContext(r), rules}
+	if w, ok := r.(Watcher); ok {
+		return rewriteWatcher{rw, w}
+	}
+	return rw
+}
+
+type rewrite struct {
+	r     ContextResolver
+	rules []Rule
+}
+
+func (rw rewrite) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return rw.ResolveContext(context.Background(), name)
+}
+
+func (rw rewrite) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	return rw.r.ResolveContext(ctx, rw.rename(name))
+}
+
+func (rw rewrite) rename(name string) string {
+	for _, rule := range rw.rules {
+		if renamed, ok := rule(name); ok {
+			return renamed
+		}
+	}
+	return name
+}
+
+type rewriteWatcher struct {
+	rewrite
+	w Watcher
+}
+
+func (rw rewriteWatcher) Watch(name string, done <-chan struct{}) <-chan Update {
+	return rw.w.Watch(rw.rename(name), done)
+}
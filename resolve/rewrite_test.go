@@ -0,0 +1,82 @@
+package resolve_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestTemplate(t *testing.T) {
+	rule, err := resolve.Template("_{service}._{proto}.{name}.{env}.internal", map[string]string{
+		"service": "http",
+		"proto":   "tcp",
+		"env":     "prod",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"users":                          "_http._tcp.users.prod.internal",
+		"_http._tcp.users.prod.internal": "",
+		"":                               "",
+	} {
+		have, ok := rule(name)
+		if want, have := want != "", ok; want != have {
+			t.Errorf("%q: want applies %v, have %v", name, want, have)
+		}
+		if want != have {
+			t.Errorf("%q: want %q, have %q", name, want, have)
+		}
+	}
+
+	if _, err := resolve.Template("{name}.{env}", nil); err == nil {
+		t.Errorf("want error for missing value, have none")
+	}
+	if _, err := resolve.Template("{name", nil); err == nil {
+		t.Errorf("want error for unterminated placeholder, have none")
+	}
+}
+
+func TestRegexp(t *testing.T) {
+	rule, err := resolve.Regexp(`(\w+)-grpc`, "_grpc._tcp.$1.prod.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, ok := rule("users-grpc"); !ok || have != "_grpc._tcp.users.prod.internal" {
+		t.Errorf("want rewrite, have %q (%v)", have, ok)
+	}
+	if _, ok := rule("users-grpc.example.com"); ok {
+		t.Errorf("want no rewrite of partial match")
+	}
+
+	if _, err := resolve.Regexp(`(`, ""); err == nil {
+		t.Errorf("want error for bad pattern, have none")
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	var asked []string
+	r := resolve.ResolverFunc(func(name string) ([]resolve.Endpoint, time.Duration, error) {
+		asked = append(asked, name)
+		return []resolve.Endpoint{{Address: "a", Port: 80}}, time.Minute, nil
+	})
+	regexp, _ := resolve.Regexp(`(\w+)-grpc`, "_grpc._tcp.$1.internal")
+	template, _ := resolve.Template("_http._tcp.{name}.internal", nil)
+	rw := resolve.Rewrite(r, regexp, template)
+
+	for _, name := range []string{"users-grpc", "users", "other.example.com"} {
+		if _, _, err := rw.Resolve(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"_grpc._tcp.users.internal", "_http._tcp.users.internal", "other.example.com"}
+	if len(want) != len(asked) {
+		t.Fatalf("want %v, have %v", want, asked)
+	}
+	for i := range want {
+		if want[i] != asked[i] {
+			t.Errorf("%d: want %q, have %q", i, want[i], asked[i])
+		}
+	}
+}
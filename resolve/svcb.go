@@ -0,0 +1,214 @@
+package resolve
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve/internal/dnswire"
+)
+
+// Labels set by SVCB on the endpoints it returns, from the SvcParams of each
+// record. Lists are comma-separated.
+const (
+	ALPNLabel     = "alpn"     // ALPN protocol IDs, e.g. "h2,http/1.1"
+	IPv4HintLabel = "ipv4hint" // IPv4 addresses of the target
+	IPv6HintLabel = "ipv6hint" // IPv6 addresses of the target
+	ECHLabel      = "ech"      // base64 ECHConfigList
+)
+
+// SVCB returns a Resolver that looks up the HTTPS records of names, or their
+// SVCB records if they have no HTTPS records, as specified by RFC 9460.
+// AliasMode records are followed. Each ServiceMode record becomes an
+// Endpoint with the record's priority, its target (or the owner name, if the
+// target is "."), and its port, which defaults to 443 for HTTPS records. The
+// ALPN protocols, address hints and ECH configuration of each record are
+// carried as labels; see ALPNLabel and friends. Records with mandatory
+// params that aren't understood are ignored.
+//
+// Apart from the records it asks for, it's the same as DNS, and takes the
+// same options. It's shorthand for DNS with SVCBRecords; to look up SVCB
+// records over DoH or DoT, give SVCBRecords to those instead.
+func SVCB(options ...DNSOption) Resolver {
+	return DNS(append([]DNSOption{SVCBRecords(true)}, options...)...)
+}
+
+// SVCBRecords makes a DNS resolver look up SVCB and HTTPS records rather than
+// SRV records, as SVCB does. It can't be combined with DNSSD or
+// ExpandTargets. If SVCBRecords isn't provided, SRV records are looked up.
+func SVCBRecords(enabled bool) DNSOption {
+	return func(r *dnsResolver) { r.svcb = enabled }
+}
+
+// svcbKnown are the SvcParamKeys understood by SVCB, for the purposes of the
+// mandatory param.
+var svcbKnown = map[uint16]bool{
+	dnswire.SVCKeyALPN:          true,
+	dnswire.SVCKeyNoDefaultALPN: true,
+	dnswire.SVCKeyPort:          true,
+	dnswire.SVCKeyIPv4Hint:      true,
+	dnswire.SVCKeyECH:           true,
+	dnswire.SVCKeyIPv6Hint:      true,
+}
+
+func (r *dnsResolver) resolveSVCB(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	var (
+		target = name
+		qtype  uint16
+		ttl    time.Duration
+	)
+	for i := 0; i <= maxCNAMEs; i++ {
+		rrs, rrsTTL, typ, server, err := r.querySVCB(ctx, target, qtype)
+		if err != nil {
+			return []Endpoint{}, 0, err
+		}
+		if i == 0 || rrsTTL < ttl {
+			ttl = rrsTTL
+		}
+		if qtype = typ; len(rrs) <= 0 {
+			return []Endpoint{}, 0, &net.DNSError{Err: "no SVCB or HTTPS records", Name: target, Server: server, IsNotFound: true}
+		}
+
+		// An AliasMode record means the other records, if any, must be
+		// ignored, and the target asked instead -- RFC 9460 section 2.4.2.
+		if alias := aliasMode(rrs); alias != nil {
+			if alias.Target == "." {
+				return []Endpoint{}, 0, &net.DNSError{Err: "service not available", Name: target, Server: server, IsNotFound: true}
+			}
+			target = alias.Target
+			continue
+		}
+
+		endpoints := make([]Endpoint, 0, len(rrs))
+		for _, rr := range rrs {
+			if endpoint, ok := svcbEndpoint(rr.Data.(*dnswire.SVCB), target, qtype); ok {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+		if len(endpoints) <= 0 {
+			return []Endpoint{}, 0, &net.DNSError{Err: "no usable SVCB or HTTPS records", Name: target, Server: server, IsNotFound: true}
+		}
+		sortEndpoints(endpoints)
+		return endpoints, ttl, nil
+	}
+	return []Endpoint{}, 0, &net.DNSError{Err: "too many aliases", Name: name}
+}
+
+// querySVCB asks for the records of type qtype, or, if qtype is 0, for the
+// HTTPS records, and then the SVCB records if there are none. It returns the
+// records, their TTL and type, and the server that answered.
+func (r *dnsResolver) querySVCB(ctx context.Context, name string, qtype uint16) ([]dnswire.RR, time.Duration, uint16, string, error) {
+	qtypes := []uint16{dnswire.TypeHTTPS, dnswire.TypeSVCB}
+	if qtype != 0 {
+		qtypes = []uint16{qtype}
+	}
+	var (
+		rrs    []dnswire.RR
+		ttl    time.Duration
+		server string
+	)
+	for _, qtype = range qtypes {
+		resp, s, err := r.query(ctx, name, qtype)
+		if err != nil {
+			return nil, 0, 0, "", err
+		}
+		if rrs, ttl = answers(resp, name, qtype); len(rrs) > 0 {
+			return rrs, ttl, qtype, s, nil
+		}
+		server = s
+	}
+	return nil, 0, qtype, server, nil
+}
+
+func aliasMode(rrs []dnswire.RR) *dnswire.SVCB {
+	for _, rr := range rrs {
+		if svcb := rr.Data.(*dnswire.SVCB); svcb.Priority == 0 {
+			return svcb
+		}
+	}
+	return nil
+}
+
+// svcbEndpoint converts a ServiceMode record owned by owner to an Endpoint.
+// It returns false if the record can't be used.
+func svcbEndpoint(svcb *dnswire.SVCB, owner string, qtype uint16) (Endpoint, bool) {
+	if mandatory, ok := svcb.Param(dnswire.SVCKeyMandatory); ok {
+		for i := 0; i+2 <= len(mandatory); i += 2 {
+			key := binary.BigEndian.Uint16(mandatory[i:])
+			if _, present := svcb.Param(key); !svcbKnown[key] || !present {
+				return Endpoint{}, false
+			}
+		}
+	}
+
+	target := svcb.Target
+	if target == "." {
+		target = owner
+	}
+	endpoint := Endpoint{
+		Address:  strings.TrimRight(target, "."),
+		Priority: svcb.Priority,
+		Labels:   map[string]string{},
+	}
+	if qtype == dnswire.TypeHTTPS {
+		endpoint.Port = 443
+	}
+	if port, ok := svcb.Param(dnswire.SVCKeyPort); ok {
+		if len(port) != 2 {
+			return Endpoint{}, false
+		}
+		endpoint.Port = binary.BigEndian.Uint16(port)
+	}
+
+	var alpn []string
+	if b, ok := svcb.Param(dnswire.SVCKeyALPN); ok {
+		for i := 0; i < len(b); {
+			n := int(b[i])
+			if n == 0 || i+1+n > len(b) {
+				return Endpoint{}, false
+			}
+			alpn = append(alpn, string(b[i+1:i+1+n]))
+			i += 1 + n
+		}
+	}
+	if _, ok := svcb.Param(dnswire.SVCKeyNoDefaultALPN); !ok && qtype == dnswire.TypeHTTPS {
+		alpn = append(alpn, "http/1.1") // the default for HTTPS records
+	}
+	if len(alpn) > 0 {
+		endpoint.Labels[ALPNLabel] = strings.Join(alpn, ",")
+	}
+
+	for _, hint := range []struct {
+		key   uint16
+		label string
+		size  int
+	}{
+		{dnswire.SVCKeyIPv4Hint, IPv4HintLabel, net.IPv4len},
+		{dnswire.SVCKeyIPv6Hint, IPv6HintLabel, net.IPv6len},
+	} {
+		b, ok := svcb.Param(hint.key)
+		if !ok {
+			continue
+		}
+		if len(b) == 0 || len(b)%hint.size != 0 {
+			return Endpoint{}, false
+		}
+		var ips []string
+		for i := 0; i < len(b); i += hint.size {
+			ips = append(ips, net.IP(b[i:i+hint.size]).String())
+		}
+		endpoint.Labels[hint.label] = strings.Join(ips, ",")
+	}
+
+	if ech, ok := svcb.Param(dnswire.SVCKeyECH); ok {
+		endpoint.Labels[ECHLabel] = base64.StdEncoding.EncodeToString(ech)
+	}
+
+	if len(endpoint.Labels) <= 0 {
+		endpoint.Labels = nil
+	}
+	return endpoint, true
+}
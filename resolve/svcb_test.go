@@ -0,0 +1,77 @@
+package resolve_test
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+	"github.com/peterbourgon/srvproxy/resolve/dnstest"
+)
+
+func TestSVCB(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetHTTPS("foo.internal",
+		dnstest.SVCB{Priority: 0, Target: "pool.internal", TTL: 300 * time.Second},
+		dnstest.SVCB{Priority: 1, Target: "ignored.internal", TTL: 300 * time.Second}, // ServiceMode alongside AliasMode
+	)
+	s.SetHTTPS("pool.internal",
+		dnstest.SVCB{Priority: 2, Target: "b.pool.internal", ALPN: []string{"h2"}, NoDefaultALPN: true, IPv6Hint: []string{"fd00::1"}, TTL: time.Minute},
+		dnstest.SVCB{Priority: 1, Target: ".", ALPN: []string{"h2"}, Port: 8080, IPv4Hint: []string{"10.0.0.1", "10.0.0.2"}, TTL: time.Minute},
+		dnstest.SVCB{Priority: 1, Target: "c.pool.internal", Mandatory: []uint16{99}, TTL: time.Minute},
+	)
+
+	endpoints, ttl, err := resolve.SVCB(resolve.Nameservers(s.Addr())).Resolve("foo.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resolve.Endpoint{
+		{Address: "pool.internal", Port: 8080, Priority: 1, Labels: map[string]string{
+			resolve.ALPNLabel:     "h2,http/1.1",
+			resolve.IPv4HintLabel: "10.0.0.1,10.0.0.2",
+		}},
+		{Address: "b.pool.internal", Port: 443, Priority: 2, Labels: map[string]string{
+			resolve.ALPNLabel:     "h2",
+			resolve.IPv6HintLabel: "fd00::1",
+		}},
+	}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+	if want, have := 60*time.Second, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+}
+
+func TestSVCBFallback(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetSVCB("_dns.foo.internal", dnstest.SVCB{Priority: 1, Target: "a.internal", Port: 53, TTL: 30 * time.Second})
+
+	endpoints, _, err := resolve.SVCB(resolve.Nameservers(s.Addr())).Resolve("_dns.foo.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"a.internal:53"}, resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestSVCBOverDoH(t *testing.T) {
+	s := dnstest.NewServer()
+	defer s.Close()
+	s.SetHTTPS("foo.internal", dnstest.SVCB{Priority: 1, Target: "a.internal", TTL: time.Minute})
+	hs := httptest.NewTLSServer(s)
+	defer hs.Close()
+
+	r := resolve.DoH(hs.URL+"/dns-query", resolve.SVCBRecords(true), resolve.DoHClient(hs.Client()))
+	endpoints, _, err := r.Resolve("foo.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"a.internal:443"}, resolve.Hosts(endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
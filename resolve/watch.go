@@ -0,0 +1,119 @@
+package resolve
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// Update is one event in a stream of resolution results for a name: either
+// the complete, current set of endpoints, or an error that prevented one from
+// being produced.
+type Update struct {
+	Endpoints []Endpoint
+	Err       error
+}
+
+// Watcher represents anything that can push updates about the endpoints of
+// a name as they happen, rather than being polled. Watch returns a channel
+// that yields the current endpoints as soon as they're known, and then again
+// each time they change. Errors are yielded as they occur, and don't end the
+// watch. The watch ends when done is closed, after which the channel is
+// closed.
+type Watcher interface {
+	Watch(name string, done <-chan struct{}) <-chan Update
+}
+
+// changeFilter decides which results of a watch are sent: the first
+// endpoints, those that differ from the last sent, and the first after an
+// error, even if they're unchanged, so that the error is known to be over.
+// The zero value is ready to use.
+type changeFilter struct {
+	last   []Endpoint
+	sent   bool // whether any endpoints have been sent
+	failed bool // whether an error has been sent since
+}
+
+// fail records that an error was sent.
+func (f *changeFilter) fail() {
+	f.failed = true
+}
+
+// changed returns true if endpoints should be sent, and if so, records them
+// as the last sent.
+func (f *changeFilter) changed(endpoints []Endpoint) bool {
+	if f.sent && !f.failed && reflect.DeepEqual(endpoints, f.last) {
+		return false
+	}
+	f.last, f.sent, f.failed = endpoints, true, false
+	return true
+}
+
+// Poll converts a Resolver to a Watcher. It resolves the name immediately,
+// and then again each time the TTL of the previous answer expires. Updates
+// are only yielded when the endpoints change, or when resolution fails, in
+// which case it's retried after a second, and the next success is yielded
+// even if the endpoints are unchanged. Lookups are at least a second apart,
+// however short the TTL, so that a TTL of 0 doesn't resolve in a loop.
+// Closing done abandons a lookup in progress, if r supports it; see
+// WithContext. To bound each lookup, wrap r with Timeout.
+func Poll(r Resolver) Watcher {
+	return poller{WithContext(r)}
+}
+
+// minPollInterval is the least time between the lookups of Poll.
+const minPollInterval = time.Second
+
+type poller struct {
+	ContextResolver
+}
+
+func (p poller) Watch(name string, done <-chan struct{}) <-chan Update {
+	var (
+		c           = make(chan Update)
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer close(c)
+		defer cancel()
+		var changes changeFilter
+		for {
+			var u *Update
+			endpoints, ttl, err := p.ResolveContext(ctx, name)
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				u, ttl = &Update{Err: err}, minPollInterval
+				changes.fail()
+			case changes.changed(endpoints):
+				u = &Update{Endpoints: endpoints}
+			}
+
+			if u != nil {
+				select {
+				case c <- *u:
+				case <-done:
+					return
+				}
+			}
+
+			if ttl < minPollInterval {
+				ttl = minPollInterval
+			}
+			select {
+			case <-time.After(ttl):
+			case <-done:
+				return
+			}
+		}
+	}()
+	return c
+}
@@ -0,0 +1,75 @@
+package resolve_test
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+func TestPoll(t *testing.T) {
+	answers := []struct {
+		hosts []string
+		err   error
+	}{
+		{[]string{"a"}, nil},
+		{[]string{"a"}, nil}, // unchanged, so not yielded
+		{nil, errors.New("transient")},
+		{[]string{"a"}, nil}, // unchanged, but yielded as a recovery
+	}
+	calls := make(chan int, len(answers)+1)
+	r := resolve.HostsFunc(func(string) ([]string, time.Duration, error) {
+		i := len(calls)
+		calls <- i
+		if i >= len(answers) {
+			return []string{"a", "b"}, time.Hour, nil
+		}
+		return answers[i].hosts, time.Millisecond, answers[i].err
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	updates := resolve.Poll(r).Watch("irrelevant", done)
+
+	if u := <-updates; u.Err != nil || !reflect.DeepEqual([]string{"a"}, resolve.Hosts(u.Endpoints)) {
+		t.Errorf("update 1: have %+v", u)
+	}
+	if u := <-updates; u.Err == nil {
+		t.Errorf("update 2: want error, have %+v", u)
+	}
+	if u := <-updates; u.Err != nil || !reflect.DeepEqual([]string{"a"}, resolve.Hosts(u.Endpoints)) {
+		t.Errorf("update 3: have %+v", u)
+	}
+	if u := <-updates; u.Err != nil || !reflect.DeepEqual([]string{"a", "b"}, resolve.Hosts(u.Endpoints)) {
+		t.Errorf("update 4: have %+v", u)
+	}
+}
+
+func TestPollZeroTTL(t *testing.T) {
+	// A TTL of 0 mustn't resolve in a loop.
+	var (
+		mtx   sync.Mutex
+		calls int
+	)
+	r := resolve.HostsFunc(func(string) ([]string, time.Duration, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		calls++
+		return []string{"a"}, 0, nil
+	})
+
+	done := make(chan struct{})
+	updates := resolve.Poll(r).Watch("irrelevant", done)
+	<-updates // later lookups are unchanged, so they aren't yielded
+	time.Sleep(500 * time.Millisecond)
+	close(done)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if calls > 1 {
+		t.Errorf("want 1 lookup, have %d", calls)
+	}
+}
@@ -0,0 +1,488 @@
+package resolve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve/internal/xdswire"
+)
+
+// Labels set on endpoints by the xDS resolver, where known.
+const (
+	RegionLabel  = "region"
+	ZoneLabel    = "zone"
+	SubZoneLabel = "subzone"
+	HealthLabel  = "health" // "healthy", "degraded", or "unknown"
+)
+
+// XDS returns a resolver that subscribes to the Envoy Endpoint Discovery
+// Service (EDS) of the control plane at addr, over Aggregated Discovery
+// Service (ADS) gRPC streams. addr is "http://host:port" for gRPC over
+// cleartext HTTP/2, or "https://host:port" for gRPC over TLS. Names are EDS
+// cluster names.
+//
+// Each endpoint of the cluster's ClusterLoadAssignment becomes an Endpoint,
+// unless it's unhealthy, draining, or timed out. The priority of its
+// locality becomes its Priority, and its load balancing weight its Weight.
+// If localities have weights, as with Envoy's locality weighted load
+// balancing, each Weight is instead the endpoint's share of its locality's
+// share of its priority, scaled so that the largest is 1000, and localities
+// without a weight are left out, as Envoy sends them no traffic. Endpoints
+// are labeled with their locality and health.
+func XDS(addr string, options ...XDSOption) *XDSResolver {
+	p := new(http.Protocols)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	r := &XDSResolver{
+		addr:   strings.TrimRight(addr, "/"),
+		client: &http.Client{Transport: &http.Transport{Protocols: p}},
+		node:   xdswire.Node{ID: "srvproxy"},
+		ttl:    5 * time.Second,
+	}
+	r.setOptions(options...)
+	return r
+}
+
+// XDSOption sets a specific option for the xDS resolver. This is the
+// functional options idiom.
+type XDSOption func(*XDSResolver)
+
+// XDSNode sets the node ID and cluster that identify the client to the
+// control plane. If XDSNode isn't provided, the node ID is "srvproxy", with
+// no cluster.
+func XDSNode(id, cluster string) XDSOption {
+	return func(r *XDSResolver) { r.node = xdswire.Node{ID: id, Cluster: cluster} }
+}
+
+// XDSClient sets the HTTP client used to talk to the control plane. Its
+// transport must speak HTTP/2, including over cleartext for http addresses.
+// If XDSClient isn't provided, a client with such a transport is used.
+func XDSClient(c *http.Client) XDSOption {
+	return func(r *XDSResolver) { r.client = c }
+}
+
+// XDSTTL sets the TTL returned by Resolve. EDS has no notion of TTLs, so
+// this only controls how often pollers come back. If XDSTTL isn't provided,
+// a default value of 5 seconds is used.
+func XDSTTL(d time.Duration) XDSOption {
+	return func(r *XDSResolver) { r.ttl = d }
+}
+
+// XDSResolver resolves names via the Envoy Endpoint Discovery Service. It's
+// both a Resolver and a Watcher, so pool.Stream picks up changes
+// immediately.
+type XDSResolver struct {
+	addr   string
+	client *http.Client
+	node   xdswire.Node
+	ttl    time.Duration
+}
+
+func (r *XDSResolver) setOptions(options ...XDSOption) {
+	for _, f := range options {
+		f(r)
+	}
+}
+
+// Resolve implements Resolver by subscribing to the cluster, and returning
+// the first assignment the control plane sends. Control planes don't answer
+// for clusters they don't know, so wrap r with Timeout to bound it.
+func (r *XDSResolver) Resolve(name string) ([]Endpoint, time.Duration, error) {
+	return r.ResolveContext(context.Background(), name)
+}
+
+// ResolveContext is Resolve, with the stream bound to ctx.
+func (r *XDSResolver) ResolveContext(ctx context.Context, name string) ([]Endpoint, time.Duration, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s, err := r.subscribe(ctx, name)
+	if err != nil {
+		return []Endpoint{}, 0, err
+	}
+	defer s.close()
+	for {
+		endpoints, err := s.recv()
+		if err == io.EOF {
+			err = fmt.Errorf("xds: %s: stream ended without an assignment", name)
+		}
+		if err != nil {
+			return []Endpoint{}, 0, err
+		}
+		if endpoints != nil {
+			return endpoints, r.ttl, nil
+		}
+	}
+}
+
+// Watch returns a channel of updates for the named cluster, driven by an ADS
+// stream, so changes are delivered as soon as the control plane sends them.
+// Each response is ACKed, or NACKed if it can't be used, in which case an
+// update with the error is sent, and the endpoints last ACKed stay current.
+// Subsequent updates are only sent when the set of endpoints changes, or
+// when the stream fails, in which case Watch backs off and subscribes again.
+// After an error, the next assignment is sent even if it's unchanged. Close
+// done to stop watching; the channel is closed after that.
+func (r *XDSResolver) Watch(name string, done <-chan struct{}) <-chan Update {
+	var (
+		c           = make(chan Update)
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+	go func() {
+		<-done
+		cancel()
+	}()
+	go func() {
+		defer close(c)
+
+		send := func(u Update) bool {
+			select {
+			case c <- u:
+				return true
+			case <-done:
+				return false
+			}
+		}
+
+		var (
+			changes changeFilter
+			backoff time.Duration
+		)
+		pause := func() bool {
+			backoff = nextBackoff(backoff)
+			select {
+			case <-time.After(backoff):
+				return true
+			case <-done:
+				return false
+			}
+		}
+		for {
+			var received bool
+			err := r.watch(ctx, name, func(endpoints []Endpoint, err error) bool {
+				switch {
+				case err != nil:
+					changes.fail()
+					return send(Update{Err: err})
+				case !changes.changed(endpoints):
+					backoff, received = 0, true
+					return true
+				default:
+					backoff, received = 0, true
+					return send(Update{Endpoints: endpoints})
+				}
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				// The control plane ended the stream; subscribe again, but
+				// don't hammer one that ends them straight away.
+				if !received && !pause() {
+					return
+				}
+				continue
+			}
+			changes.fail()
+			if !send(Update{Err: err}) || !pause() {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// watch subscribes to name, and calls emit with each assignment, or each
+// NACKed response's error, until the stream ends or emit returns false. It
+// returns nil if the control plane ended the stream cleanly.
+func (r *XDSResolver) watch(ctx context.Context, name string, emit func([]Endpoint, error) bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s, err := r.subscribe(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	for {
+		endpoints, err := s.recv()
+		var nack *xdsNACKError
+		switch {
+		case err == io.EOF:
+			return nil
+		case errors.As(err, &nack):
+			if !emit(nil, err) {
+				return nil
+			}
+		case err != nil:
+			return err
+		case endpoints != nil:
+			if !emit(endpoints, nil) {
+				return nil
+			}
+		}
+	}
+}
+
+// xdsStream is an ADS stream subscribed to the assignment of one cluster.
+type xdsStream struct {
+	name    string
+	node    xdswire.Node
+	w       *io.PipeWriter
+	resp    *http.Response
+	version string // last ACKed
+}
+
+// subscribe opens an ADS stream, and subscribes to the assignment of name.
+func (r *XDSResolver) subscribe(ctx context.Context, name string) (*xdsStream, error) {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("POST", r.addr+xdswire.ADSPath, pr)
+	if err != nil {
+		return nil, fmt.Errorf("xds: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	// The transport doesn't notice the end of ctx while it waits for more of
+	// the request body, so the body ends with it.
+	context.AfterFunc(ctx, func() { pw.CloseWithError(ctx.Err()) })
+
+	// The control plane may not answer with headers until it's had the
+	// subscription, so it's sent while the request is being made.
+	s := &xdsStream{name: name, node: r.node, w: pw}
+	go func() {
+		if err := s.send("", "", nil); err != nil {
+			pw.CloseWithError(err)
+		}
+	}()
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		pw.Close()
+		return nil, fmt.Errorf("xds: %s: %v", name, err)
+	}
+	s.resp = resp
+	if resp.StatusCode != http.StatusOK {
+		s.close()
+		return nil, fmt.Errorf("xds: %s: HTTP %d %s", name, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	if err := grpcStatus(resp.Header); err != nil { // a trailers-only response
+		s.close()
+		return nil, fmt.Errorf("xds: %s: %v", name, err)
+	}
+	return s, nil
+}
+
+// send sends a request for the assignment. The first request carries the
+// node; later ones ACK or NACK the response with the nonce.
+func (s *xdsStream) send(version, nonce string, detail *xdswire.Status) error {
+	req := &xdswire.DiscoveryRequest{
+		VersionInfo:   version,
+		ResourceNames: []string{s.name},
+		TypeURL:       xdswire.TypeClusterLoadAssignment,
+		ResponseNonce: nonce,
+		ErrorDetail:   detail,
+	}
+	if nonce == "" {
+		req.Node = &s.node
+	}
+	return xdswire.WriteMessage(s.w, req.Marshal())
+}
+
+// recv reads the next response, and ACKs or NACKs it. It returns the
+// endpoints of an accepted response, which are nil if the response didn't
+// include the assignment, or an *xdsNACKError if the response was rejected.
+// It returns io.EOF if the stream ended cleanly.
+func (s *xdsStream) recv() ([]Endpoint, error) {
+	b, err := xdswire.ReadMessage(s.resp.Body)
+	if err == io.EOF {
+		if err := grpcStatus(s.resp.Trailer); err != nil {
+			return nil, fmt.Errorf("xds: %s: %v", s.name, err)
+		}
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("xds: %s: %v", s.name, err)
+	}
+	var resp xdswire.DiscoveryResponse
+	if err := resp.Unmarshal(b); err != nil {
+		return nil, fmt.Errorf("xds: %s: %v", s.name, err)
+	}
+
+	endpoints, err := s.assignment(&resp)
+	if err != nil {
+		// Per the xDS protocol, a NACK carries the last version accepted.
+		const invalidArgument = 3
+		if err := s.send(s.version, resp.Nonce, &xdswire.Status{Code: invalidArgument, Message: err.Error()}); err != nil {
+			return nil, fmt.Errorf("xds: %s: %v", s.name, err)
+		}
+		return nil, &xdsNACKError{name: s.name, version: resp.VersionInfo, err: err}
+	}
+	if err := s.send(resp.VersionInfo, resp.Nonce, nil); err != nil {
+		return nil, fmt.Errorf("xds: %s: %v", s.name, err)
+	}
+	s.version = resp.VersionInfo
+	return endpoints, nil
+}
+
+// assignment returns the endpoints of the subscribed cluster in resp, or nil
+// if it isn't there.
+func (s *xdsStream) assignment(resp *xdswire.DiscoveryResponse) ([]Endpoint, error) {
+	if resp.TypeURL != xdswire.TypeClusterLoadAssignment {
+		return nil, fmt.Errorf("unexpected type %q", resp.TypeURL)
+	}
+	var endpoints []Endpoint
+	for _, res := range resp.Resources {
+		if res.TypeURL != xdswire.TypeClusterLoadAssignment {
+			return nil, fmt.Errorf("unexpected resource type %q", res.TypeURL)
+		}
+		var cla xdswire.ClusterLoadAssignment
+		if err := cla.Unmarshal(res.Value); err != nil {
+			return nil, err
+		}
+		if cla.ClusterName == s.name {
+			endpoints = xdsEndpoints(cla)
+		}
+	}
+	return endpoints, nil
+}
+
+func (s *xdsStream) close() {
+	s.w.Close()
+	if s.resp != nil {
+		s.resp.Body.Close()
+	}
+}
+
+// xdsNACKError is a response that was NACKed.
+type xdsNACKError struct {
+	name, version string
+	err           error
+}
+
+func (e *xdsNACKError) Error() string {
+	return fmt.Sprintf("xds: %s: rejected version %q: %v", e.name, e.version, e.err)
+}
+
+func (e *xdsNACKError) Unwrap() error { return e.err }
+
+// xdsEndpoints converts the usable endpoints of cla to Endpoints.
+func xdsEndpoints(cla xdswire.ClusterLoadAssignment) []Endpoint {
+	// With locality weights, each endpoint's share of its priority is its
+	// locality's share of the priority, split among the locality's endpoints
+	// by their weights.
+	var (
+		localityWeights bool
+		priorityTotals  = map[uint32]float64{}
+	)
+	for _, l := range cla.Endpoints {
+		if l.LoadBalancingWeight > 0 {
+			localityWeights = true
+		}
+		priorityTotals[l.Priority] += float64(l.LoadBalancingWeight)
+	}
+
+	type weighted struct {
+		Endpoint
+		share float64
+	}
+	var (
+		all      []weighted
+		maxShare float64
+	)
+	for _, l := range cla.Endpoints {
+		if localityWeights && l.LoadBalancingWeight == 0 {
+			continue
+		}
+		var localityTotal float64
+		for _, e := range l.LbEndpoints {
+			if xdsUsable(e) {
+				localityTotal += float64(xdsWeight(e))
+			}
+		}
+		for _, e := range l.LbEndpoints {
+			if !xdsUsable(e) {
+				continue
+			}
+			addr := e.Address
+			if addr == "" {
+				addr = e.Hostname
+			}
+			if addr == "" || e.Port == 0 || e.Port > math.MaxUint16 {
+				continue
+			}
+			w := weighted{Endpoint: Endpoint{
+				Address:  addr,
+				Port:     uint16(e.Port),
+				Priority: uint16(min(l.Priority, math.MaxUint16)),
+				Weight:   uint16(min(xdsWeight(e), math.MaxUint16)),
+				Labels:   xdsLabels(l.Locality, e.HealthStatus),
+			}}
+			if localityWeights {
+				w.share = float64(l.LoadBalancingWeight) / priorityTotals[l.Priority] * float64(xdsWeight(e)) / localityTotal
+				maxShare = max(maxShare, w.share)
+			}
+			all = append(all, w)
+		}
+	}
+
+	endpoints := make([]Endpoint, len(all))
+	for i, w := range all {
+		if localityWeights && maxShare > 0 {
+			w.Weight = uint16(max(1, math.Round(w.share/maxShare*1000)))
+		}
+		endpoints[i] = w.Endpoint
+	}
+	sortEndpoints(endpoints)
+	return endpoints
+}
+
+// xdsUsable returns true if Envoy would send traffic to e.
+func xdsUsable(e xdswire.LbEndpoint) bool {
+	switch e.HealthStatus {
+	case xdswire.HealthUnhealthy, xdswire.HealthDraining, xdswire.HealthTimeout:
+		return false
+	default:
+		return true
+	}
+}
+
+// xdsWeight returns the weight of e, which defaults to 1.
+func xdsWeight(e xdswire.LbEndpoint) uint32 {
+	if e.LoadBalancingWeight == 0 {
+		return 1
+	}
+	return e.LoadBalancingWeight
+}
+
+func xdsLabels(l xdswire.Locality, health xdswire.HealthStatus) map[string]string {
+	labels := map[string]string{HealthLabel: "unknown"}
+	switch health {
+	case xdswire.HealthHealthy:
+		labels[HealthLabel] = "healthy"
+	case xdswire.HealthDegraded:
+		labels[HealthLabel] = "degraded"
+	}
+	for k, v := range map[string]string{RegionLabel: l.Region, ZoneLabel: l.Zone, SubZoneLabel: l.SubZone} {
+		if v != "" {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// grpcStatus returns the error in the gRPC status of h, if it's not OK.
+func grpcStatus(h http.Header) error {
+	code := h.Get("Grpc-Status")
+	if code == "" || code == "0" {
+		return nil
+	}
+	msg, _ := url.PathUnescape(h.Get("Grpc-Message"))
+	return fmt.Errorf("gRPC status %s: %s", code, msg)
+}
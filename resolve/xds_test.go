@@ -0,0 +1,351 @@
+package resolve_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+	"github.com/peterbourgon/srvproxy/resolve/internal/xdswire"
+)
+
+func TestXDSResolve(t *testing.T) {
+	x := newFakeXDS()
+	x.set(&xdswire.ClusterLoadAssignment{
+		ClusterName: "users",
+		Endpoints: []xdswire.LocalityLbEndpoints{
+			{
+				Locality: xdswire.Locality{Region: "eu", Zone: "eu-1a"},
+				LbEndpoints: []xdswire.LbEndpoint{
+					{Address: "10.0.0.1", Port: 8080, HealthStatus: xdswire.HealthHealthy, LoadBalancingWeight: 3},
+					{Address: "10.0.0.2", Port: 8080, HealthStatus: xdswire.HealthUnhealthy},
+					{Address: "10.0.0.3", Port: 8080, HealthStatus: xdswire.HealthDraining},
+					{Hostname: "d.internal", Port: 8080, HealthStatus: xdswire.HealthDegraded},
+				},
+			},
+			{
+				Locality:    xdswire.Locality{Region: "eu", Zone: "eu-1b"},
+				Priority:    1,
+				LbEndpoints: []xdswire.LbEndpoint{{Address: "10.0.1.1", Port: 8080}},
+			},
+		},
+	})
+	s := newXDSServer(x)
+	defer s.Close()
+
+	endpoints, ttl, err := resolve.XDS(s.URL, resolve.XDSNode("edge-1", "edge"), resolve.XDSTTL(time.Minute)).Resolve("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resolve.Endpoint{
+		{Address: "10.0.0.1", Port: 8080, Weight: 3, Labels: map[string]string{"region": "eu", "zone": "eu-1a", "health": "healthy"}},
+		{Address: "d.internal", Port: 8080, Weight: 1, Labels: map[string]string{"region": "eu", "zone": "eu-1a", "health": "degraded"}},
+		{Address: "10.0.1.1", Port: 8080, Priority: 1, Weight: 1, Labels: map[string]string{"region": "eu", "zone": "eu-1b", "health": "unknown"}},
+	}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+	if want, have := time.Minute, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+
+	req := x.received()[0]
+	if req.Node == nil || req.Node.ID != "edge-1" || req.Node.Cluster != "edge" {
+		t.Errorf("want node edge-1 in cluster edge, have %+v", req.Node)
+	}
+	if want, have := []string{"users"}, req.ResourceNames; !reflect.DeepEqual(want, have) {
+		t.Errorf("want resource names %v, have %v", want, have)
+	}
+	if want, have := xdswire.TypeClusterLoadAssignment, req.TypeURL; want != have {
+		t.Errorf("want type %q, have %q", want, have)
+	}
+}
+
+func TestXDSLocalityWeights(t *testing.T) {
+	x := newFakeXDS()
+	x.set(&xdswire.ClusterLoadAssignment{
+		ClusterName: "users",
+		Endpoints: []xdswire.LocalityLbEndpoints{
+			{
+				Locality:            xdswire.Locality{Zone: "a"},
+				LoadBalancingWeight: 1,
+				LbEndpoints: []xdswire.LbEndpoint{
+					{Address: "10.0.0.1", Port: 80, LoadBalancingWeight: 1},
+					{Address: "10.0.0.2", Port: 80, LoadBalancingWeight: 3},
+				},
+			},
+			{
+				Locality:            xdswire.Locality{Zone: "b"},
+				LoadBalancingWeight: 3,
+				LbEndpoints:         []xdswire.LbEndpoint{{Address: "10.0.1.1", Port: 80}},
+			},
+			{
+				Locality:    xdswire.Locality{Zone: "c"},
+				LbEndpoints: []xdswire.LbEndpoint{{Address: "10.0.2.1", Port: 80}},
+			},
+		},
+	})
+	s := newXDSServer(x)
+	defer s.Close()
+
+	endpoints, _, err := resolve.XDS(s.URL).Resolve("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Zone b gets 3/4 of the traffic, all to its one endpoint, and zone a
+	// gets 1/4, split 1:3. Zone c has no weight, so it gets none.
+	have := map[string]uint16{}
+	for _, e := range endpoints {
+		have[e.Address] = e.Weight
+	}
+	if want := map[string]uint16{"10.0.0.1": 83, "10.0.0.2": 250, "10.0.1.1": 1000}; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestXDSWatch(t *testing.T) {
+	x := newFakeXDS()
+	x.set(&xdswire.ClusterLoadAssignment{ClusterName: "users", Endpoints: []xdswire.LocalityLbEndpoints{
+		{LbEndpoints: []xdswire.LbEndpoint{{Address: "10.0.0.1", Port: 80}}},
+	}})
+	s := newXDSServer(x)
+	defer s.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	updates := resolve.XDS(s.URL).Watch("users", done)
+
+	u := recvUpdate(t, updates)
+	if want, have := []string{"10.0.0.1:80"}, resolve.Hosts(u.Endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	waitRequest(t, x, func(req xdswire.DiscoveryRequest) bool {
+		return req.VersionInfo == "1" && req.ResponseNonce == "1" && req.ErrorDetail == nil
+	})
+
+	// A response that can't be decoded is NACKed, with the version last
+	// accepted, and reported.
+	x.setRaw("users", []byte{0xFF})
+	select {
+	case u := <-updates:
+		if u.Err == nil {
+			t.Errorf("want error, have %+v", u)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for update")
+	}
+	waitRequest(t, x, func(req xdswire.DiscoveryRequest) bool {
+		return req.VersionInfo == "1" && req.ResponseNonce == "2" && req.ErrorDetail != nil
+	})
+
+	// The next good response is sent, even though nothing has changed, so
+	// the error is known to be over.
+	x.set(&xdswire.ClusterLoadAssignment{ClusterName: "users", Endpoints: []xdswire.LocalityLbEndpoints{
+		{LbEndpoints: []xdswire.LbEndpoint{{Address: "10.0.0.1", Port: 80}}},
+	}})
+	u = recvUpdate(t, updates)
+	if want, have := []string{"10.0.0.1:80"}, resolve.Hosts(u.Endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	x.set(&xdswire.ClusterLoadAssignment{ClusterName: "users", Endpoints: []xdswire.LocalityLbEndpoints{
+		{LbEndpoints: []xdswire.LbEndpoint{{Address: "10.0.0.1", Port: 80}, {Address: "10.0.0.2", Port: 80}}},
+	}})
+	u = recvUpdate(t, updates)
+	if want, have := []string{"10.0.0.1:80", "10.0.0.2:80"}, resolve.Hosts(u.Endpoints); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	waitRequest(t, x, func(req xdswire.DiscoveryRequest) bool {
+		return req.VersionInfo == "4" && req.ResponseNonce == "4" && req.ErrorDetail == nil
+	})
+}
+
+func TestXDSStatus(t *testing.T) {
+	s := newXDSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "7")
+		w.Header().Set("Grpc-Message", "permission%20denied")
+	}))
+	defer s.Close()
+
+	_, _, err := resolve.XDS(s.URL).Resolve("users")
+	if want, have := "xds: users: gRPC status 7: permission denied", errString(err); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func TestXDSWatchBackoff(t *testing.T) {
+	// A control plane that ends each stream at once, without a response,
+	// mustn't be hammered with new ones.
+	var (
+		mtx     sync.Mutex
+		streams int
+	)
+	s := newXDSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mtx.Lock()
+		streams++
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	defer s.Close()
+
+	done := make(chan struct{})
+	updates := resolve.XDS(s.URL).Watch("users", done)
+	go func() {
+		for range updates {
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+	close(done)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if streams < 1 || streams > 5 {
+		t.Errorf("want between 1 and 5 streams, have %d", streams)
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func newXDSServer(h http.Handler) *httptest.Server {
+	s := httptest.NewUnstartedServer(h)
+	s.Config.Protocols = new(http.Protocols)
+	s.Config.Protocols.SetUnencryptedHTTP2(true)
+	s.Start()
+	return s
+}
+
+// waitRequest waits for the control plane to receive a request that
+// matches.
+func waitRequest(t *testing.T, x *fakeXDS, match func(xdswire.DiscoveryRequest) bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, req := range x.received() {
+			if match(req) {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no matching request in %+v", x.received())
+}
+
+// fakeXDS is a stand-in for an ADS control plane, which serves EDS
+// resources. The version of the resources, and the nonce of each response,
+// is a counter bumped with every change, and each stream is sent the
+// resources it's subscribed to whenever they change.
+type fakeXDS struct {
+	mtx       sync.Mutex
+	version   int
+	resources map[string][]byte // by cluster name
+	changed   chan struct{}
+	requests  []xdswire.DiscoveryRequest
+}
+
+func newFakeXDS() *fakeXDS {
+	return &fakeXDS{resources: map[string][]byte{}, changed: make(chan struct{})}
+}
+
+func (x *fakeXDS) set(cla *xdswire.ClusterLoadAssignment) {
+	x.setRaw(cla.ClusterName, cla.Marshal())
+}
+
+func (x *fakeXDS) setRaw(name string, b []byte) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	x.resources[name] = b
+	x.version++
+	close(x.changed)
+	x.changed = make(chan struct{})
+}
+
+func (x *fakeXDS) received() []xdswire.DiscoveryRequest {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	return append([]xdswire.DiscoveryRequest{}, x.requests...)
+}
+
+func (x *fakeXDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != xdswire.ADSPath || r.Header.Get("Content-Type") != "application/grpc" {
+		http.NotFound(w, r)
+		return
+	}
+
+	reqs := make(chan xdswire.DiscoveryRequest)
+	go func() {
+		defer close(reqs)
+		for {
+			b, err := xdswire.ReadMessage(r.Body)
+			if err != nil {
+				return
+			}
+			var req xdswire.DiscoveryRequest
+			if err := req.Unmarshal(b); err != nil {
+				return
+			}
+			x.mtx.Lock()
+			x.requests = append(x.requests, req)
+			x.mtx.Unlock()
+			select {
+			case reqs <- req:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status")
+	defer w.Header().Set("Grpc-Status", "0")
+
+	var (
+		names []string
+		sent  int
+	)
+	for {
+		x.mtx.Lock()
+		version, changed := x.version, x.changed
+		resp := &xdswire.DiscoveryResponse{
+			VersionInfo: strconv.Itoa(version),
+			TypeURL:     xdswire.TypeClusterLoadAssignment,
+			Nonce:       strconv.Itoa(version),
+		}
+		for _, name := range names {
+			if b, ok := x.resources[name]; ok {
+				resp.Resources = append(resp.Resources, xdswire.Any{TypeURL: xdswire.TypeClusterLoadAssignment, Value: b})
+			}
+		}
+		x.mtx.Unlock()
+
+		if len(resp.Resources) > 0 && sent != version {
+			if err := xdswire.WriteMessage(w, resp.Marshal()); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			sent = version
+		}
+
+		select {
+		case req, ok := <-reqs:
+			if !ok {
+				return
+			}
+			names = req.ResourceNames
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
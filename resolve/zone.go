@@ -0,0 +1,409 @@
+package resolve
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve/internal/dnswire"
+)
+
+// ZoneFile returns a Resolver that answers from a zone file in the master
+// file format of RFC 1035 section 5, as served by an authoritative
+// nameserver, so that whole service topologies can be described for tests.
+// The $ORIGIN and $TTL directives are understood, as are SRV, A, AAAA, TXT,
+// PTR and CNAME records; records of other types, like SOA and NS, are
+// ignored.
+// Names are relative to the origin, which is the root until $ORIGIN says
+// otherwise. TTLs may be given in seconds, or with units, as in "1h30m".
+//
+//	$ORIGIN prod.internal.
+//	$TTL 60
+//	_http._tcp.users  SRV    10 5 8080 users-1
+//	                  SRV    10 5 8080 users-2
+//	users-1           A      10.0.0.1
+//	users-2      30   AAAA   2001:db8::2
+//	_http._tcp.api    CNAME  _http._tcp.users
+//
+// Apart from where the answers come from, it's the same as DNS, and takes
+// the same options, except for the ones about nameservers, and SVCBRecords,
+// as zone files can't hold SVCB records. CNAMEs are followed, and the
+// addresses of SRV targets in the zone are given along with them, for
+// ExpandTargets. The file is read once.
+func ZoneFile(path string, options ...DNSOption) (Resolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	z, err := parseZone(f, path)
+	if err != nil {
+		return nil, err
+	}
+	r := &dnsResolver{
+		timeout:  time.Second,
+		ndots:    1,
+		attempts: 1,
+	}
+	r.setOptions(options...)
+	r.proto, r.nameservers, r.zone = protoZone, []string{path}, z
+	if err := r.complete(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// zone is a set of records, by lowercased, fully qualified owner name.
+type zone map[string][]dnswire.RR
+
+// answer answers req as an authoritative nameserver for the zone would.
+func (z zone) answer(req *dnswire.Message) *dnswire.Message {
+	resp := &dnswire.Message{
+		Header: dnswire.Header{
+			ID:               req.ID,
+			Response:         true,
+			Authoritative:    true,
+			RecursionDesired: req.RecursionDesired,
+		},
+		Questions: req.Questions,
+	}
+	if len(req.Questions) != 1 {
+		resp.Rcode = dnswire.RcodeFormatError
+		return resp
+	}
+
+	q := req.Questions[0]
+	name := strings.ToLower(dnswire.Fqdn(q.Name))
+	for i := 0; i <= maxCNAMEs; i++ {
+		rrs, ok := z[name]
+		if !ok {
+			if i == 0 {
+				resp.Rcode = dnswire.RcodeNameError
+			}
+			break // a CNAME out of the zone is the asker's problem
+		}
+		var cname *dnswire.RR
+		for j, rr := range rrs {
+			switch {
+			case rr.Type == q.Type:
+				resp.Answers = append(resp.Answers, rr)
+			case rr.Type == dnswire.TypeCNAME:
+				cname = &rrs[j]
+			}
+		}
+		if cname == nil || q.Type == dnswire.TypeCNAME {
+			break
+		}
+		resp.Answers = append(resp.Answers, *cname)
+		name = strings.ToLower(cname.Data.(*dnswire.CNAME).Target)
+	}
+
+	for _, rr := range resp.Answers {
+		if srv, ok := rr.Data.(*dnswire.SRV); ok {
+			for _, addr := range z[strings.ToLower(srv.Target)] {
+				if addr.Type == dnswire.TypeA || addr.Type == dnswire.TypeAAAA {
+					resp.Additionals = append(resp.Additionals, addr)
+				}
+			}
+		}
+	}
+	return resp
+}
+
+// parseZone parses a zone file. Errors are reported with the file name and
+// line number.
+func parseZone(r io.Reader, filename string) (zone, error) {
+	var (
+		z       = zone{}
+		p       = zoneParser{origin: ".", owner: "", ttl: -1, defaultTTL: -1}
+		scanner = bufio.NewScanner(r)
+		lineno  = 0
+		tokens  []string
+		start   int  // line number of the entry being read
+		depth   int  // of parentheses
+		blank   bool // whether the entry started with whitespace
+	)
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if depth == 0 {
+			start, tokens = lineno, nil
+			blank = len(line) > 0 && (line[0] == ' ' || line[0] == '\t')
+		}
+		more, err := tokenize(line, &depth)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		if tokens = append(tokens, more...); depth > 0 || len(tokens) <= 0 {
+			continue
+		}
+		rr, err := p.entry(tokens, blank)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, start, err)
+		}
+		if rr != nil {
+			key := strings.ToLower(rr.Name)
+			z[key] = append(z[key], *rr)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("%s:%d: unbalanced parentheses", filename, start)
+	}
+	return z, nil
+}
+
+// tokenize splits a line of a zone file into tokens, dropping comments and
+// parentheses, and tracking the depth of the latter. Quoted strings are
+// returned with their quotes, so that they can be told apart.
+func tokenize(line string, depth *int) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ';':
+			return tokens, nil
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '(':
+			*depth++
+			i++
+		case c == ')':
+			if *depth--; *depth < 0 {
+				return nil, fmt.Errorf("unbalanced parentheses")
+			}
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, line[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(line) && !strings.ContainsRune(" \t\r;()\"", rune(line[j])); j++ {
+				if line[j] == '\\' {
+					j++
+				}
+			}
+			if j > len(line) {
+				j = len(line)
+			}
+			tokens = append(tokens, line[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// zoneParser holds the state carried from entry to entry in a zone file.
+type zoneParser struct {
+	origin     string
+	owner      string // of the last record
+	ttl        int64  // of the last record, or -1
+	defaultTTL int64  // set by $TTL, or -1
+}
+
+// entry parses the tokens of an entry. It returns nil for directives and
+// records that are ignored.
+func (p *zoneParser) entry(tokens []string, blank bool) (*dnswire.RR, error) {
+	switch strings.ToUpper(tokens[0]) {
+	case "$ORIGIN":
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("$ORIGIN takes a name")
+		}
+		p.origin = p.name(tokens[1])
+		return nil, nil
+	case "$TTL":
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("$TTL takes a TTL")
+		}
+		ttl, err := parseTTL(tokens[1])
+		if err != nil {
+			return nil, err
+		}
+		p.defaultTTL = ttl
+		return nil, nil
+	case "$INCLUDE", "$GENERATE":
+		return nil, fmt.Errorf("%s isn't supported", tokens[0])
+	}
+
+	if !blank {
+		p.owner, tokens = p.name(tokens[0]), tokens[1:]
+	}
+	if p.owner == "" {
+		return nil, fmt.Errorf("no owner name")
+	}
+
+	// The TTL and class come in either order, and are both optional.
+	ttl := int64(-1)
+	for len(tokens) > 0 {
+		if t, err := parseTTL(tokens[0]); err == nil && ttl < 0 {
+			ttl, tokens = t, tokens[1:]
+			continue
+		}
+		if c := strings.ToUpper(tokens[0]); c == "IN" || c == "CH" || c == "HS" || c == "CS" {
+			if c != "IN" {
+				return nil, fmt.Errorf("class %s isn't supported", c)
+			}
+			tokens = tokens[1:]
+			continue
+		}
+		break
+	}
+	switch {
+	case ttl >= 0:
+	case p.defaultTTL >= 0:
+		ttl = p.defaultTTL
+	case p.ttl >= 0:
+		ttl = p.ttl // RFC 1035 section 5.1
+	default:
+		return nil, fmt.Errorf("no TTL, and no $TTL")
+	}
+	p.ttl = ttl
+	if len(tokens) <= 0 {
+		return nil, fmt.Errorf("no record type")
+	}
+
+	rr := &dnswire.RR{Name: p.owner, Class: dnswire.ClassINET, TTL: uint32(ttl)}
+	typ, rdata := strings.ToUpper(tokens[0]), tokens[1:]
+	switch typ {
+	case "SRV":
+		if len(rdata) != 4 {
+			return nil, fmt.Errorf("SRV takes a priority, weight, port and target")
+		}
+		var fields [3]uint16
+		for i := range fields {
+			n, err := strconv.ParseUint(rdata[i], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("bad SRV field %q", rdata[i])
+			}
+			fields[i] = uint16(n)
+		}
+		rr.Type = dnswire.TypeSRV
+		rr.Data = &dnswire.SRV{Priority: fields[0], Weight: fields[1], Port: fields[2], Target: p.name(rdata[3])}
+
+	case "A", "AAAA":
+		if len(rdata) != 1 {
+			return nil, fmt.Errorf("%s takes an address", typ)
+		}
+		ip := net.ParseIP(rdata[0])
+		switch {
+		case ip == nil:
+			return nil, fmt.Errorf("bad address %q", rdata[0])
+		case typ == "A" && ip.To4() != nil:
+			rr.Type, rr.Data = dnswire.TypeA, &dnswire.A{IP: ip.To4()}
+		case typ == "AAAA" && ip.To4() == nil:
+			rr.Type, rr.Data = dnswire.TypeAAAA, &dnswire.AAAA{IP: ip}
+		default:
+			return nil, fmt.Errorf("bad %s address %q", typ, rdata[0])
+		}
+
+	case "CNAME":
+		if len(rdata) != 1 {
+			return nil, fmt.Errorf("CNAME takes a name")
+		}
+		rr.Type, rr.Data = dnswire.TypeCNAME, &dnswire.CNAME{Target: p.name(rdata[0])}
+
+	case "PTR":
+		if len(rdata) != 1 {
+			return nil, fmt.Errorf("PTR takes a name")
+		}
+		rr.Type, rr.Data = dnswire.TypePTR, &dnswire.PTR{Target: p.name(rdata[0])}
+
+	case "TXT":
+		if len(rdata) <= 0 {
+			return nil, fmt.Errorf("TXT takes at least one string")
+		}
+		strs := make([]string, len(rdata))
+		for i, s := range rdata {
+			strs[i] = unescape(strings.Trim(s, `"`))
+		}
+		rr.Type, rr.Data = dnswire.TypeTXT, &dnswire.TXT{Strings: strs}
+
+	default:
+		return nil, nil
+	}
+	return rr, nil
+}
+
+// name makes a domain name in a zone file fully qualified.
+func (p *zoneParser) name(s string) string {
+	switch {
+	case s == "@":
+		return p.origin
+	case strings.HasSuffix(s, "."):
+		return s
+	case p.origin == ".":
+		return s + "."
+	default:
+		return s + "." + p.origin
+	}
+}
+
+// parseTTL parses a TTL in seconds, or with the units of BIND, e.g. "1h30m".
+func parseTTL(s string) (int64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty TTL")
+	}
+	if n, err := strconv.ParseUint(s, 10, 31); err == nil {
+		return int64(n), nil
+	}
+	var (
+		total int64
+		n     int64
+		digit bool
+	)
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			n, digit = n*10+int64(c-'0'), true
+			continue
+		}
+		unit, ok := map[rune]int64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}[c]
+		if !ok || !digit {
+			return 0, fmt.Errorf("bad TTL %q", s)
+		}
+		total, n, digit = total+n*unit, 0, false
+	}
+	if digit || total > 1<<31-1 {
+		return 0, fmt.Errorf("bad TTL %q", s)
+	}
+	return total, nil
+}
+
+// unescape resolves the \X and \DDD escapes of a character string.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 10, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i+1])
+		i++
+	}
+	return b.String()
+}
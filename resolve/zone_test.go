@@ -0,0 +1,140 @@
+package resolve_test
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/srvproxy/resolve"
+)
+
+const testZone = `
+$ORIGIN prod.internal.
+$TTL 1h
+@                 IN SOA ns1 hostmaster ( 2024010101 ; serial
+                         3600 600 86400 60 )
+_http._tcp.users  60 IN SRV 10 5 8080 users-1
+                  IN 60 SRV 10 5 8080 users-2
+                  SRV   20 0 8080 backup.example.com.
+users-1           A     10.0.0.1
+users-1           AAAA  2001:db8::1
+users-2       30  A     10.0.0.2
+_http._tcp.api    300   CNAME _http._tcp.users
+_http._tcp.users  TXT   "zone=us-east-1a" "note=a \"quoted\" value"
+`
+
+func TestZoneFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prod.zone")
+	writeFile(t, path, testZone)
+
+	r, err := resolve.ZoneFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []resolve.Endpoint{
+		{Address: "users-1.prod.internal", Port: 8080, Priority: 10, Weight: 5},
+		{Address: "users-2.prod.internal", Port: 8080, Priority: 10, Weight: 5},
+		{Address: "backup.example.com", Port: 8080, Priority: 20},
+	}
+	for _, name := range []string{"_http._tcp.users.prod.internal", "_HTTP._tcp.api.prod.internal."} {
+		endpoints, ttl, err := r.Resolve(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(want, endpoints) {
+			t.Errorf("%s: want %+v, have %+v", name, want, endpoints)
+		}
+		if want, have := time.Minute, ttl; want != have {
+			t.Errorf("%s: want TTL %s, have %s", name, want, have)
+		}
+	}
+
+	_, _, err = r.Resolve("_http._tcp.unknown.prod.internal")
+	if e, ok := err.(*net.DNSError); !ok || !e.IsNotFound {
+		t.Errorf("want not-found *net.DNSError, have %#v", err)
+	}
+}
+
+func TestZoneFileExpandTargets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prod.zone")
+	writeFile(t, path, testZone)
+
+	r, err := resolve.ZoneFile(path, resolve.ExpandTargets(true), resolve.Search("prod.internal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints, ttl, err := r.Resolve("_http._tcp.users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, endpoint := range endpoints {
+		have = append(have, endpoint.String())
+	}
+	// backup.example.com has no addresses in the zone, and there's nowhere
+	// else to look, so it's dropped.
+	// users-1 splits its weight between its two addresses.
+	want := []string{"10.0.0.2:8080", "10.0.0.1:8080", "[2001:db8::1]:8080"}
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want, have := 30*time.Second, ttl; want != have {
+		t.Errorf("want TTL %s, have %s", want, have)
+	}
+}
+
+func TestZoneFileDNSSD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prod.zone")
+	writeFile(t, path, `
+$ORIGIN prod.internal.
+$TTL 60
+_http._tcp         PTR  a._http._tcp
+a._http._tcp       SRV  0 0 8080 users-1
+a._http._tcp       TXT  "version=2"
+`)
+
+	r, err := resolve.ZoneFile(path, resolve.DNSSD(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints, _, err := r.Resolve("_http._tcp.prod.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resolve.Endpoint{{Address: "users-1.prod.internal", Port: 8080, Labels: map[string]string{
+		"version":             "2",
+		resolve.InstanceLabel: "a._http._tcp.prod.internal",
+	}}}
+	if !reflect.DeepEqual(want, endpoints) {
+		t.Errorf("want %+v, have %+v", want, endpoints)
+	}
+
+	if _, err := resolve.ZoneFile(path, resolve.SVCBRecords(true)); err == nil {
+		t.Error("want error for SVCB records, have none")
+	}
+}
+
+func TestZoneFileErrors(t *testing.T) {
+	for _, contents := range []string{
+		"users 60 SRV 10 5 8080\n",
+		"users SRV 10 5 8080 a\n", // no TTL
+		"users 60 A 2001:db8::1\n",
+		"users 60 CH TXT \"a\"\n",
+		"users 60 TXT \"unterminated\n",
+		"users 60 SRV ( 10 5 8080 a\n",
+		"$INCLUDE other.zone\n",
+	} {
+		path := filepath.Join(t.TempDir(), "bad.zone")
+		writeFile(t, path, contents)
+		if _, err := resolve.ZoneFile(path); err == nil {
+			t.Errorf("%q: want error, have none", contents)
+		}
+	}
+
+	if _, err := resolve.ZoneFile(filepath.Join(t.TempDir(), "missing.zone")); err == nil {
+		t.Errorf("want error for missing file, have none")
+	}
+}